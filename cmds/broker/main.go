@@ -2,32 +2,198 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
+	"flag"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/rs/zerolog/log"
 	"github.com/threefoldtech/tfagent/pkg"
 	"github.com/threefoldtech/tfagent/pkg/stores"
 )
 
+const peerCacheTTL = 10 * time.Minute
+
 func main() {
-	ctx := context.Background()
+	var (
+		port       uint
+		bootstrap  string
+		noPublic   bool
+		private    bool
+		dhtPrefix  string
+		dhtServer  bool
+		pskPath    string
+		listenAddr string
+		adminAddr  string
+		adminToken string
+		metrics    string
+		metricsAt  string
+		logLevel   string
+		tlsCert    string
+		tlsKey     string
+		tlsSelf    bool
+		tlsCA      string
+		socket     string
+		socketMode string
+		socketTwin uint64
+		wsAddr     string
+		wsPath     string
+		wsOrigins  string
+		restAddr   string
+		substrate  string
+		limits     = pkg.DefaultLimits()
+	)
+
+	flag.UintVar(&port, "port", pkg.DefaultPort, "port to accept RESP connections on")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate file, serves TLS on the RESP port if set")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM key file of the certificate")
+	flag.BoolVar(&tlsSelf, "tls-self-signed", false, "serve TLS with a self-signed certificate, written to -tls-cert and -tls-key if they are set and don't exist")
+	flag.StringVar(&tlsCA, "tls-client-ca", "", "PEM file of CAs client certificates must be signed by, requires TLS")
+	flag.StringVar(&socket, "socket", "", "path of a unix socket to accept RESP connections on, in addition to the port")
+	flag.StringVar(&socketMode, "socket-mode", "0600", "file mode of the unix socket, in octal")
+	flag.Uint64Var(&socketTwin, "socket-twin", 0, "twin connections on the unix socket are authenticated as without AUTH, disabled if 0")
+	flag.StringVar(&wsAddr, "ws", "", "address to accept RESP over WebSocket connections on, e.g. :8890. Served over TLS like the RESP port")
+	flag.StringVar(&wsPath, "ws-path", "/", "path of the WebSocket endpoint")
+	flag.StringVar(&wsOrigins, "ws-origins", "", "comma separated list of origins browsers can connect to the WebSocket endpoint from, * for all. Defaults to the origin of the endpoint")
+	flag.IntVar(&limits.MaxConnections, "max-clients", limits.MaxConnections, "maximum number of RESP connections, unlimited if 0")
+	flag.IntVar(&limits.MaxConnectionsPerIP, "max-clients-per-ip", limits.MaxConnectionsPerIP, "maximum number of RESP connections per remote IP address, unlimited if 0")
+	flag.DurationVar(&limits.AuthTimeout, "auth-timeout", limits.AuthTimeout, "time RESP connections have to authenticate, disabled if 0")
+	flag.DurationVar(&limits.IdleTimeout, "idle-timeout", limits.IdleTimeout, "close authenticated RESP connections which are idle for this long, disabled if 0")
+	flag.DurationVar(&limits.WriteTimeout, "write-timeout", limits.WriteTimeout, "time RESP clients have to read a reply, disabled if 0")
+	flag.StringVar(&listenAddr, "p2p-listen", "", "comma separated list of multiaddrs for the p2p host to listen on")
+	flag.StringVar(&bootstrap, "bootstrap", "", "comma separated list of bootstrap peer multiaddrs")
+	flag.BoolVar(&noPublic, "no-public-bootstrap", false, "don't connect to the public IPFS bootstrap peers")
+	flag.StringVar(&dhtPrefix, "dht-prefix", "", "protocol prefix of the DHT, e.g. "+pkg.PrivateDHTProtocolPrefix)
+	flag.BoolVar(&dhtServer, "dht-server", false, "always run the DHT in server mode")
+	flag.BoolVar(&private, "private", false, "run a private DHT, shorthand for -no-public-bootstrap -dht-prefix "+pkg.PrivateDHTProtocolPrefix+" -dht-server")
+	flag.StringVar(&pskPath, "psk", "", "path to a pre shared key file to run on a private libp2p network")
+	flag.StringVar(&restAddr, "rest", "", "address of the REST gateway, e.g. :8891. Served over TLS like the RESP port. Disabled if empty")
+	flag.StringVar(&adminAddr, "admin", "", "address of the admin interface, a loopback address or unix:///path/to/socket. Disabled if empty")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("TFAGENT_ADMIN_TOKEN"), "bearer token of the admin interface, defaults to $TFAGENT_ADMIN_TOKEN")
+	flag.StringVar(&metrics, "metrics", "", "address to serve prometheus metrics on, e.g. :9100. Disabled if empty")
+	flag.StringVar(&metricsAt, "metrics-path", "/metrics", "path of the metrics endpoint")
+	flag.StringVar(&substrate, "substrate", "", "websocket URL of the substrate node to look up twins on, e.g. ws://localhost:9944. Uses a mock store if empty")
+	flag.StringVar(&logLevel, "log-level", "info", "log level, one of debug, info, warn or error. Can be changed at runtime over the admin interface")
+	flag.Parse()
 
-	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	level, err := pkg.ParseLevel(logLevel)
 	if err != nil {
-		log.Fatal().Err(err).Msg("could not generate key")
-		return
+		log.Fatal().Err(err).Msg("invalid log level")
+	}
+	logger := pkg.NewZerologLogger(log.Logger)
+	logger.SetLevel(level)
+
+	cfg := pkg.P2PConfig{
+		ListenAddrs:            splitList(listenAddr),
+		BootstrapPeers:         splitList(bootstrap),
+		DisablePublicBootstrap: noPublic,
+		DHTProtocolPrefix:      dhtPrefix,
+		DHTServer:              dhtServer,
+	}
+	if private {
+		cfg.DisablePublicBootstrap = true
+		cfg.DHTServer = true
+		if cfg.DHTProtocolPrefix == "" {
+			cfg.DHTProtocolPrefix = pkg.PrivateDHTProtocolPrefix
+		}
+	}
+	if pskPath != "" {
+		psk, err := pkg.LoadPSK(pskPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not load pre shared key")
+		}
+		cfg.PrivateNetworkKey = psk
+	}
+
+	var store pkg.PeerStore = stores.MockStore{}
+	if substrate != "" {
+		client, err := stores.NewGridDB(substrate)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not connect to substrate")
+		}
+		store = stores.NewGrid(client)
+	}
+
+	opts := []pkg.Option{
+		pkg.WithPeerStore(stores.NewCache(store, peerCacheTTL)),
+		pkg.WithP2PConfig(cfg),
+		pkg.WithPort(uint16(port)),
+		pkg.WithLimits(limits),
+		pkg.WithLogger(logger),
+	}
+	var tlsCfg *pkg.TLSConfig
+	if tlsCert != "" || tlsSelf {
+		tlsCfg = &pkg.TLSConfig{
+			CertFile:     tlsCert,
+			KeyFile:      tlsKey,
+			SelfSigned:   tlsSelf,
+			ClientCAFile: tlsCA,
+		}
+		opts = append(opts, pkg.WithTLS(*tlsCfg))
+	} else if tlsCA != "" {
+		log.Fatal().Msg("-tls-client-ca requires -tls-cert or -tls-self-signed")
+	}
+	if socket != "" {
+		mode, err := strconv.ParseUint(socketMode, 8, 32)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid socket mode")
+		}
+		opts = append(opts, pkg.WithListener(pkg.ListenerConfig{
+			Address:    "unix://" + socket,
+			SocketMode: os.FileMode(mode),
+			Twin:       socketTwin,
+		}))
+	} else if socketTwin != 0 {
+		log.Fatal().Msg("-socket-twin requires -socket")
+	}
+	if wsAddr != "" {
+		opts = append(opts, pkg.WithListener(pkg.ListenerConfig{
+			Address:        "ws://" + wsAddr + wsPath,
+			TLS:            tlsCfg,
+			AllowedOrigins: splitList(wsOrigins),
+		}))
+	}
+	if restAddr != "" {
+		opts = append(opts, pkg.WithREST(pkg.RESTConfig{Address: restAddr, TLS: tlsCfg}))
+	}
+	if adminAddr != "" {
+		opts = append(opts, pkg.WithAdmin(pkg.AdminConfig{Address: adminAddr, Token: adminToken}))
 	}
 
-	store := stores.MockStore{}
-	node := pkg.NewBufferedNode(store)
-	node.Start(ctx, priv)
+	if metrics != "" {
+		opts = append(opts, pkg.WithMetrics(pkg.MetricsConfig{Address: metrics, Path: metricsAt}))
+	}
 
-	server, err := pkg.NewServer(ctx, 8888, store, node)
+	agent, err := pkg.New(opts...)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to get server")
+		log.Fatal().Err(err).Msg("could not create agent")
 	}
-	defer server.Close()
 
-	server.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		cancel()
+	}()
+
+	if err = agent.Run(ctx); err != nil {
+		log.Fatal().Err(err).Msg("agent failed")
+	}
+}
+
+// splitList splits a comma separated list, ignoring empty elements
+func splitList(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
 }
@@ -7,12 +7,15 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/threefoldtech/tfagent/pkg"
 )
 
+const sendTimeout = time.Second * 20
+
 func main() {
 	shouldReply := true
 	ctx, cancel := context.WithCancel(context.Background())
@@ -29,15 +32,15 @@ func main() {
 		return
 	}
 
-	nodes := make(map[peer.ID]*pkg.ConnectionManager)
+	nodes := make(map[peer.ID]*pkg.P2PNode)
 	for i := 0; i < amount; i++ {
-		conmgr := pkg.ConnectionManager{}
+		node := pkg.NewP2PNode(pkg.P2PConfig{})
 		priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
 		if err != nil {
 			fmt.Println("could not generate key", err.Error())
 			return
 		}
-		if err = conmgr.Start(ctx, priv); err != nil {
+		if err = node.Start(ctx, priv); err != nil {
 			fmt.Println("could not start host:", err.Error())
 			return
 		}
@@ -51,17 +54,25 @@ func main() {
 				select {
 				case <-ctx.Done():
 					return
-				case msg := <-conmgr.Messages:
-					fmt.Println("Received message from", msg.Remote, "-", msg.M)
+				case msg := <-node.Messages():
+					// the topic is (ab)used to pass the peer ID of the sender
+					fmt.Println("Received message from", msg.Topic, "-", string(msg.Payload))
 					if shouldReply {
-						data := []byte(msg.M)
+						remote, err := peer.Decode(msg.Topic)
+						if err != nil {
+							fmt.Println("could not decode remote peer ID", err.Error())
+							continue
+						}
+						data := append([]byte(nil), msg.Payload...)
 						reverse(data)
-						conmgr.Send(data, msg.Remote)
+						if err = node.Send(message(node, data), peer.AddrInfo{ID: remote}, sendTimeout); err != nil {
+							fmt.Println("failed to send reply:", err.Error())
+						}
 					}
 				}
 			}
 		}()
-		nodes[pid] = &conmgr
+		nodes[pid] = node
 	}
 
 	// send message, wait untill our nodes are initialized a bit
@@ -82,7 +93,7 @@ func main() {
 			return
 		}
 
-		if err = sendPid.Send([]byte(msg), pid); err != nil {
+		if err = sendPid.Send(message(sendPid, []byte(msg)), peer.AddrInfo{ID: pid}, sendTimeout); err != nil {
 			fmt.Println("failed to send message:", err.Error())
 		}
 
@@ -95,7 +106,7 @@ func main() {
 	return
 }
 
-func getSender(nodes map[peer.ID]*pkg.ConnectionManager) *pkg.ConnectionManager {
+func getSender(nodes map[peer.ID]*pkg.P2PNode) *pkg.P2PNode {
 	for k := range nodes {
 		return nodes[k]
 	}
@@ -103,6 +114,14 @@ func getSender(nodes map[peer.ID]*pkg.ConnectionManager) *pkg.ConnectionManager
 	return nil
 }
 
+func message(from *pkg.P2PNode, payload []byte) pkg.Message {
+	return pkg.Message{
+		Topic:   from.PeerID(),
+		TTL:     time.Now().Add(time.Hour),
+		Payload: payload,
+	}
+}
+
 func reverse(b []byte) {
 	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
 		b[i], b[j] = b[j], b[i]
@@ -1,20 +1,302 @@
 package main
 
 import (
-	"crypto/ed25519"
-	"crypto/rand"
+	"bufio"
 	"encoding/hex"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfagent/pkg/keys"
+	"golang.org/x/term"
 )
 
+const usage = `Usage: signer <command> [flags]
+
+Commands:
+  generate -out file [-type sr25519]   generate a key, and print its mnemonic
+  import -out file [-type sr25519]     import a key from a mnemonic or secret URI read from stdin
+  public -key file [-format hex]       print the public key, as hex or ss58
+  sign -key file [-file path] [challenge]
+                                       sign a challenge, "A" by default as used by AUTH
+  sign-request -key file -twin id [-body file] METHOD URI
+                                       print the headers of a signed REST request, e.g.
+                                       signer sign-request ... | curl -H @- ...
+
+Keys are stored encrypted with a passphrase, which is read from
+$TFAGENT_KEY_PASSPHRASE, or prompted for.
+`
+
+// passphraseEnv is the environment variable holding the passphrase of keys
+const passphraseEnv = "TFAGENT_KEY_PASSPHRASE"
+
+var errUsage = errors.New("invalid arguments")
+
+// stdin is shared, so buffered input is not lost between reads
+var stdin = bufio.NewReader(os.Stdin)
+
+type command func(args []string) error
+
+var commands = map[string]command{
+	"generate":     generate,
+	"import":       importKey,
+	"public":       public,
+	"sign":         sign,
+	"sign-request": signRequest,
+}
+
 func main() {
-	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	err := cmd(os.Args[2:])
+	if errors.Is(err, errUsage) {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "signer:", err)
+		os.Exit(1)
+	}
+}
+
+func generate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	typ := fs.String("type", string(keys.Sr25519), "key type, sr25519 or ed25519")
+	out := fs.String("out", "", "file to store the key in")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *out == "" {
+		return errUsage
+	}
+
+	t, err := keys.ParseType(*typ)
+	if err != nil {
+		return err
+	}
+
+	key, mnemonic, err := keys.Generate(t)
+	if err != nil {
+		return err
+	}
+
+	if err = save(*out, key); err != nil {
+		return err
+	}
+
+	fmt.Println("mnemonic:", mnemonic)
+	fmt.Println("write down the mnemonic, it is the only way to restore the key")
+	return printPublic(key)
+}
+
+func importKey(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	typ := fs.String("type", string(keys.Sr25519), "key type, sr25519 or ed25519. Grid accounts use sr25519")
+	out := fs.String("out", "", "file to store the key in")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *out == "" {
+		return errUsage
+	}
+
+	t, err := keys.ParseType(*typ)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	msg := "A"
+	// the secret is not taken as argument, so it doesn't end up in the
+	// shell history
+	uri, err := readSecret("mnemonic or secret URI: ")
+	if err != nil {
+		return err
+	}
+
+	key, err := keys.FromURI(t, uri)
+	if err != nil {
+		return err
+	}
+
+	if err = save(*out, key); err != nil {
+		return err
+	}
+
+	return printPublic(key)
+}
+
+func public(args []string) error {
+	fs := flag.NewFlagSet("public", flag.ContinueOnError)
+	path := fs.String("key", "", "key file")
+	format := fs.String("format", "hex", "output format, hex or ss58")
+	network := fs.Uint("network", keys.DefaultNetwork, "ss58 network prefix")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *path == "" {
+		return errUsage
+	}
+
+	key, err := load(*path)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "hex":
+		fmt.Println(hex.EncodeToString(key.Public()))
+	case "ss58":
+		addr, err := key.SS58(uint8(*network))
+		if err != nil {
+			return err
+		}
+		fmt.Println(addr)
+	default:
+		return errUsage
+	}
+
+	return nil
+}
+
+func sign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	path := fs.String("key", "", "key file")
+	file := fs.String("file", "", "sign the content of this file instead of a challenge")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 || *path == "" {
+		return errUsage
+	}
+
+	msg := []byte(keys.AuthChallenge)
+	if fs.NArg() == 1 {
+		msg = []byte(fs.Arg(0))
+	}
+	if *file != "" {
+		if fs.NArg() != 0 {
+			return errUsage
+		}
+		var err error
+		if msg, err = ioutil.ReadFile(*file); err != nil {
+			return errors.Wrap(err, "could not read file")
+		}
+	}
+
+	key, err := load(*path)
+	if err != nil {
+		return err
+	}
+
+	sig, err := key.Sign(msg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hex.EncodeToString(sig))
+	return nil
+}
+
+func signRequest(args []string) error {
+	fs := flag.NewFlagSet("sign-request", flag.ContinueOnError)
+	path := fs.String("key", "", "key file")
+	twin := fs.Uint64("twin", 0, "id of the twin owning the key")
+	file := fs.String("body", "", "file with the body of the request")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 || *path == "" || *twin == 0 {
+		return errUsage
+	}
+
+	var body []byte
+	if *file != "" {
+		var err error
+		if body, err = ioutil.ReadFile(*file); err != nil {
+			return errors.Wrap(err, "could not read body")
+		}
+	}
+
+	key, err := load(*path)
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	nonce := uuid.New().String()
+	sig, err := key.Sign(keys.RequestMessage(fs.Arg(0), fs.Arg(1), timestamp, nonce, body))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d\n", keys.HeaderTwin, *twin)
+	fmt.Printf("%s: %d\n", keys.HeaderTimestamp, timestamp)
+	fmt.Printf("%s: %s\n", keys.HeaderNonce, nonce)
+	fmt.Printf("%s: %s\n", keys.HeaderSignature, hex.EncodeToString(sig))
+	return nil
+}
+
+func printPublic(key *keys.Key) error {
+	addr, err := key.SS58(keys.DefaultNetwork)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("type:", key.Type())
+	fmt.Println("public key:", hex.EncodeToString(key.Public()))
+	fmt.Println("ss58 address:", addr)
+	return nil
+}
+
+func save(path string, key *keys.Key) error {
+	passphrase, err := passphrase(true)
+	if err != nil {
+		return err
+	}
+	return keys.Save(path, key, passphrase)
+}
+
+func load(path string) (*keys.Key, error) {
+	passphrase, err := passphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	return keys.Load(path, passphrase)
+}
+
+// passphrase of the key file, confirmed if it is for a new file
+func passphrase(confirm bool) (string, error) {
+	if p, ok := os.LookupEnv(passphraseEnv); ok {
+		return p, nil
+	}
+
+	p, err := readSecret("passphrase: ")
+	if err != nil || !confirm {
+		return p, err
+	}
+
+	again, err := readSecret("repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if p != again {
+		return "", errors.New("passphrases don't match")
+	}
+
+	return p, nil
+}
+
+// readSecret reads a line from stdin, without echoing it if stdin is a
+// terminal
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.Wrap(err, "could not read secret")
+		}
+		return strings.TrimSpace(line), nil
+	}
 
-	fmt.Println("hex sig", hex.EncodeToString(ed25519.Sign(priv, []byte(msg))))
-	fmt.Println("hex key", hex.EncodeToString(pub))
+	fmt.Fprint(os.Stderr, prompt)
+	data, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return strings.TrimSpace(string(data)), errors.Wrap(err, "could not read secret")
 }
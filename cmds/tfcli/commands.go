@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfagent/pkg/client"
+)
+
+// pingTopic is the topic of the ping and pong commands
+const pingTopic = "tfcli.ping"
+
+type command func(ctx context.Context, c *client.Client, args []string) error
+
+var commands = map[string]command{
+	"send":  send,
+	"recv":  recv,
+	"tail":  tail,
+	"len":   length,
+	"range": listRange,
+	"ping":  ping,
+	"pong":  pong,
+}
+
+// message is the JSON output of a message
+type message struct {
+	ID      string `json:"id,omitempty"`
+	Sender  uint64 `json:"sender"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+}
+
+func printMessage(msg client.Message) error {
+	return json.NewEncoder(os.Stdout).Encode(message{
+		ID:      msg.ID,
+		Sender:  msg.Sender,
+		Topic:   msg.Topic,
+		Payload: string(msg.Payload),
+	})
+}
+
+// filterFlags creates a flag set with the flags which select messages from the
+// mailbox
+func filterFlags(name string) (*flag.FlagSet, *uint64, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	from := fs.Uint64("from", 0, "only messages from this twin, all twins if 0")
+	topic := fs.String("topic", "", "only messages on this topic, all topics if empty")
+	return fs, from, topic
+}
+
+func send(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+
+	dtid, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid twin")
+	}
+
+	payload := []byte(args[2])
+	if args[2] == "-" {
+		if payload, err = ioutil.ReadAll(os.Stdin); err != nil {
+			return errors.Wrap(err, "could not read payload")
+		}
+	}
+
+	id, err := c.Send(ctx, dtid, args[1], payload)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(id)
+	return nil
+}
+
+func recv(ctx context.Context, c *client.Client, args []string) error {
+	fs, from, topic := filterFlags("recv")
+	wait := fs.Duration("wait", 0, "wait this long for a message, only checks once if 0")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	var msg client.Message
+	var err error
+	if *wait > 0 {
+		ctx, cancel := context.WithTimeout(ctx, *wait)
+		defer cancel()
+		msg, err = c.BlockingReceive(ctx, *from, *topic)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = client.ErrNoMessage
+		}
+	} else {
+		msg, err = c.Receive(ctx, *from, *topic)
+	}
+	if err != nil {
+		return err
+	}
+
+	return printMessage(msg)
+}
+
+func tail(ctx context.Context, c *client.Client, args []string) error {
+	fs, from, topic := filterFlags("tail")
+	consume := fs.Bool("consume", false, "pop the messages from the mailbox as they are printed")
+	interval := fs.Duration("interval", time.Second, "how often the mailbox is listed for new messages, unless consuming")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	if *consume {
+		sub := c.Subscribe(ctx, *from, *topic)
+		defer sub.Close()
+
+		for msg := range sub.Messages() {
+			if err := printMessage(msg); err != nil {
+				return err
+			}
+		}
+
+		return sub.Err()
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	// the messages stay in the mailbox, so the ones which were printed
+	// already are skipped
+	printed := make(map[string]bool)
+	for {
+		messages, err := c.Range(ctx, *from, *topic, 0, -1)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		listed := make(map[string]bool, len(messages))
+		for _, msg := range messages {
+			listed[msg.ID] = true
+			if printed[msg.ID] {
+				continue
+			}
+			if err := printMessage(msg); err != nil {
+				return err
+			}
+		}
+		// forget the messages which left the mailbox
+		printed = listed
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func length(ctx context.Context, c *client.Client, args []string) error {
+	fs, from, topic := filterFlags("len")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	n, err := c.Len(ctx, *from, *topic)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(n)
+	return nil
+}
+
+func listRange(ctx context.Context, c *client.Client, args []string) error {
+	fs, from, topic := filterFlags("range")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	// all messages by default
+	bounds := []int{0, -1}
+	if fs.NArg() > len(bounds) {
+		return errUsage
+	}
+	var err error
+	for i, arg := range fs.Args() {
+		if bounds[i], err = strconv.Atoi(arg); err != nil {
+			return errors.Wrap(err, "invalid range")
+		}
+	}
+
+	messages, err := c.Range(ctx, *from, *topic, bounds[0], bounds[1])
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		if err := printMessage(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ping(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ContinueOnError)
+	count := fs.Int("count", 4, "amount of pings to send")
+	interval := fs.Duration("interval", time.Second, "time between pings")
+	timeout := fs.Duration("timeout", 10*time.Second, "time to wait for a pong")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+
+	dtid, err := strconv.ParseUint(fs.Arg(0), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid twin")
+	}
+
+	var received int
+	var min, max, total time.Duration
+	for i := 1; i <= *count && ctx.Err() == nil; i++ {
+		if i > 1 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(*interval):
+			}
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, *timeout)
+		start := time.Now()
+		_, err := c.Call(callCtx, dtid, pingTopic, []byte(strconv.Itoa(i)))
+		rtt := time.Since(start)
+		cancel()
+
+		if errors.Is(err, client.ErrTimeout) {
+			fmt.Printf("ping %d to twin %d: timeout\n", i, dtid)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Printf("pong %d from twin %d: time=%s\n", i, dtid, durationMs(rtt))
+		received++
+		total += rtt
+		if min == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+	}
+
+	fmt.Printf("%d pings, %d pongs", *count, received)
+	if received > 0 {
+		fmt.Printf(", min/avg/max = %s/%s/%s", durationMs(min), durationMs(total/time.Duration(received)), durationMs(max))
+	}
+	fmt.Println()
+
+	return nil
+}
+
+func pong(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	sub := c.Subscribe(ctx, 0, pingTopic)
+	defer sub.Close()
+
+	for msg := range sub.Messages() {
+		if _, err := c.Reply(ctx, msg.Sender, msg.Topic, msg.ID, msg.Payload); err != nil {
+			return err
+		}
+		fmt.Printf("pong %s to twin %d\n", msg.Payload, msg.Sender)
+	}
+
+	return sub.Err()
+}
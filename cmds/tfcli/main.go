@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfagent/pkg/client"
+	"github.com/threefoldtech/tfagent/pkg/keys"
+)
+
+const usage = `Usage: tfcli [flags] <command> [arguments]
+
+Commands:
+  send <dtid> <topic> <payload>     send a message, - reads the payload from stdin
+  recv [-from dtid] [-topic topic] [-wait duration]
+                                    pop a message from the mailbox
+  tail [-from dtid] [-topic topic] [-consume] [-interval duration]
+                                    print messages as they arrive, leaving them
+                                    in the mailbox unless -consume pops them
+  len [-from dtid] [-topic topic]   print the amount of messages in the mailbox
+  range [-from dtid] [-topic topic] [start] [end]
+                                    print messages without removing them
+  ping [-count n] <dtid>            measure the round trip to a twin running pong
+  pong                              answer pings from other twins
+
+Messages are printed as JSON, one per line.
+
+Flags:
+`
+
+// defaultAddr of a broker on the local machine
+const defaultAddr = "127.0.0.1:8888"
+
+// errUsage is returned for invalid arguments, the usage is printed
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	var (
+		addr    string
+		twin    uint64
+		keyPath string
+		useTLS  bool
+		tlsCA   string
+		tlsCert string
+		tlsKey  string
+	)
+
+	flag.StringVar(&addr, "addr", defaultAddr, "address of the broker, or unix:///path/to/socket")
+	flag.Uint64Var(&twin, "twin", 0, "ID of the twin to authenticate as")
+	flag.StringVar(&keyPath, "key", os.Getenv("TFCLI_KEY"), "path to the key file of the twin, or its hex encoded ed25519 seed, defaults to $TFCLI_KEY. Not needed on unix sockets trusted for the twin")
+	flag.BoolVar(&useTLS, "tls", false, "connect over TLS, implied by the other tls flags")
+	flag.StringVar(&tlsCA, "tls-ca", "", "PEM file of the CA to verify the broker with, e.g. its self-signed certificate. Defaults to the system CAs")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM file of the client certificate, for brokers requiring one")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM file of the key of the client certificate")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cmd, ok := commands[flag.Arg(0)]
+	// connections of a trusted unix socket are authenticated by the broker
+	trusted := strings.HasPrefix(addr, "unix://")
+	if !ok || twin == 0 || (keyPath == "" && !trusted) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var key client.Signer
+	var err error
+	if keyPath != "" {
+		if key, err = loadKey(keyPath); err != nil {
+			fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		cancel()
+	}()
+
+	var opts []client.Option
+	if useTLS || tlsCA != "" || tlsCert != "" {
+		cfg, err := tlsConfig(tlsCA, tlsCert, tlsKey)
+		if err != nil {
+			fatal(err)
+		}
+		opts = append(opts, client.WithTLS(cfg))
+	}
+
+	c, err := client.NewWithSigner(addr, twin, key, opts...)
+	if err != nil {
+		fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Connect(ctx); err != nil {
+		fatal(err)
+	}
+
+	err = cmd(ctx, c, flag.Args()[1:])
+	if errors.Is(err, errUsage) {
+		flag.Usage()
+		os.Exit(2)
+	} else if err != nil && ctx.Err() == nil {
+		fatal(err)
+	}
+}
+
+// loadKey loads a key file created by the signer, or a hex encoded ed25519
+// seed or private key. The passphrase of key files is read from
+// $TFAGENT_KEY_PASSPHRASE.
+func loadKey(path string) (client.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read key")
+	}
+
+	if keys.IsKeyFile(data) {
+		return keys.Load(path, os.Getenv("TFAGENT_KEY_PASSPHRASE"))
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode key")
+	}
+
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return keys.FromURI(keys.Ed25519, "0x"+hex.EncodeToString(raw))
+	case ed25519.PrivateKeySize:
+		return keys.FromURI(keys.Ed25519, "0x"+hex.EncodeToString(raw[:ed25519.SeedSize]))
+	default:
+		return nil, errors.Errorf("invalid key length %d", len(raw))
+	}
+}
+
+// tlsConfig verifies the broker with the CA if set, and presents the client
+// certificate if set
+func tlsConfig(caPath, certPath, keyPath string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caPath != "" {
+		data, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read CA file")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", caPath)
+		}
+	}
+
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "tfcli:", err)
+	os.Exit(1)
+}
+
+// durationMs formats a duration in milliseconds
+func durationMs(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
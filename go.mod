@@ -3,8 +3,13 @@ module github.com/threefoldtech/tfagent
 go 1.15
 
 require (
+	github.com/ChainSafe/go-schnorrkel v1.0.0
 	github.com/centrifuge/go-substrate-rpc-client/v2 v2.0.1
-	github.com/google/go-cmp v0.5.2 // indirect
+	github.com/cosmos/go-bip39 v1.0.0
+	github.com/go-redis/redis/v8 v8.11.4
+	github.com/google/uuid v1.1.5
+	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/libp2p/go-libp2p v0.13.0
 	github.com/libp2p/go-libp2p-connmgr v0.2.4
 	github.com/libp2p/go-libp2p-core v0.8.0
@@ -12,8 +17,15 @@ require (
 	github.com/libp2p/go-libp2p-quic-transport v0.10.0
 	github.com/libp2p/go-libp2p-secio v0.2.2
 	github.com/libp2p/go-libp2p-tls v0.1.3
+	github.com/multiformats/go-multiaddr v0.3.1
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.9.0
 	github.com/rs/zerolog v1.19.0
 	github.com/secmask/go-redisproto v0.1.0
-	golang.org/x/text v0.3.3 // indirect
+	github.com/vedhavyas/go-subkey v1.0.3
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"strings"
+	"sync"
+)
+
+// ACLRule allows or denies messages for a digital twin, based on the sender and
+// topic of the message
+type ACLRule struct {
+	// Sender digital twin ID this rule applies to, 0 matches all senders
+	Sender uint64 `json:"sender"`
+	// Topic this rule applies to, an empty topic matches all topics
+	Topic string `json:"topic"`
+	// Allow messages matching this rule if true, deny them otherwise
+	Allow bool `json:"allow"`
+}
+
+func (r ACLRule) matches(sender uint64, topic string) bool {
+	return (r.Sender == 0 || r.Sender == sender) && (r.Topic == "" || r.Topic == topic)
+}
+
+// specificity of the rule, a rule for a specific sender is more specific than
+// a rule for a specific topic, which is more specific than a catch all rule
+func (r ACLRule) specificity() int {
+	var s int
+	if r.Sender != 0 {
+		s += 2
+	}
+	if r.Topic != "" {
+		s++
+	}
+	return s
+}
+
+func (r ACLRule) String() string {
+	policy := "deny"
+	if r.Allow {
+		policy = "allow"
+	}
+	return policy + " " + createKey(r.Sender, r.Topic)
+}
+
+// ACL keeps the access control rules of all digital twins on the broker. The
+// most specific rule matching a message decides if it is accepted. If no rule
+// matches, the message is accepted. An allow list can be created with a deny
+// rule for all senders, and allow rules for the accepted senders and topics.
+type ACL struct {
+	rules map[uint64][]ACLRule
+	lock  sync.RWMutex
+}
+
+// NewACL creates a new empty ACL
+func NewACL() *ACL {
+	return &ACL{
+		rules: make(map[uint64][]ACLRule),
+	}
+}
+
+// Set a rule for the receiving digital twin. An existing rule for the same
+// sender and topic is replaced.
+func (a *ACL) Set(receiver uint64, rule ACLRule) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rules := a.rules[receiver]
+	for i := range rules {
+		if rules[i].Sender == rule.Sender && rules[i].Topic == rule.Topic {
+			rules[i].Allow = rule.Allow
+			return
+		}
+	}
+
+	a.rules[receiver] = append(rules, rule)
+}
+
+// Remove the rule for the given sender and topic from the receiving digital
+// twin. Returns true if a rule was removed.
+func (a *ACL) Remove(receiver uint64, sender uint64, topic string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rules := a.rules[receiver]
+	for i := range rules {
+		if rules[i].Sender == sender && rules[i].Topic == topic {
+			a.rules[receiver] = append(rules[:i], rules[i+1:]...)
+			if len(a.rules[receiver]) == 0 {
+				delete(a.rules, receiver)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reset removes all rules of the receiving digital twin
+func (a *ACL) Reset(receiver uint64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.rules, receiver)
+}
+
+// Rules of the receiving digital twin, in the order they were added
+func (a *ACL) Rules(receiver uint64) []ACLRule {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return append([]ACLRule(nil), a.rules[receiver]...)
+}
+
+// Permitted checks if the message may be delivered to its receiver
+func (a *ACL) Permitted(msg Message) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	rules := a.rules[msg.Receiver]
+
+	var match *ACLRule
+	for i := range rules {
+		r := &rules[i]
+		if !r.matches(msg.Sender, msg.Topic) {
+			continue
+		}
+		if match == nil || r.specificity() > match.specificity() {
+			match = r
+		}
+	}
+
+	return match == nil || match.Allow
+}
+
+// parseACLKey parses the key of an ACL rule. This is the same as a regular key,
+// but the separator and topic can be omitted to match all topics
+func parseACLKey(key string) (uint64, string, error) {
+	if !strings.Contains(key, keySeparator) {
+		key += keySeparator
+	}
+	return parseKey(key)
+}
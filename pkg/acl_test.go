@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestACLPermitted(t *testing.T) {
+	acl := NewACL()
+	acl.Set(1, ACLRule{Sender: 0, Allow: false})
+	acl.Set(1, ACLRule{Sender: 2, Allow: true})
+	acl.Set(1, ACLRule{Sender: 2, Topic: "secret", Allow: false})
+	acl.Set(1, ACLRule{Topic: "public", Allow: true})
+	acl.Set(1, ACLRule{Sender: 3, Allow: false})
+
+	cases := []struct {
+		msg       Message
+		permitted bool
+	}{
+		// catch all deny rule
+		{Message{Sender: 4, Receiver: 1, Topic: "chat"}, false},
+		// topic rules are more specific than the catch all rule
+		{Message{Sender: 4, Receiver: 1, Topic: "public"}, true},
+		// sender rules are more specific than topic rules
+		{Message{Sender: 2, Receiver: 1, Topic: "chat"}, true},
+		{Message{Sender: 3, Receiver: 1, Topic: "public"}, false},
+		// sender and topic rules are the most specific
+		{Message{Sender: 2, Receiver: 1, Topic: "secret"}, false},
+		// rules are per receiver
+		{Message{Sender: 4, Receiver: 2, Topic: "chat"}, true},
+	}
+
+	for _, tc := range cases {
+		if permitted := acl.Permitted(tc.msg); permitted != tc.permitted {
+			t.Errorf("message from %d to %d on %s: expected permitted %v, got %v",
+				tc.msg.Sender, tc.msg.Receiver, tc.msg.Topic, tc.permitted, permitted)
+		}
+	}
+}
+
+func TestACLRules(t *testing.T) {
+	acl := NewACL()
+	acl.Set(1, ACLRule{Sender: 2, Allow: false})
+	acl.Set(1, ACLRule{Topic: "spam", Allow: false})
+	// replaces the existing rule for the sender
+	acl.Set(1, ACLRule{Sender: 2, Allow: true})
+
+	expected := []ACLRule{{Sender: 2, Allow: true}, {Topic: "spam", Allow: false}}
+	rules := acl.Rules(1)
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("expected rules %v, got %v", expected, rules)
+	}
+	if rules[0].String() != "allow 2:" || rules[1].String() != "deny 0:spam" {
+		t.Errorf("unexpected rule strings %s, %s", rules[0], rules[1])
+	}
+
+	// the returned rules are a copy
+	rules[0].Allow = false
+	if !acl.Rules(1)[0].Allow {
+		t.Error("expected rules to be unaffected by changes to the returned rules")
+	}
+
+	if acl.Remove(1, 2, "spam") {
+		t.Error("expected no rule to be removed")
+	}
+	if !acl.Remove(1, 2, "") {
+		t.Error("expected rule to be removed")
+	}
+	if rules = acl.Rules(1); !reflect.DeepEqual(rules, expected[1:]) {
+		t.Errorf("expected rules %v, got %v", expected[1:], rules)
+	}
+
+	acl.Set(2, ACLRule{Sender: 1, Allow: false})
+	acl.Reset(1)
+	if rules = acl.Rules(1); len(rules) != 0 {
+		t.Errorf("expected no rules after reset, got %v", rules)
+	}
+	if rules = acl.Rules(2); len(rules) != 1 {
+		t.Errorf("expected rules of other twins to be kept, got %v", rules)
+	}
+}
+
+func TestParseACLKey(t *testing.T) {
+	cases := []struct {
+		key    string
+		sender uint64
+		topic  string
+		err    bool
+	}{
+		{"2", 2, "", false},
+		{"2:", 2, "", false},
+		{"2:chat", 2, "chat", false},
+		{"0:spam", 0, "spam", false},
+		{"a:b", 0, "", true},
+		{"2:a:b", 0, "", true},
+	}
+
+	for _, tc := range cases {
+		sender, topic, err := parseACLKey(tc.key)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.key)
+			}
+			continue
+		}
+		if err != nil || sender != tc.sender || topic != tc.topic {
+			t.Errorf("%s: expected %d %q, got %d %q (%v)", tc.key, tc.sender, tc.topic, sender, topic, err)
+		}
+	}
+}
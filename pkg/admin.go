@@ -0,0 +1,279 @@
+package pkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const unixSocketPrefix = "unix://"
+
+var (
+	errAdminNoToken      = errors.New("admin interface requires a token")
+	errAdminUnauthorized = errors.New("invalid or missing bearer token")
+	errNotCaching        = errors.New("peer store does not cache lookups")
+)
+
+// AdminConfig configures the admin interface of an agent
+type AdminConfig struct {
+	// Address to listen on. This is either a loopback tcp address, e.g.
+	// 127.0.0.1:8889, or the path of a unix socket prefixed with unix://, e.g.
+	// unix:///run/tfagent/admin.sock
+	Address string
+	// Token clients need to present as bearer token on every request
+	Token string
+}
+
+// AdminServer serves the admin http interface of an agent
+type AdminServer struct {
+	agent *Agent
+	token string
+
+	ln  net.Listener
+	srv *http.Server
+
+	ctx context.Context
+}
+
+func newAdminServer(ctx context.Context, agent *Agent, cfg AdminConfig) (*AdminServer, error) {
+	if cfg.Token == "" {
+		return nil, errAdminNoToken
+	}
+
+	ln, err := adminListen(ctx, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	as := &AdminServer{
+		agent: agent,
+		token: cfg.Token,
+		ln:    ln,
+		ctx:   ctx,
+	}
+	as.srv = &http.Server{
+		Handler:           as.router(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return as, nil
+}
+
+// adminListen only listens on loopback addresses and unix sockets, so the
+// admin interface is never exposed to the network
+func adminListen(ctx context.Context, address string) (net.Listener, error) {
+	if strings.HasPrefix(address, unixSocketPrefix) {
+		ln, err := listenUnix(ctx, strings.TrimPrefix(address, unixSocketPrefix), 0600)
+		return ln, errors.Wrap(err, "could not create admin socket")
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid admin address")
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.Errorf("admin interface must listen on a loopback address, not %q", host)
+	}
+
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", address)
+	return ln, errors.Wrap(err, "failed to create admin tcp listener")
+}
+
+// Run the admin server until the context is done
+func (as *AdminServer) Run() error {
+	go func() {
+		<-as.ctx.Done()
+		as.srv.Close()
+	}()
+
+	err := as.srv.Serve(as.ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return errors.Wrap(err, "admin server failed")
+}
+
+// Close the admin server
+func (as *AdminServer) Close() error {
+	return errors.Wrap(as.srv.Close(), "failed to close admin server")
+}
+
+func (as *AdminServer) router() http.Handler {
+	r := mux.NewRouter()
+	r.Use(as.authenticate)
+
+	r.HandleFunc("/health", as.health).Methods(http.MethodGet)
+	r.HandleFunc("/status", as.status).Methods(http.MethodGet)
+	r.HandleFunc("/clients", as.clients).Methods(http.MethodGet)
+	r.HandleFunc("/peers", as.peers).Methods(http.MethodGet)
+	r.HandleFunc("/queues", as.queues).Methods(http.MethodGet)
+	r.HandleFunc("/peerstore", as.peerStore).Methods(http.MethodGet)
+	r.HandleFunc("/mailboxes/{dtid:[0-9]+}", as.mailbox).Methods(http.MethodGet)
+	r.HandleFunc("/mailboxes/{dtid:[0-9]+}", as.purgeMailbox).Methods(http.MethodDelete)
+	r.HandleFunc("/messages/{id}/trace", as.messageTrace).Methods(http.MethodGet)
+	r.HandleFunc("/log/level", as.logLevel).Methods(http.MethodGet)
+	r.HandleFunc("/log/level", as.setLogLevel).Methods(http.MethodPut)
+
+	return r
+}
+
+// authenticate requests with the bearer token
+func (as *AdminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if !strings.HasPrefix(auth, prefix) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(as.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tfagent"`)
+			writeError(w, http.StatusUnauthorized, errAdminUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type adminStatus struct {
+	State       string          `json:"state"`
+	Version     string          `json:"version"`
+	PeerID      string          `json:"peer_id"`
+	Addrs       []string        `json:"addrs"`
+	Clients     int             `json:"clients"`
+	Peers       int             `json:"peers"`
+	Received    int             `json:"received"`
+	Sending     int             `json:"sending"`
+	Connections ConnectionStats `json:"connections"`
+}
+
+// health reports the state of the agent, with a 503 status code if it is not
+// running
+func (as *AdminServer) health(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusOK
+	if !as.agent.Healthy() {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]string{"state": as.agent.State().String()})
+}
+
+func (as *AdminServer) status(w http.ResponseWriter, r *http.Request) {
+	status := adminStatus{
+		State:       as.agent.State().String(),
+		Version:     serverVersion,
+		PeerID:      as.agent.node.PeerID(),
+		Addrs:       as.agent.node.Addrs(),
+		Clients:     len(as.agent.server.Clients()),
+		Peers:       len(as.agent.node.Peers()),
+		Connections: as.agent.server.ConnectionStats(),
+	}
+	if status.Addrs == nil {
+		status.Addrs = []string{}
+	}
+	for _, qi := range as.agent.node.Queues() {
+		status.Received += qi.Received
+		status.Sending += qi.Sending
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (as *AdminServer) clients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, as.agent.server.Clients())
+}
+
+func (as *AdminServer) peers(w http.ResponseWriter, r *http.Request) {
+	peers := as.agent.node.Peers()
+	if peers == nil {
+		peers = []PeerInfo{}
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (as *AdminServer) queues(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, as.agent.node.Queues())
+}
+
+func (as *AdminServer) peerStore(w http.ResponseWriter, r *http.Request) {
+	cs, ok := as.agent.store.(CachingStore)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errNotCaching)
+		return
+	}
+	writeJSON(w, http.StatusOK, cs.Cached())
+}
+
+func (as *AdminServer) mailbox(w http.ResponseWriter, r *http.Request) {
+	dtid, err := strconv.ParseUint(mux.Vars(r)["dtid"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid dtid"))
+		return
+	}
+	writeJSON(w, http.StatusOK, as.agent.node.Mailbox(dtid))
+}
+
+func (as *AdminServer) purgeMailbox(w http.ResponseWriter, r *http.Request) {
+	dtid, err := strconv.ParseUint(mux.Vars(r)["dtid"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid dtid"))
+		return
+	}
+
+	removed := as.agent.node.PurgeMailbox(dtid)
+	as.agent.log.WithField("dtid", dtid).WithField("removed", removed).Info("purged mailbox")
+
+	writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+func (as *AdminServer) messageTrace(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, as.agent.node.Trace(mux.Vars(r)["id"]))
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func (as *AdminServer) logLevel(w http.ResponseWriter, r *http.Request) {
+	level, err := as.agent.LogLevel()
+	if err != nil {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, logLevel{Level: level.String()})
+}
+
+func (as *AdminServer) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevel
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request body"))
+		return
+	}
+	level, err := ParseLevel(req.Level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err = as.agent.SetLogLevel(level); err != nil {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, logLevel{Level: level.String()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// the only way this fails is if the client went away
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
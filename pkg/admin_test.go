@@ -0,0 +1,234 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// agent of the running broker, using the given store
+func (h *harness) agent(store PeerStore) *Agent {
+	return &Agent{
+		store:  store,
+		node:   h.node,
+		server: h.server,
+		log:    &NOOPLogger{},
+		state:  int32(StateRunning),
+	}
+}
+
+// admin runs the admin interface of the broker, and returns a function
+// doing authenticated requests without body against it
+func (h *harness) admin(store PeerStore) func(method string, path string, out interface{}) int {
+	do := h.adminFor(h.agent(store))
+	return func(method string, path string, out interface{}) int {
+		return do(method, path, nil, out)
+	}
+}
+
+// adminFor runs the admin interface of the agent, and returns a function doing
+// authenticated requests against it
+func (h *harness) adminFor(agent *Agent) func(method string, path string, body io.Reader, out interface{}) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.t.Cleanup(cancel)
+
+	as, err := agent.setupAdminControl(ctx, AdminConfig{Address: "127.0.0.1:0", Token: "secret"})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	go as.Run()
+
+	base := fmt.Sprintf("http://%s", as.ln.Addr())
+	return func(method string, path string, body io.Reader, out interface{}) int {
+		req, err := http.NewRequest(method, base+path, body)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if out != nil {
+			if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+				h.t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+}
+
+func TestAdminListen(t *testing.T) {
+	h := newHarness(t, 1)
+	agent := h.agent(h.store)
+	ctx := context.Background()
+
+	for _, cfg := range []AdminConfig{
+		{Address: "127.0.0.1:0"},
+		{Address: "0.0.0.0:0", Token: "secret"},
+		{Address: ":0", Token: "secret"},
+		{Address: "example.com:80", Token: "secret"},
+	} {
+		if _, err := agent.setupAdminControl(ctx, cfg); err == nil {
+			t.Errorf("expected %+v to be refused", cfg)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	as, err := agent.setupAdminControl(ctx, AdminConfig{Address: unixSocketPrefix + path, Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go as.Run()
+	defer as.Close()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	req, _ := http.NewRequest(http.MethodGet, "http://admin/status", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200 over unix socket, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := newHarness(t, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	as, err := h.agent(h.store).setupAdminControl(ctx, AdminConfig{Address: "127.0.0.1:0", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go as.Run()
+
+	for header, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/status", as.ln.Addr()), nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Authorization %q: expected status %d, got %d", header, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminInspect(t *testing.T) {
+	network := NewMemoryNetwork()
+	store := newTestStore(t, 1, 2, 3)
+	h := newBroker(t, network, store, 1, 2)
+	other := newBroker(t, network, store, 3)
+	do := h.admin(store)
+
+	if err := h.client(1).Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	h.deliver(msg(3, 1, "chat", "a"), msg(3, 2, "chat", "b"), msg(3, 1, "chat", "c"))
+
+	var status adminStatus
+	if code := do(http.MethodGet, "/status", &status); code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	if status.State != "running" || status.PeerID != h.node.PeerID() || status.Clients != 1 || status.Peers != 1 || status.Received != 3 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	var clients []ClientInfo
+	do(http.MethodGet, "/clients", &clients)
+	if len(clients) != 1 || clients[0].Twin != 1 || clients[0].LastCommand != "PING" {
+		t.Errorf("unexpected clients %+v", clients)
+	}
+
+	var peers []PeerInfo
+	do(http.MethodGet, "/peers", &peers)
+	if len(peers) != 1 || peers[0].ID != other.node.PeerID() {
+		t.Errorf("unexpected peers %+v", peers)
+	}
+
+	var queues []QueueInfo
+	do(http.MethodGet, "/queues", &queues)
+	expected := []QueueInfo{{Twin: 1, Received: 2}, {Twin: 2, Received: 1}}
+	if !reflect.DeepEqual(queues, expected) {
+		t.Errorf("expected queues %+v, got %+v", expected, queues)
+	}
+
+	var mailbox []Message
+	do(http.MethodGet, "/mailboxes/1", &mailbox)
+	if len(mailbox) != 2 || string(mailbox[0].Payload) != "a" || string(mailbox[1].Payload) != "c" {
+		t.Errorf("unexpected mailbox %+v", mailbox)
+	}
+
+	var purged map[string]int
+	do(http.MethodDelete, "/mailboxes/1", &purged)
+	if purged["removed"] != 2 {
+		t.Errorf("expected 2 purged messages, got %v", purged)
+	}
+	do(http.MethodGet, "/mailboxes/1", &mailbox)
+	if len(mailbox) != 0 {
+		t.Errorf("expected empty mailbox after purge, got %+v", mailbox)
+	}
+	do(http.MethodGet, "/mailboxes/2", &mailbox)
+	if len(mailbox) != 1 {
+		t.Errorf("expected purge to leave other mailboxes alone, got %+v", mailbox)
+	}
+
+	if code := do(http.MethodGet, "/mailboxes/99999999999999999999", nil); code != http.StatusBadRequest {
+		t.Errorf("expected bad request for invalid dtid, got %d", code)
+	}
+}
+
+// cachingStore is a testStore which pretends to cache
+type cachingStore struct {
+	*testStore
+}
+
+func (cs cachingStore) Cached() []CachedTwin {
+	return []CachedTwin{{ID: 1, PeerID: "peer"}}
+}
+
+func (cs cachingStore) CacheStats() (uint64, uint64) {
+	return 3, 1
+}
+
+func TestAdminPeerStore(t *testing.T) {
+	h := newHarness(t, 1)
+
+	if code := h.admin(h.store)(http.MethodGet, "/peerstore", nil); code != http.StatusNotImplemented {
+		t.Errorf("expected not implemented for non caching store, got %d", code)
+	}
+
+	var cached []CachedTwin
+	if code := h.admin(cachingStore{h.store})(http.MethodGet, "/peerstore", &cached); code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	if len(cached) != 1 || cached[0].ID != 1 || cached[0].PeerID != "peer" {
+		t.Errorf("unexpected cache contents %+v", cached)
+	}
+}
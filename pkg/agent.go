@@ -1,13 +1,464 @@
 package pkg
 
-// Agent is the main tft agent entity
-type Agent struct { // 	network ConnectionManager
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultPort the server accepts RESP connections on
+const DefaultPort = 8888
+
+var (
+	errNoPeerStore    = errors.New("agent requires a peer store")
+	errAlreadyStarted = errors.New("agent can only be run once")
+	errNoLogLevel     = errors.New("logger does not support changing the level")
+)
+
+// State of an agent
+type State int32
+
+const (
+	// StateCreated is the state of an agent which is not yet run
+	StateCreated State = iota
+	// StateStarting is the state while the components are being started
+	StateStarting
+	// StateRunning is the state once all components are started
+	StateRunning
+	// StateStopping is the state while the components are shutting down
+	StateStopping
+	// StateStopped is the state after a clean shutdown
+	StateStopped
+	// StateFailed is the state after a component failed
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateCreated:
+		return "created"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Option configures an Agent
+type Option func(*Agent)
+
+// WithPeerStore sets the peer store used to look up digital twins. This is
+// required. If the store implements io.Closer, it is closed when the agent
+// stops.
+func WithPeerStore(store PeerStore) Option {
+	return func(a *Agent) {
+		a.store = store
+	}
+}
+
+// WithTransport sets the transport used to exchange messages with other
+// agents. Defaults to a P2PNode joining the public IPFS DHT.
+func WithTransport(transport Transport) Option {
+	return func(a *Agent) {
+		a.transport = transport
+	}
+}
+
+// WithP2PConfig uses a P2PNode with the given config as transport
+func WithP2PConfig(cfg P2PConfig) Option {
+	return func(a *Agent) {
+		a.transport = NewP2PNode(cfg)
+	}
+}
+
+// WithPrivateKey sets the identity of the agent on the network. Defaults to a
+// newly generated key.
+func WithPrivateKey(privateKey crypto.PrivKey) Option {
+	return func(a *Agent) {
+		a.privateKey = privateKey
+	}
+}
+
+// WithPort sets the port the server accepts RESP connections on. Defaults to
+// DefaultPort, 0 picks a random port.
+func WithPort(port uint16) Option {
+	return func(a *Agent) {
+		a.port = port
+	}
+}
+
+// WithTLS serves TLS on the RESP listener instead of plain TCP
+func WithTLS(cfg TLSConfig) Option {
+	return func(a *Agent) {
+		a.tlsCfg = &cfg
+	}
+}
+
+// WithListener accepts RESP connections on an additional listener, e.g. a unix
+// socket for local services. The port set with WithPort is always served.
+func WithListener(cfg ListenerConfig) Option {
+	return func(a *Agent) {
+		a.listenerCfgs = append(a.listenerCfgs, cfg)
+	}
+}
+
+// WithLimits replaces the DefaultLimits of the RESP connections
+func WithLimits(limits Limits) Option {
+	return func(a *Agent) {
+		a.limits = limits
+	}
+}
+
+// WithAdmin enables the admin interface
+func WithAdmin(cfg AdminConfig) Option {
+	return func(a *Agent) {
+		a.adminCfg = &cfg
+	}
+}
+
+// WithREST serves the REST gateway, letting twins send and receive messages
+// with signed http requests
+func WithREST(cfg RESTConfig) Option {
+	return func(a *Agent) {
+		a.restCfg = &cfg
+	}
+}
+
+// WithMetrics serves metrics on the given endpoint. Metrics are collected
+// regardless, but are not served if this is not set.
+func WithMetrics(cfg MetricsConfig) Option {
+	return func(a *Agent) {
+		a.metricsCfg = &cfg
+	}
+}
+
+// WithLogger sets the logger of the agent and its components. Defaults to a
+// ZerologLogger on the global zerolog logger.
+func WithLogger(log Log) Option {
+	return func(a *Agent) {
+		a.log = log
+	}
+}
+
+// WithTracerProvider creates spans for messages with the tracer provider. The
+// span context is propagated to remote brokers. Message events are always
+// recorded, regardless of this option.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(a *Agent) {
+		a.tracerProvider = tp
+	}
+}
+
+// Agent is the main tft agent entity. It owns the buffered node on top of the
+// transport, the RESP server and the optional admin interface.
+type Agent struct {
+	store      PeerStore
+	transport  Transport
+	privateKey crypto.PrivKey
+	port       uint16
+	tlsCfg     *TLSConfig
+	limits     Limits
+	adminCfg   *AdminConfig
+	restCfg    *RESTConfig
+	metricsCfg *MetricsConfig
+	log        Log
+
+	// listenerCfgs of additional listeners
+	listenerCfgs []ListenerConfig
+
+	tracerProvider trace.TracerProvider
+
+	node          *BufferedNode
+	server        *Server
+	admin         *AdminServer
+	rest          *RESTServer
+	metrics       *Metrics
+	metricsServer *metricsServer
+
+	state int32
+	ready chan struct{}
+}
+
+// New creates a new agent. The agent does not do anything until it is run.
+func New(opts ...Option) (*Agent, error) {
+	a := &Agent{
+		port:   DefaultPort,
+		limits: DefaultLimits(),
+		ready:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	if a.store == nil {
+		return nil, errNoPeerStore
+	}
+	if a.log == nil {
+		a.log = DefaultLogger()
+	}
+	if a.transport == nil {
+		a.transport = NewP2PNode(P2PConfig{})
+	}
+	if a.privateKey == nil {
+		var err error
+		a.privateKey, _, err = crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not generate private key")
+		}
+	}
+
+	if ls, ok := a.store.(LogSetter); ok {
+		ls.SetLogger(a.log.WithField("component", "peerstore"))
+	}
+	if ls, ok := a.transport.(LogSetter); ok {
+		ls.SetLogger(a.log.WithField("component", "transport"))
+	}
+
+	a.node = NewBufferedNode(a.store, a.transport)
+	a.node.SetLogger(a.log.WithField("component", "node"))
+	a.metrics = newMetrics(a)
+	a.node.metrics = a.metrics
+	if a.tracerProvider != nil {
+		a.node.SetTracerProvider(a.tracerProvider)
+	}
+
+	return a, nil
+}
+
+// Run the agent until the context is done, or one of its components fails. The
+// node is started first, then the server and the admin interface. Once the
+// context is done, the components are shut down, and the peer store is closed.
+// An agent can only be run once.
+func (a *Agent) Run(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&a.state, int32(StateCreated), int32(StateStarting)) {
+		return errAlreadyStarted
+	}
+	a.log.Info("starting agent")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer a.closeStore()
+
+	if err := a.start(ctx); err != nil {
+		a.setState(StateFailed)
+		return err
+	}
+
+	// the listeners are bound, so the agent can accept connections before the
+	// components are serving
+	a.setState(StateRunning)
+	close(a.ready)
+	a.log.WithField("peerID", a.node.PeerID()).WithField("addr", a.server.Addr().String()).Info("agent running")
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(a.server.Run)
+	if a.admin != nil {
+		g.Go(a.admin.Run)
+	}
+	if a.rest != nil {
+		g.Go(a.rest.Run)
+	}
+	if a.metricsServer != nil {
+		g.Go(a.metricsServer.Run)
+	}
+	g.Go(func() error {
+		<-gctx.Done()
+		a.setState(StateStopping)
+		a.log.Info("stopping agent")
+		// stop all components if one of them failed. The node and the admin
+		// interface stop on their own once the context is done, but the
+		// server blocks on accepting connections.
+		cancel()
+		a.server.Close()
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		a.setState(StateFailed)
+		return err
+	}
+
+	a.setState(StateStopped)
+	a.log.Info("agent stopped")
+	return nil
+}
+
+// start the components in order
+func (a *Agent) start(ctx context.Context) error {
+	if err := a.node.Start(ctx, a.privateKey); err != nil {
+		return errors.Wrap(err, "could not start node")
+	}
+
+	var err error
+	a.server, err = NewServer(ctx, a.port, a.store, a.node)
+	if err != nil {
+		return errors.Wrap(err, "could not create server")
+	}
+	a.server.metrics = a.metrics
+	a.server.SetLimits(a.limits)
+	a.server.SetLogger(a.log.WithField("component", "server"))
+	if a.tlsCfg != nil {
+		if err = a.server.EnableTLS(*a.tlsCfg); err != nil {
+			a.server.Close()
+			return errors.Wrap(err, "could not enable TLS")
+		}
+	}
+	for _, cfg := range a.listenerCfgs {
+		if err = a.server.Listen(cfg); err != nil {
+			a.server.Close()
+			return errors.Wrapf(err, "could not listen on %s", cfg.Address)
+		}
+	}
+
+	if a.adminCfg != nil {
+		a.admin, err = a.setupAdminControl(ctx, *a.adminCfg)
+		if err != nil {
+			a.server.Close()
+			return errors.Wrap(err, "could not set up admin interface")
+		}
+	}
+
+	if a.restCfg != nil {
+		a.rest, err = newRESTServer(ctx, a.server, a.store, *a.restCfg, a.log.WithField("component", "rest"))
+		if err != nil {
+			a.server.Close()
+			if a.admin != nil {
+				a.admin.Close()
+			}
+			return errors.Wrap(err, "could not set up REST gateway")
+		}
+	}
+
+	if a.metricsCfg != nil {
+		a.metricsServer, err = newMetricsServer(ctx, a.metrics, *a.metricsCfg)
+		if err != nil {
+			a.server.Close()
+			if a.admin != nil {
+				a.admin.Close()
+			}
+			if a.rest != nil {
+				a.rest.Close()
+			}
+			return errors.Wrap(err, "could not set up metrics endpoint")
+		}
+	}
+
+	return nil
+}
+
+func (a *Agent) closeStore() {
+	closer, ok := a.store.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		a.log.WithField("error", err).Error("could not close peer store")
+	}
+}
+
+func (a *Agent) setState(state State) {
+	atomic.StoreInt32(&a.state, int32(state))
+}
+
+// State of the agent
+func (a *Agent) State() State {
+	return State(atomic.LoadInt32(&a.state))
+}
+
+// Healthy returns true if the agent is running
+func (a *Agent) Healthy() bool {
+	return a.State() == StateRunning
+}
+
+// Ready is closed once the agent is running. It is never closed if the agent
+// fails to start.
+func (a *Agent) Ready() <-chan struct{} {
+	return a.ready
+}
+
+// Addr the server accepts RESP connections on. Only valid once the agent is
+// ready.
+func (a *Agent) Addr() net.Addr {
+	return a.server.Addr()
+}
+
+// Addrs of all listeners of the server, starting with Addr. Only valid once
+// the agent is ready.
+func (a *Agent) Addrs() []net.Addr {
+	return a.server.Addrs()
+}
+
+// AdminAddr the admin interface is listening on, nil if it is disabled. Only
+// valid once the agent is ready.
+func (a *Agent) AdminAddr() net.Addr {
+	if a.admin == nil {
+		return nil
+	}
+	return a.admin.ln.Addr()
+}
+
+// LogLevel of the logger of the agent
+func (a *Agent) LogLevel() (Level, error) {
+	ll, ok := a.log.(LevelLog)
+	if !ok {
+		return 0, errNoLogLevel
+	}
+	return ll.Level(), nil
+}
+
+// SetLogLevel changes the level of the logger of the agent, and all its
+// components, at runtime
+func (a *Agent) SetLogLevel(level Level) error {
+	ll, ok := a.log.(LevelLog)
+	if !ok {
+		return errNoLogLevel
+	}
+	ll.SetLevel(level)
+	a.log.WithField("level", level.String()).Info("changed log level")
+	return nil
+}
+
+// RESTAddr the REST gateway is listening on, nil if it is disabled. Only valid
+// once the agent is ready.
+func (a *Agent) RESTAddr() net.Addr {
+	if a.rest == nil {
+		return nil
+	}
+	return a.rest.ln.Addr()
+}
+
+// MetricsAddr the metrics are served on, nil if they are not served. Only
+// valid once the agent is ready.
+func (a *Agent) MetricsAddr() net.Addr {
+	if a.metricsServer == nil {
+		return nil
+	}
+	return a.metricsServer.ln.Addr()
+}
+
+// PeerID of the agent on the network. Only valid once the agent is ready.
+func (a *Agent) PeerID() string {
+	return a.node.PeerID()
 }
 
-// SetupAdminControl for the agent, allowing it to be controlled over an http
+// setupAdminControl for the agent, allowing it to be controlled over an http
 // interface. WARNING: this interface has full controll over the agent, including
 // wallets and their secrets
-func (a *Agent) SetupAdminControl() {
-	// r := mux.NewRouter()
-	// TODO
+func (a *Agent) setupAdminControl(ctx context.Context, cfg AdminConfig) (*AdminServer, error) {
+	return newAdminServer(ctx, a, cfg)
 }
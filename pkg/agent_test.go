@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// closingStore records if it is closed
+type closingStore struct {
+	*testStore
+	closed bool
+}
+
+func (cs *closingStore) Close() error {
+	cs.closed = true
+	return nil
+}
+
+// runAgent runs the agent in the background, and waits until it is ready
+func runAgent(t *testing.T, agent *Agent) (context.CancelFunc, <-chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	errs := make(chan error, 1)
+	go func() { errs <- agent.Run(ctx) }()
+
+	select {
+	case <-agent.Ready():
+	case err := <-errs:
+		t.Fatalf("agent failed to start: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not become ready")
+	}
+
+	return cancel, errs
+}
+
+func TestAgentRequiresStore(t *testing.T) {
+	if _, err := New(); err != errNoPeerStore {
+		t.Errorf("expected missing store error, got %v", err)
+	}
+}
+
+func TestAgentLifecycle(t *testing.T) {
+	store := &closingStore{testStore: newTestStore(t, 1)}
+	agent, err := New(
+		WithPeerStore(store),
+		WithTransport(NewMemoryNetwork().NewTransport()),
+		WithPort(0),
+		WithAdmin(AdminConfig{Address: "127.0.0.1:0", Token: "secret"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.State() != StateCreated {
+		t.Errorf("expected created state, got %s", agent.State())
+	}
+
+	cancel, errs := runAgent(t, agent)
+	if !agent.Healthy() {
+		t.Errorf("expected running agent to be healthy, got %s", agent.State())
+	}
+	store.SetPeerID(1, agent.PeerID())
+
+	ctx := context.Background()
+	sig := store.sig(1)
+	client := redis.NewClient(&redis.Options{
+		Addr: agent.Addr().String(),
+		OnConnect: func(ctx context.Context, cn *redis.Conn) error {
+			return cn.Process(ctx, redis.NewStatusCmd(ctx, "AUTH", 1, sig))
+		},
+		MaxRetries: -1,
+	})
+	defer client.Close()
+	if err = client.Do(ctx, "LPUSH", "1:self", "hello").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/health", agent.AdminAddr()), nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected healthy status code, got %d", resp.StatusCode)
+	}
+
+	cancel()
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Errorf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+
+	if agent.State() != StateStopped {
+		t.Errorf("expected stopped state, got %s", agent.State())
+	}
+	if !store.closed {
+		t.Error("expected store to be closed")
+	}
+	// existing client connections are closed as well
+	if err = client.Ping(ctx).Err(); err == nil {
+		t.Error("expected client connection to be closed")
+	}
+	if err = agent.Run(ctx); err != errAlreadyStarted {
+		t.Errorf("expected agent to only run once, got %v", err)
+	}
+}
+
+func TestAgentStartFailure(t *testing.T) {
+	agent, err := New(
+		WithPeerStore(newTestStore(t)),
+		WithTransport(NewMemoryNetwork().NewTransport()),
+		WithPort(0),
+		WithAdmin(AdminConfig{Address: "0.0.0.0:0", Token: "secret"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = agent.Run(context.Background()); err == nil {
+		t.Fatal("expected agent with public admin address to fail")
+	}
+	if agent.State() != StateFailed {
+		t.Errorf("expected failed state, got %s", agent.State())
+	}
+}
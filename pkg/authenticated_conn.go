@@ -1,9 +1,14 @@
 package pkg
 
 import (
+	"bytes"
+	"context"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type authenticatedConn struct {
@@ -16,6 +21,7 @@ const defaultMsgTTL = time.Hour
 
 var errAlreadyAuthenticated = errors.New("already authenticated")
 var errNoMessage = errors.New("no message for the given filter")
+var errZeroRank = errors.New("RANK can't be zero")
 
 func newAuthenticatedConn(dtid uint64, s *Server) *authenticatedConn {
 	return &authenticatedConn{
@@ -30,82 +36,471 @@ func (conn *authenticatedConn) Auth(_ uint64, _ []byte) error {
 }
 
 // LPush implements connection
-func (conn *authenticatedConn) LPush(dtid uint64, subject string, payload []byte) error {
-	msg := Message{
+func (conn *authenticatedConn) LPush(dtid uint64, subject string, payload []byte) (string, error) {
+	return conn.send(conn.message(dtid, subject, payload))
+}
+
+// message creates a new message from this twin
+func (conn *authenticatedConn) message(dtid uint64, subject string, payload []byte) Message {
+	return Message{
+		ID:       uuid.New().String(),
 		Sender:   conn.dtid,
 		Receiver: dtid,
 		Topic:    subject,
 		TTL:      time.Now().Add(defaultMsgTTL),
-		Payload:  payload,
+		// the payload is owned by the command parser, which reuses its buffer
+		// for the next command
+		Payload: append([]byte(nil), payload...),
+	}
+}
+
+// send the message, and return its ID
+func (conn *authenticatedConn) send(msg Message) (string, error) {
+	ctx, span := conn.s.node.startSpan(context.Background(), "message.send", msg, trace.SpanKindProducer)
+	defer span.End()
+	injectSpan(ctx, &msg)
+
+	conn.s.node.trace(msg, eventAccepted, "")
+	if err := conn.s.node.Send(msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", errors.Wrap(err, "could not send message")
 	}
 
-	return errors.Wrap(conn.s.node.Send(msg), "could not send message")
+	return msg.ID, nil
+}
+
+// RPush implements connection. Messages are always appended to the mailbox of
+// the receiver, so this is the same as LPush.
+func (conn *authenticatedConn) RPush(dtid uint64, subject string, payload []byte) (string, error) {
+	return conn.LPush(dtid, subject, payload)
 }
 
 // LPop implements connection
 func (conn *authenticatedConn) LPop(dtid uint64, subject string) (Message, error) {
 	conn.s.node.recvQLock.Lock()
-	defer conn.s.node.recvQLock.Lock()
+	defer conn.s.node.recvQLock.Unlock()
 
-	var idx int
-	var msg Message
-	err := errNoMessage
-	for i, m := range conn.s.node.recvQ {
-		if m.Receiver == conn.dtid && (dtid == 0 || m.Sender == dtid) && (subject == "" || m.Topic == subject) {
-			idx = i
-			m = msg
-			err = nil
-			break
+	ids := conn.filter(dtid, subject)
+	if len(ids) == 0 {
+		return Message{}, errNoMessage
+	}
+
+	return conn.pop(ids[0]), nil
+}
+
+// RPop implements connection
+func (conn *authenticatedConn) RPop(dtid uint64, subject string) (Message, error) {
+	conn.s.node.recvQLock.Lock()
+	defer conn.s.node.recvQLock.Unlock()
+
+	ids := conn.filter(dtid, subject)
+	if len(ids) == 0 {
+		return Message{}, errNoMessage
+	}
+
+	return conn.pop(ids[len(ids)-1]), nil
+}
+
+// LPopMsg implements connection
+func (conn *authenticatedConn) LPopMsg(dtid uint64, subject string) (Message, error) {
+	return conn.LPop(dtid, subject)
+}
+
+// Lease implements connection
+func (conn *authenticatedConn) Lease(dtid uint64, subject string, timeout time.Duration) (Message, string, error) {
+	if timeout <= 0 {
+		return Message{}, "", errLeaseTimeout
+	}
+
+	conn.s.node.recvQLock.Lock()
+	defer conn.s.node.recvQLock.Unlock()
+
+	ids := conn.filter(dtid, subject)
+	if len(ids) == 0 {
+		return Message{}, "", errNoMessage
+	}
+
+	id, msg := conn.s.node.lease(ids[0], timeout)
+	_, span := conn.s.node.startSpan(extractSpan(msg), "message.lease", msg, trace.SpanKindConsumer)
+	span.End()
+
+	return msg, id, nil
+}
+
+// Ack implements connection. Only leases of this twin can be acknowledged.
+func (conn *authenticatedConn) Ack(ids []string) (uint64, error) {
+	var n uint64
+	for _, id := range ids {
+		if conn.s.node.ack(conn.dtid, id) {
+			n++
 		}
 	}
+	return n, nil
+}
+
+// Nack implements connection
+func (conn *authenticatedConn) Nack(ids []string) (uint64, error) {
+	var n uint64
+	for _, id := range ids {
+		if conn.s.node.nack(conn.dtid, id) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Call implements connection. Only a reply from the receiver of the request
+// is accepted.
+func (conn *authenticatedConn) Call(ctx context.Context, dtid uint64, subject string, payload []byte, timeout time.Duration) (Message, error) {
+	// the request is pending before it is sent, so the reply can't be
+	// popped by a subscription of the twin
+	msg := conn.message(dtid, subject, payload)
+	conn.s.node.recvQLock.Lock()
+	conn.s.node.calls[msg.ID] = true
+	conn.s.node.recvQLock.Unlock()
+	defer func() {
+		conn.s.node.recvQLock.Lock()
+		delete(conn.s.node.calls, msg.ID)
+		conn.s.node.recvQLock.Unlock()
+	}()
+
+	id, err := conn.send(msg)
+	if err != nil {
+		return Message{}, err
+	}
 
-	if err == nil {
-		conn.s.node.recvQ = append(conn.s.node.recvQ[:idx], conn.s.node.recvQ[idx+1:]...)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	return msg, err
+	return conn.waitReply(ctx, dtid, id)
+}
+
+// Reply implements connection
+func (conn *authenticatedConn) Reply(dtid uint64, subject string, requestID string, payload []byte) (string, error) {
+	msg := conn.message(dtid, subject, payload)
+	msg.ReplyTo = requestID
+	return conn.send(msg)
+}
+
+// waitReply pops the reply of the twin to the request with the given ID from
+// the receive queue, waiting for it to arrive until the context is done
+func (conn *authenticatedConn) waitReply(ctx context.Context, dtid uint64, id string) (Message, error) {
+	return conn.wait(ctx, func(m Message) bool {
+		return m.Sender == dtid && m.ReplyTo == id
+	}, true)
+}
+
+// Next implements connection
+func (conn *authenticatedConn) Next(ctx context.Context, keys []mailboxKey) (Message, error) {
+	return conn.wait(ctx, conn.matchKeys(keys), true)
+}
+
+// Peek implements connection
+func (conn *authenticatedConn) Peek(ctx context.Context, keys []mailboxKey) (Message, error) {
+	return conn.wait(ctx, conn.matchKeys(keys), false)
+}
+
+// matchKeys matches messages selected by one of the keys, as filter does.
+// The recvQLock must be held while matching.
+func (conn *authenticatedConn) matchKeys(keys []mailboxKey) func(Message) bool {
+	return func(m Message) bool {
+		for _, k := range keys {
+			if conn.matches(m, k.dtid, k.subject) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// wait for the oldest message for this twin which matches in the receive
+// queue, until the context is done. The message is popped if pop is set.
+func (conn *authenticatedConn) wait(ctx context.Context, match func(Message) bool, pop bool) (Message, error) {
+	for {
+		conn.s.node.recvQLock.Lock()
+		for i, m := range conn.s.node.recvQ {
+			if m.Receiver == conn.dtid && match(m) {
+				if pop {
+					m = conn.pop(i)
+				}
+				conn.s.node.recvQLock.Unlock()
+				return m, nil
+			}
+		}
+		notify := conn.s.node.recvNotify
+		conn.s.node.recvQLock.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return Message{}, errNoMessage
+		}
+	}
 }
 
 // LLen implements connection
 func (conn *authenticatedConn) LLen(dtid uint64, subject string) (uint64, error) {
 	conn.s.node.recvQLock.Lock()
-	defer conn.s.node.recvQLock.Lock()
+	defer conn.s.node.recvQLock.Unlock()
+
+	return uint64(len(conn.filter(dtid, subject))), nil
+}
+
+// LRange implements connection
+func (conn *authenticatedConn) LRange(dtid uint64, subject string, start int, end int) ([]Message, error) {
+	conn.s.node.recvQLock.Lock()
+	defer conn.s.node.recvQLock.Unlock()
+
+	ids := conn.filter(dtid, subject)
+	start, end = normalizeRange(start, end, len(ids))
+
+	messages := make([]Message, 0, end-start)
+	for _, id := range ids[start:end] {
+		messages = append(messages, conn.s.node.recvQ[id])
+	}
+
+	return messages, nil
+}
+
+// LIndex implements connection
+func (conn *authenticatedConn) LIndex(dtid uint64, subject string, index int) (Message, error) {
+	conn.s.node.recvQLock.Lock()
+	defer conn.s.node.recvQLock.Unlock()
+
+	ids := conn.filter(dtid, subject)
+	if index < 0 {
+		index += len(ids)
+	}
+	if index < 0 || index >= len(ids) {
+		return Message{}, errNoMessage
+	}
+
+	return conn.s.node.recvQ[ids[index]], nil
+}
+
+// LRem implements connection
+func (conn *authenticatedConn) LRem(dtid uint64, subject string, count int, payload []byte) (uint64, error) {
+	conn.s.node.recvQLock.Lock()
+	defer conn.s.node.recvQLock.Unlock()
 
-	var count uint64
-	for _, m := range conn.s.node.recvQ {
-		if m.Receiver == conn.dtid && (dtid == 0 || m.Sender == dtid) && (subject == "" || m.Topic == subject) {
-			count++
+	ids := conn.filter(dtid, subject)
+	if count < 0 {
+		reverse(ids)
+		count = -count
+	}
+
+	remove := make(map[int]struct{})
+	for _, id := range ids {
+		if count != 0 && len(remove) == count {
+			break
+		}
+		if bytes.Equal(conn.s.node.recvQ[id].Payload, payload) {
+			remove[id] = struct{}{}
 		}
 	}
 
-	return count, nil
+	conn.removeAll(remove)
+
+	return uint64(len(remove)), nil
 }
 
-// LRange implements connection
-func (conn *authenticatedConn) LRange(dtid uint64, subject string, start int, end int) ([]Message, error) {
+// LTrim implements connection
+func (conn *authenticatedConn) LTrim(dtid uint64, subject string, start int, end int) error {
+	conn.s.node.recvQLock.Lock()
+	defer conn.s.node.recvQLock.Unlock()
+
+	ids := conn.filter(dtid, subject)
+	start, end = normalizeRange(start, end, len(ids))
+
+	remove := make(map[int]struct{})
+	for i, id := range ids {
+		if i < start || i >= end {
+			remove[id] = struct{}{}
+		}
+	}
+
+	conn.removeAll(remove)
+
+	return nil
+}
+
+// LPos implements connection
+func (conn *authenticatedConn) LPos(dtid uint64, subject string, payload []byte, rank int, count int, maxLen int) ([]int, error) {
+	if rank == 0 {
+		return nil, errZeroRank
+	}
+
 	conn.s.node.recvQLock.Lock()
-	defer conn.s.node.recvQLock.Lock()
+	defer conn.s.node.recvQLock.Unlock()
 
-	foundIDs := make([]int, 0, (end-start)+1)
-	messages := make([]Message, 0, (end-start)+1)
-	var idx int
+	ids := conn.filter(dtid, subject)
+	if maxLen <= 0 || maxLen > len(ids) {
+		maxLen = len(ids)
+	}
 
+	positions := []int{}
+	for i := 0; i < maxLen; i++ {
+		// a negative rank searches from the end of the list
+		pos := i
+		if rank < 0 {
+			pos = len(ids) - 1 - i
+		}
+		if !bytes.Equal(conn.s.node.recvQ[ids[pos]].Payload, payload) {
+			continue
+		}
+		// skip the first matches until the requested rank is reached
+		if rank > 1 {
+			rank--
+			continue
+		} else if rank < -1 {
+			rank++
+			continue
+		}
+		positions = append(positions, pos)
+		if count != 0 && len(positions) == count {
+			break
+		}
+	}
+
+	return positions, nil
+}
+
+// filter the receive queue, and return the indices of all messages for this
+// twin, which match the given sender and subject, in order. The recvQLock
+// must be held by the caller.
+func (conn *authenticatedConn) filter(dtid uint64, subject string) []int {
+	var ids []int
 	for i, m := range conn.s.node.recvQ {
-		if m.Receiver == conn.dtid && (dtid == 0 || m.Sender == dtid) && (subject == "" || m.Topic == subject) {
-			if idx >= start && idx <= end {
-				messages = append(messages, m)
-				foundIDs = append(foundIDs, i)
-			}
-			idx++
+		if conn.matches(m, dtid, subject) {
+			ids = append(ids, i)
 		}
 	}
+	return ids
+}
 
-	// TODO: should LRANGE delete elements?
-	// iterate over the found ID's backwards - otherwise the id's will be invalid
-	// after the first removal
-	// for i := len(foundIDs) - 1; i > 0; i-- {
-	// 	conn.s.node.recvQ = append(conn.s.node.recvQ[:foundIDs[i]], conn.s.node.recvQ[foundIDs[i]+1:]...)
-	// }
+// matches returns true if the message is for this twin, from the given sender
+// and on the given subject. Replies to pending calls never match, they are
+// left for the call. The recvQLock must be held by the caller.
+func (conn *authenticatedConn) matches(m Message, dtid uint64, subject string) bool {
+	if m.Receiver != conn.dtid || (m.ReplyTo != "" && conn.s.node.calls[m.ReplyTo]) {
+		return false
+	}
+	return (dtid == 0 || m.Sender == dtid) && (subject == "" || m.Topic == subject)
+}
 
-	return messages, nil
+// pop the message at the given index from the receive queue, delivering it to
+// the client. The recvQLock must be held by the caller.
+func (conn *authenticatedConn) pop(id int) Message {
+	msg := conn.s.node.recvQ[id]
+	conn.s.node.recvQ = append(conn.s.node.recvQ[:id], conn.s.node.recvQ[id+1:]...)
+
+	_, span := conn.s.node.startSpan(extractSpan(msg), "message.pop", msg, trace.SpanKindConsumer)
+	conn.s.node.trace(msg, eventPopped, "")
+	span.End()
+
+	return msg
+}
+
+// removeAll removes the messages at the given indices from the receive queue.
+// The recvQLock must be held by the caller.
+func (conn *authenticatedConn) removeAll(ids map[int]struct{}) {
+	if len(ids) == 0 {
+		return
+	}
+
+	q := conn.s.node.recvQ[:0]
+	for i, m := range conn.s.node.recvQ {
+		if _, ok := ids[i]; ok {
+			conn.s.node.trace(m, eventRemoved, "removed by receiver")
+		} else {
+			q = append(q, m)
+		}
+	}
+	conn.s.node.recvQ = q
+}
+
+// normalizeRange converts an inclusive range, where negative indices count
+// from the end of the list as is done by redis, to a half open range of valid
+// indices for a list of the given length.
+func normalizeRange(start int, end int, length int) (int, int) {
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end {
+		return 0, 0
+	}
+	return start, end + 1
+}
+
+func reverse(ids []int) {
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+}
+
+// Trace implements connection. Only events of messages sent or received by
+// this twin are returned.
+func (conn *authenticatedConn) Trace(id string) ([]TraceEvent, error) {
+	events := []TraceEvent{}
+	for _, event := range conn.s.node.Trace(id) {
+		if event.Sender == conn.dtid || event.Receiver == conn.dtid {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// DeadLetters implements connection
+func (conn *authenticatedConn) DeadLetters(dtid uint64, subject string) ([]DeadLetter, error) {
+	return conn.s.node.deadLetters.List(conn.dtid, dtid, subject), nil
+}
+
+// DeadLetterPop implements connection
+func (conn *authenticatedConn) DeadLetterPop(dtid uint64, subject string) (DeadLetter, error) {
+	letter, ok := conn.s.node.deadLetters.Pop(conn.dtid, dtid, subject)
+	if !ok {
+		return DeadLetter{}, errNoMessage
+	}
+	return letter, nil
+}
+
+// SetBounce implements connection
+func (conn *authenticatedConn) SetBounce(enabled bool) error {
+	conn.s.node.deadLetters.SetBounce(conn.dtid, enabled)
+	return nil
+}
+
+// ACLSet implements connection
+func (conn *authenticatedConn) ACLSet(dtid uint64, subject string, allow bool) error {
+	conn.s.node.acl.Set(conn.dtid, ACLRule{Sender: dtid, Topic: subject, Allow: allow})
+	return nil
+}
+
+// ACLDel implements connection
+func (conn *authenticatedConn) ACLDel(dtid uint64, subject string) (bool, error) {
+	return conn.s.node.acl.Remove(conn.dtid, dtid, subject), nil
+}
+
+// ACLList implements connection
+func (conn *authenticatedConn) ACLList() ([]ACLRule, error) {
+	return conn.s.node.acl.Rules(conn.dtid), nil
+}
+
+// ACLReset implements connection
+func (conn *authenticatedConn) ACLReset() error {
+	conn.s.node.acl.Reset(conn.dtid)
+	return nil
 }
@@ -2,91 +2,473 @@ package pkg
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var errDenied = errors.New("denied by receiver ACL")
+
 type BufferedNode struct {
-	node    *P2PNode
-	msgChan <-chan Message
+	node Transport
 
 	peerStore PeerStore
 
+	// access control rules for the digital twins served by this node
+	acl *ACL
+	// messages of the digital twins served by this node which could not be
+	// delivered
+	deadLetters *DeadLetters
+
 	// receiving queue, messages are kept in the order they are received
 	recvQ     []Message
 	recvQLock sync.Mutex
+	// leased messages by ID, they are not in the receiving queue until the
+	// lease expires. They are protected by the recvQLock.
+	leases map[string]*lease
+	// calls are the IDs of the requests waiting for a reply with CALL, their
+	// replies are only popped by the call. They are protected by the
+	// recvQLock.
+	calls map[string]bool
 	// sending queue, message are kept in the order they are submitted
 	sendQ     []Message
 	sendQLock sync.Mutex
+	// retrying is set while the sending queue is retried, it is accessed
+	// atomically
+	retrying int32
+	// recvNotify is closed and replaced whenever a message is added to the
+	// receiving queue. It is protected by the recvQLock.
+	recvNotify chan struct{}
+
+	metrics *Metrics
+	log     Log
+
+	// recent events in the lifecycle of messages
+	traces *traceLog
+	tracer trace.Tracer
 
 	ctx context.Context
 }
 
-const singleMessageSendTTL = time.Second * 20 // 20 seconds by default to send a message
+const (
+	singleMessageSendTTL = time.Second * 20 // 20 seconds by default to send a message
+	maintenanceInterval  = time.Minute      // check for expired messages every minute
+	sendRetryInterval    = time.Second * 10 // retry sending queued messages every 10 seconds
+)
 
-// NewBufferedNode creates a new buffered node embedding a regular P2PNode
-func NewBufferedNode(store PeerStore) *BufferedNode {
-	msgChan := make(chan Message)
+// NewBufferedNode creates a new buffered node on top of the given transport,
+// typically a P2PNode
+func NewBufferedNode(store PeerStore, transport Transport) *BufferedNode {
 	return &BufferedNode{
-		node:      NewP2PNode(msgChan),
-		msgChan:   msgChan,
-		peerStore: store,
-		recvQ:     []Message{},
-		sendQ:     []Message{},
+		node:        transport,
+		peerStore:   store,
+		acl:         NewACL(),
+		deadLetters: NewDeadLetters(),
+		recvQ:       []Message{},
+		leases:      make(map[string]*lease),
+		calls:       make(map[string]bool),
+		sendQ:       []Message{},
+		recvNotify:  make(chan struct{}),
+		log:         DefaultLogger(),
+		traces:      newTraceLog(traceLogSize),
+		tracer:      noopTracer,
 	}
 }
 
+// SetLogger implements LogSetter. It must be called before the component is
+// started.
+func (bn *BufferedNode) SetLogger(log Log) {
+	bn.log = log
+}
+
 func (bn *BufferedNode) Send(message Message) error {
 	if err := bn.ctx.Err(); err != nil {
 		return errors.Wrap(err, "could not send message")
 	}
 
+	err := bn.send(message, true)
+	if errors.Is(err, context.DeadlineExceeded) {
+		bn.sendQLock.Lock()
+		bn.sendQ = append(bn.sendQ, message)
+		bn.sendQLock.Unlock()
+		bn.trace(message, eventQueued, err.Error())
+		bn.metrics.queued()
+		return nil // TODO: return ErrQueued?
+	}
+	return err
+}
+
+// send the message to the peer of its receiver. If it can't be delivered in
+// time, the error is returned as is for the message to be queued. Other
+// failures are dead lettered, returned is set if they are returned to the
+// sender as well.
+func (bn *BufferedNode) send(message Message, returned bool) error {
 	peerIDStr, err := bn.peerStore.PeerID(message.Receiver)
 	if err != nil {
-		return errors.Wrap(err, "could not load receiver peerID")
+		err = errors.Wrap(err, "could not load receiver peerID")
+		bn.deadLetter(message, deadUnknownReceiver, err.Error(), returned)
+		return err
 	}
 
-	peerID, err := peer.IDFromString(peerIDStr)
+	peerID, err := peer.Decode(peerIDStr)
 	if err != nil {
-		return errors.Wrap(err, "invalid receiver peerID")
+		err = errors.Wrap(err, "invalid receiver peerID")
+		bn.deadLetter(message, deadUnknownReceiver, err.Error(), returned)
+		return err
 	}
 
-	err = bn.node.Send(message, peerID, singleMessageSendTTL)
+	remote := peer.AddrInfo{ID: peerID}
+
+	start := time.Now()
+	err = bn.node.Send(message, remote, singleMessageSendTTL)
+	bn.metrics.sent(err, time.Since(start))
 	if errors.Is(err, context.DeadlineExceeded) {
-		bn.sendQLock.Lock()
-		defer bn.sendQLock.Unlock()
-		bn.sendQ = append(bn.sendQ, message)
-		return nil // TODO: return ErrQueued?
+		return err
 	} else if err != nil {
+		reason := deadSendFailed
+		var rerr *RejectedError
+		if errors.As(err, &rerr) {
+			reason = deadRejected
+		}
+		bn.trace(message, eventFailed, err.Error())
+		bn.deadLetter(message, reason, err.Error(), returned)
 		return errors.Wrap(err, "could not send message")
 	}
 
+	bn.trace(message, eventSent, peerIDStr)
 	return nil
 }
 
 func (bn *BufferedNode) Start(ctx context.Context, privateKey crypto.PrivKey) error {
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg := <-bn.msgChan:
-				bn.recvQLock.Lock()
-				bn.recvQ = append(bn.recvQ, msg)
-				bn.recvQLock.Unlock()
+	// transports which can tell the sending peer about rejected messages
+	// hand them over directly
+	if r, ok := bn.node.(Receiver); ok {
+		r.SetReceiver(bn.receive)
+	} else {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg := <-bn.node.Messages():
+					bn.receive(msg)
+				}
 			}
-		}
-	}()
-	// TODO: Start maintenance routine to kick expired Messages
+		}()
+	}
+	go bn.maintain(ctx)
 	bn.ctx = ctx
 	return bn.node.Start(ctx, privateKey)
 }
 
+// receive a message from the transport in the mailbox of the receiver.
+// Returns errDenied if the receiver does not accept the message.
+func (bn *BufferedNode) receive(msg Message) error {
+	// messages of older brokers don't have an ID yet
+	if msg.ID == "" {
+		msg.ID = uuid.New().String()
+	}
+
+	_, span := bn.startSpan(extractSpan(msg), "message.receive", msg, trace.SpanKindConsumer)
+	defer span.End()
+
+	bn.trace(msg, eventReceived, "")
+	if !bn.acl.Permitted(msg) {
+		bn.trace(msg, eventDenied, "receiver ACL")
+		span.SetStatus(codes.Error, errDenied.Error())
+		bn.metrics.denied()
+		return errDenied
+	}
+
+	bn.recvQLock.Lock()
+	bn.recvQ = append(bn.recvQ, msg)
+	close(bn.recvNotify)
+	bn.recvNotify = make(chan struct{})
+	bn.recvQLock.Unlock()
+	bn.trace(msg, eventEnqueued, "")
+	bn.metrics.received()
+	return nil
+}
+
+// trace records an event in the lifecycle of a message
+func (bn *BufferedNode) trace(msg Message, event string, detail string) {
+	bn.traces.add(TraceEvent{
+		ID:       msg.ID,
+		Sender:   msg.Sender,
+		Receiver: msg.Receiver,
+		Time:     time.Now(),
+		Event:    event,
+		Detail:   detail,
+	})
+
+	if !debugEnabled(bn.log) {
+		return
+	}
+	log := bn.log.
+		WithField("msgID", msg.ID).
+		WithField("sender", msg.Sender).
+		WithField("receiver", msg.Receiver)
+	if detail != "" {
+		log = log.WithField("detail", detail)
+	}
+	log.Debugf("message %s", event)
+}
+
+// Trace returns the events of the message at this node which are still
+// remembered, oldest first
+func (bn *BufferedNode) Trace(id string) []TraceEvent {
+	return bn.traces.lookup(id)
+}
+
+// startSpan starts a span for the message
+func (bn *BufferedNode) startSpan(ctx context.Context, name string, msg Message, kind trace.SpanKind) (context.Context, trace.Span) {
+	return bn.tracer.Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("message.id", msg.ID),
+			attribute.Int64("message.sender", int64(msg.Sender)),
+			attribute.Int64("message.receiver", int64(msg.Receiver)),
+			attribute.String("message.topic", msg.Topic),
+		),
+	)
+}
+
+// SetTracerProvider enables tracing of messages with spans from the provider.
+// The span context is propagated to remote brokers in the message. It must be
+// called before the node is started.
+func (bn *BufferedNode) SetTracerProvider(tp trace.TracerProvider) {
+	bn.tracer = tp.Tracer(tracerName)
+}
+
+// maintain the queues until the context is done
+func (bn *BufferedNode) maintain(ctx context.Context) {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	retryTicker := time.NewTicker(sendRetryInterval)
+	defer retryTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			bn.expire(now)
+		case <-retryTicker.C:
+			// sending can take a while, don't hold back expiring messages
+			go bn.retry()
+		}
+	}
+}
+
+// retry sending the queued messages. Once a message times out, the following
+// messages to the same receiver are not tried either. The messages which are
+// not delivered stay queued, in order, until their TTL expires. Other
+// failures are bounced, as the sender was only told the message was queued.
+func (bn *BufferedNode) retry() {
+	if !atomic.CompareAndSwapInt32(&bn.retrying, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&bn.retrying, 0)
+
+	bn.sendQLock.Lock()
+	queued := bn.sendQ
+	bn.sendQ = []Message{}
+	bn.sendQLock.Unlock()
+
+	var requeued []Message
+	unreachable := make(map[uint64]bool)
+	for _, msg := range queued {
+		expired := !msg.TTL.IsZero() && !msg.TTL.After(time.Now())
+		if expired || unreachable[msg.Receiver] || bn.ctx.Err() != nil {
+			requeued = append(requeued, msg)
+			continue
+		}
+
+		if err := bn.send(msg, false); errors.Is(err, context.DeadlineExceeded) {
+			unreachable[msg.Receiver] = true
+			requeued = append(requeued, msg)
+			bn.trace(msg, eventQueued, err.Error())
+		}
+	}
+
+	// messages queued in the meantime are newer
+	bn.sendQLock.Lock()
+	bn.sendQ = append(requeued, bn.sendQ...)
+	bn.sendQLock.Unlock()
+}
+
+// expire removes messages of which the TTL passed from both queues. Messages
+// without TTL never expire.
+func (bn *BufferedNode) expire(now time.Time) {
+	isExpired := func(msg Message) bool {
+		return !msg.TTL.IsZero() && !msg.TTL.After(now)
+	}
+
+	bn.recvQLock.Lock()
+	var expired []Message
+	bn.recvQ, expired = removeWhere(bn.recvQ, isExpired)
+	bn.recvQLock.Unlock()
+	bn.metrics.expired("recv", len(expired))
+	for _, msg := range expired {
+		bn.trace(msg, eventExpired, "receive queue")
+	}
+
+	bn.sendQLock.Lock()
+	bn.sendQ, expired = removeWhere(bn.sendQ, isExpired)
+	bn.sendQLock.Unlock()
+	bn.metrics.expired("send", len(expired))
+	for _, msg := range expired {
+		bn.trace(msg, eventExpired, "send queue")
+		bn.deadLetter(msg, deadExpired, "TTL expired in send queue", false)
+	}
+
+	bn.deadLetters.expire(now.Add(-deadLetterTTL))
+}
+
+// removeWhere removes the messages matching the predicate from the queue in
+// place, and returns the new queue and the removed messages
+func removeWhere(queue []Message, remove func(Message) bool) ([]Message, []Message) {
+	var removed []Message
+	kept := queue[:0]
+	for _, msg := range queue {
+		if remove(msg) {
+			removed = append(removed, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	// clear the tail so removed payloads can be collected
+	for i := len(kept); i < len(queue); i++ {
+		queue[i] = Message{}
+	}
+
+	return kept, removed
+}
+
+// ACL of the digital twins served by this node
+func (bn *BufferedNode) ACL() *ACL {
+	return bn.acl
+}
+
 // PeerID returns the underlying nodes PeerID
 func (bn *BufferedNode) PeerID() string {
 	return bn.node.PeerID()
 }
+
+// Addrs returns the underlying nodes addresses
+func (bn *BufferedNode) Addrs() []string {
+	return bn.node.Addrs()
+}
+
+// Peers the underlying node is connected to, if it can list them
+func (bn *BufferedNode) Peers() []PeerInfo {
+	pl, ok := bn.node.(PeerLister)
+	if !ok {
+		return nil
+	}
+	return pl.Peers()
+}
+
+// QueueInfo holds the queue sizes of a digital twin
+type QueueInfo struct {
+	// Twin the queues belong to
+	Twin uint64 `json:"twin"`
+	// Received messages waiting in the mailbox of the twin
+	Received int `json:"received"`
+	// Sending messages sent by the twin, waiting to be delivered
+	Sending int `json:"sending"`
+	// Leased messages received by the twin, waiting to be acknowledged
+	Leased int `json:"leased"`
+	// DeadLetters sent by the twin, which could not be delivered
+	DeadLetters int `json:"dead_letters"`
+}
+
+// Queues returns the queue sizes of all digital twins with queued messages,
+// ordered by twin
+func (bn *BufferedNode) Queues() []QueueInfo {
+	queues := make(map[uint64]*QueueInfo)
+	get := func(dtid uint64) *QueueInfo {
+		qi, ok := queues[dtid]
+		if !ok {
+			qi = &QueueInfo{Twin: dtid}
+			queues[dtid] = qi
+		}
+		return qi
+	}
+
+	bn.recvQLock.Lock()
+	for _, msg := range bn.recvQ {
+		get(msg.Receiver).Received++
+	}
+	for _, l := range bn.leases {
+		get(l.msg.Receiver).Leased++
+	}
+	bn.recvQLock.Unlock()
+
+	bn.sendQLock.Lock()
+	for _, msg := range bn.sendQ {
+		get(msg.Sender).Sending++
+	}
+	bn.sendQLock.Unlock()
+
+	for dtid, n := range bn.deadLetters.counts() {
+		get(dtid).DeadLetters = n
+	}
+
+	out := make([]QueueInfo, 0, len(queues))
+	for _, qi := range queues {
+		out = append(out, *qi)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Twin < out[j].Twin })
+
+	return out
+}
+
+// Mailbox returns a copy of the messages in the mailbox of a digital twin, in
+// the order they were received
+func (bn *BufferedNode) Mailbox(dtid uint64) []Message {
+	bn.recvQLock.Lock()
+	defer bn.recvQLock.Unlock()
+
+	out := []Message{}
+	for _, msg := range bn.recvQ {
+		if msg.Receiver == dtid {
+			out = append(out, msg)
+		}
+	}
+
+	return out
+}
+
+// PurgeMailbox removes all messages from the mailbox of a digital twin,
+// leased messages included, and returns the amount of removed messages
+func (bn *BufferedNode) PurgeMailbox(dtid uint64) int {
+	bn.recvQLock.Lock()
+	defer bn.recvQLock.Unlock()
+
+	var removed []Message
+	bn.recvQ, removed = removeWhere(bn.recvQ, func(msg Message) bool {
+		return msg.Receiver == dtid
+	})
+	for id, l := range bn.leases {
+		if l.msg.Receiver == dtid {
+			l.timer.Stop()
+			delete(bn.leases, id)
+			removed = append(removed, l.msg)
+		}
+	}
+	for _, msg := range removed {
+		bn.trace(msg, eventRemoved, "mailbox purged")
+	}
+
+	return len(removed)
+}
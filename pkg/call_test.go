@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestCallReply(t *testing.T) {
+	network := NewMemoryNetwork()
+	store := newTestStore(t, 1, 2, 3)
+	b1 := newBroker(t, network, store, 1)
+	b2 := newBroker(t, network, store, 2, 3)
+	ctx := context.Background()
+
+	c1, c2, c3 := b1.client(1), b2.client(2), b2.client(3)
+
+	// twin 2 serves requests in the background
+	errs := make(chan error, 1)
+	go func() {
+		errs <- func() error {
+			var request []interface{}
+			for {
+				var err error
+				request, err = c2.Do(ctx, "LPOPMSG", "1:echo").Slice()
+				if err == nil {
+					break
+				} else if err != redis.Nil {
+					return err
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			// a reply to some other request is ignored by the caller
+			if err := c3.Do(ctx, "REPLY", "1:echo", request[2], "spoofed").Err(); err != nil {
+				return err
+			}
+			if err := c2.Do(ctx, "REPLY", "1:echo", "other", "unrelated").Err(); err != nil {
+				return err
+			}
+			return c2.Do(ctx, "REPLY", "1:echo", request[2], "re: "+request[1].(string)).Err()
+		}()
+	}()
+
+	reply, err := c1.Do(ctx, "CALL", "2:echo", "hello", 5).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, []interface{}{"2:echo", "re: hello"}) {
+		t.Errorf("unexpected CALL reply %v", reply)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// the ignored replies stay in the mailbox of the caller
+	b1.eventually(func() bool { return c1.LLen(ctx, "0:echo").Val() == 2 }, "expected ignored replies in the mailbox")
+}
+
+func TestCallTimeout(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	ctx := context.Background()
+
+	start := time.Now()
+	err := h.client(1).Do(ctx, "CALL", "2:echo", "hello", "0.1").Err()
+	if err != redis.Nil {
+		t.Errorf("expected nil reply on timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("CALL returned before the timeout, after %s", elapsed)
+	}
+
+	// the request is delivered regardless
+	reply, err := h.client(2).Do(ctx, "LPOPMSG", "0:").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 3 || reply[0] != "1:echo" || reply[1] != "hello" || reply[2] == "" {
+		t.Errorf("unexpected LPOPMSG reply %v", reply)
+	}
+
+	for _, timeout := range []string{"-1", "soon"} {
+		if err := h.client(1).Do(ctx, "CALL", "2:echo", "hello", timeout).Err(); err == nil {
+			t.Errorf("expected error for timeout %s", timeout)
+		}
+	}
+}
+
+func TestCallDisconnected(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	ctx := context.Background()
+	c2 := h.client(2)
+
+	// the caller goes away while waiting without a timeout
+	c := h.respConn()
+	c.do("HELLO", 3, "AUTH", 1, h.store.sig(1))
+	c.send("CALL", "2:echo", "hello", 0)
+
+	var request []interface{}
+	h.eventually(func() bool {
+		var err error
+		request, err = c2.Do(ctx, "LPOPMSG", "1:echo").Slice()
+		return err == nil
+	}, "request was not delivered")
+	c.conn.Close()
+
+	h.eventually(func() bool { return len(h.server.Clients()) == 1 }, "disconnected caller was not removed")
+
+	// the reply is kept for the caller, instead of being written to the closed
+	// connection
+	if err := c2.Do(ctx, "REPLY", "1:echo", request[2], "re: hello").Err(); err != nil {
+		t.Fatal(err)
+	}
+	h.eventually(func() bool { return h.client(1).LLen(ctx, "2:echo").Val() == 1 }, "reply was not kept in the mailbox")
+}
+
+func TestCallConcurrentPop(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	ctx := context.Background()
+	c1, c2 := h.client(1), h.client(2)
+
+	c := h.respConn()
+	c.do("HELLO", 3, "AUTH", 1, h.store.sig(1))
+	c.send("CALL", "2:echo", "hello", 5)
+
+	var request []interface{}
+	h.eventually(func() bool {
+		var err error
+		request, err = c2.Do(ctx, "LPOPMSG", "1:echo").Slice()
+		return err == nil
+	}, "request was not delivered")
+
+	// the reply is in the mailbox before the call wakes up
+	reply := msg(2, 1, "echo", "re: hello")
+	reply.ID, reply.ReplyTo = "reply", request[2].(string)
+	h.node.recvQLock.Lock()
+	h.node.recvQ = append(h.node.recvQ, reply)
+	h.node.recvQLock.Unlock()
+
+	// other connections of the caller don't see the reply
+	if n, err := c1.LLen(ctx, "0:").Result(); err != nil || n != 0 {
+		t.Errorf("expected empty mailbox, got %d %v", n, err)
+	}
+	if err := c1.Do(ctx, "LPOP", "0:").Err(); err != redis.Nil {
+		t.Errorf("expected no message to pop, got %v", err)
+	}
+	if err := c1.Do(ctx, "LEASE", "0:", 10).Err(); err != redis.Nil {
+		t.Errorf("expected no message to lease, got %v", err)
+	}
+
+	h.deliver()
+	if reply, ok := c.read().(map[string]interface{}); !ok || reply["payload"] != "re: hello" {
+		t.Errorf("unexpected CALL reply %v", reply)
+	}
+}
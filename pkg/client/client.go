@@ -0,0 +1,518 @@
+// Package client connects digital twins to a tfagent broker over RESP
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// authMessage is signed by the twin to authenticate
+var authMessage = []byte("A")
+
+// unixSocketPrefix marks addresses of unix sockets
+const unixSocketPrefix = "unix://"
+
+var (
+	// ErrTimeout is returned by Call if no reply is received in time
+	ErrTimeout = errors.New("no reply received in time")
+	// ErrNoMessage is returned by Receive if there is no matching message
+	ErrNoMessage = errors.New("no message")
+)
+
+const (
+	defaultPollInterval = 100 * time.Millisecond
+	defaultCallTimeout  = 30 * time.Second
+	defaultMaxRetries   = 3
+	defaultMinBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff   = 5 * time.Second
+)
+
+// Message received from a digital twin
+type Message struct {
+	// ID of the message
+	ID string
+	// Sender digital twin ID
+	Sender uint64
+	// Topic of the message
+	Topic string
+	// Payload of the message
+	Payload []byte
+	// Deliveries counts the leases of a message returned by Lease, it is more
+	// than 1 if the message is redelivered
+	Deliveries int
+	// Lease is the ID of the lease of a message returned by Lease, to
+	// acknowledge it with
+	Lease string
+}
+
+// Option configures a client
+type Option func(*options)
+
+type options struct {
+	pollInterval time.Duration
+	maxRetries   int
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	dialTimeout  time.Duration
+	tls          *tls.Config
+}
+
+// WithPollInterval sets how often blocking receives check the mailbox.
+// Defaults to 100ms.
+func WithPollInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = interval
+	}
+}
+
+// WithRetries sets how often a read of the mailbox, with Len or Range, is
+// retried after a network error, and the bounds of the backoff between
+// retries. Other commands are never retried, as the broker can have executed
+// them before the connection failed, which would duplicate or lose messages.
+// Subscriptions use the same backoff while the broker is unreachable. Defaults
+// to 3 retries, with a backoff between 100ms and 5s.
+func WithRetries(retries int, minBackoff time.Duration, maxBackoff time.Duration) Option {
+	return func(o *options) {
+		o.maxRetries = retries
+		o.minBackoff = minBackoff
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// WithDialTimeout sets the timeout for connecting to the broker. Defaults to
+// 5s.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = timeout
+	}
+}
+
+// WithTLS connects to the broker over TLS with the given config. For mutual
+// TLS, the config holds the client certificate.
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tls = cfg
+	}
+}
+
+// Client of a broker, authenticated as a digital twin. Connections are
+// authenticated when they are opened, so the client re-authenticates when it
+// reconnects after the connection is lost. A client is safe for concurrent
+// use.
+type Client struct {
+	dtid  uint64
+	opts  options
+	redis *redis.Client
+}
+
+// Signer signs the authentication challenge of the broker. Keys from the keys
+// package implement it, for both ed25519 and sr25519 twins.
+type Signer interface {
+	Sign(msg []byte) ([]byte, error)
+}
+
+// ed25519Signer signs with a raw ed25519 key
+type ed25519Signer ed25519.PrivateKey
+
+func (s ed25519Signer) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(s), msg), nil
+}
+
+// New creates a client for the broker at the address, authenticating as the
+// digital twin with its ed25519 key. No connection is made until the first
+// command, use Connect to verify the address and key.
+func New(addr string, dtid uint64, key ed25519.PrivateKey, opts ...Option) *Client {
+	c, _ := NewWithSigner(addr, dtid, ed25519Signer(key), opts...)
+	return c
+}
+
+// NewWithSigner creates a client like New, authenticating with a signature of
+// the signer, which must use the key type registered for the twin. If signer
+// is nil, the client does not authenticate, for listeners of the broker which
+// authenticate their connections as the twin. The address is either a tcp
+// address, or the path of a unix socket prefixed with unix://.
+func NewWithSigner(addr string, dtid uint64, signer Signer, opts ...Option) (*Client, error) {
+	var onConnect func(ctx context.Context, cn *redis.Conn) error
+	if signer != nil {
+		sig, err := signer.Sign(authMessage)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not sign authentication challenge")
+		}
+		onConnect = func(ctx context.Context, cn *redis.Conn) error {
+			err := cn.Process(ctx, redis.NewStatusCmd(ctx, "AUTH", dtid, sig))
+			return errors.Wrap(err, "could not authenticate")
+		}
+	}
+
+	o := options{
+		pollInterval: defaultPollInterval,
+		maxRetries:   defaultMaxRetries,
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	network := "tcp"
+	if path := strings.TrimPrefix(addr, unixSocketPrefix); path != addr {
+		network, addr = "unix", path
+	}
+
+	return &Client{
+		dtid: dtid,
+		opts: o,
+		redis: redis.NewClient(&redis.Options{
+			Network:     network,
+			Addr:        addr,
+			DialTimeout: o.dialTimeout,
+			TLSConfig:   o.tls,
+			// only reads are retried, by retry
+			MaxRetries: -1,
+			// blocking commands are bounded by the context instead
+			ReadTimeout: -1,
+			OnConnect:   onConnect,
+		}),
+	}, nil
+}
+
+// Twin the client is authenticated as
+func (c *Client) Twin() uint64 {
+	return c.dtid
+}
+
+// Connect to the broker and authenticate
+func (c *Client) Connect(ctx context.Context) error {
+	return errors.Wrap(c.redis.Ping(ctx).Err(), "could not connect to broker")
+}
+
+// Close the client and its connections
+func (c *Client) Close() error {
+	return c.redis.Close()
+}
+
+// Send a message to the twin on the topic, and return its ID
+func (c *Client) Send(ctx context.Context, dtid uint64, topic string, payload []byte) (string, error) {
+	id, err := c.redis.Do(ctx, "LPUSHID", key(dtid, topic), payload).Text()
+	return id, errors.Wrap(err, "could not send message")
+}
+
+// Receive pops the oldest message from the twin on the topic. A twin of 0
+// matches all senders, and an empty topic all topics. ErrNoMessage is returned
+// if there is no such message.
+func (c *Client) Receive(ctx context.Context, dtid uint64, topic string) (Message, error) {
+	reply, err := c.redis.Do(ctx, "LPOPMSG", key(dtid, topic)).Slice()
+	if errors.Is(err, redis.Nil) {
+		return Message{}, ErrNoMessage
+	} else if err != nil {
+		return Message{}, errors.Wrap(err, "could not receive message")
+	}
+	if len(reply) != 3 {
+		return Message{}, errors.Errorf("unexpected LPOPMSG reply of length %d", len(reply))
+	}
+
+	msg, err := parseMessage(reply[0], reply[1])
+	if err != nil {
+		return Message{}, err
+	}
+	msg.ID, _ = reply[2].(string)
+
+	return msg, nil
+}
+
+// Lease pops the oldest message from the twin on the topic, as Receive, but
+// the message is redelivered unless it is acknowledged with Ack before the
+// timeout. ErrNoMessage is returned if there is no such message.
+func (c *Client) Lease(ctx context.Context, dtid uint64, topic string, timeout time.Duration) (Message, error) {
+	reply, err := c.redis.Do(ctx, "LEASE", key(dtid, topic), strconv.FormatFloat(timeout.Seconds(), 'f', 3, 64)).Slice()
+	if errors.Is(err, redis.Nil) {
+		return Message{}, ErrNoMessage
+	} else if err != nil {
+		return Message{}, errors.Wrap(err, "could not lease message")
+	}
+	if len(reply) != 5 {
+		return Message{}, errors.Errorf("unexpected LEASE reply of length %d", len(reply))
+	}
+
+	msg, err := parseMessage(reply[0], reply[1])
+	if err != nil {
+		return Message{}, err
+	}
+	msg.ID, _ = reply[2].(string)
+	deliveries, _ := reply[3].(int64)
+	msg.Deliveries = int(deliveries)
+	msg.Lease, _ = reply[4].(string)
+
+	return msg, nil
+}
+
+// Ack acknowledges leased messages by the IDs of their leases, so they are not
+// redelivered, and returns how many of them were still leased
+func (c *Client) Ack(ctx context.Context, ids ...string) (uint64, error) {
+	n, err := c.redis.Do(ctx, append([]interface{}{"ACK"}, toArgs(ids)...)...).Uint64()
+	return n, errors.Wrap(err, "could not acknowledge messages")
+}
+
+// Nack redelivers leased messages by the IDs of their leases right away, and
+// returns how many of them were still leased
+func (c *Client) Nack(ctx context.Context, ids ...string) (uint64, error) {
+	n, err := c.redis.Do(ctx, append([]interface{}{"NACK"}, toArgs(ids)...)...).Uint64()
+	return n, errors.Wrap(err, "could not redeliver messages")
+}
+
+// BlockingReceive waits for a message from the twin on the topic, as Receive,
+// until the context is done
+func (c *Client) BlockingReceive(ctx context.Context, dtid uint64, topic string) (Message, error) {
+	ticker := time.NewTicker(c.opts.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		msg, err := c.Receive(ctx, dtid, topic)
+		if !errors.Is(err, ErrNoMessage) {
+			return msg, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Len returns the amount of messages from the twin on the topic
+func (c *Client) Len(ctx context.Context, dtid uint64, topic string) (uint64, error) {
+	n, err := c.retry(ctx, "LLEN", key(dtid, topic)).Uint64()
+	return n, errors.Wrap(err, "could not get mailbox length")
+}
+
+// Range returns the messages from the twin on the topic between start and end,
+// inclusive, without removing them. Negative indices count from the newest
+// message, as for LRANGE.
+func (c *Client) Range(ctx context.Context, dtid uint64, topic string, start int, end int) ([]Message, error) {
+	reply, err := c.retry(ctx, "LRANGEMSG", key(dtid, topic), start, end).Slice()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list messages")
+	}
+
+	messages := make([]Message, 0, len(reply))
+	for _, item := range reply {
+		fields, ok := item.([]interface{})
+		if !ok || len(fields) != 3 {
+			return nil, errors.Errorf("unexpected LRANGEMSG message %v", item)
+		}
+		msg, err := parseMessage(fields[0], fields[1])
+		if err != nil {
+			return nil, err
+		}
+		msg.ID, _ = fields[2].(string)
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// Call sends a request to the twin on the topic, and waits for its reply
+// until the context is done, or for 30 seconds if the context has no
+// deadline. ErrTimeout is returned if the deadline passes without a reply.
+func (c *Client) Call(ctx context.Context, dtid uint64, topic string, payload []byte) ([]byte, error) {
+	// the broker waits until the deadline, so it never waits for a caller
+	// which is gone
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultCallTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	remaining := time.Until(deadline).Seconds()
+	if remaining <= 0 {
+		return nil, ErrTimeout
+	}
+	timeout := strconv.FormatFloat(math.Max(remaining, 0.001), 'f', 3, 64)
+
+	reply, err := c.redis.Do(ctx, "CALL", key(dtid, topic), payload, timeout).Slice()
+	// the deadline of the context can pass before the broker replies, and
+	// the read timeout of the connection can fire before the context is done
+	if errors.Is(err, redis.Nil) || errors.Is(ctx.Err(), context.DeadlineExceeded) || !time.Now().Before(deadline) {
+		return nil, ErrTimeout
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not call twin")
+	}
+	if len(reply) != 2 {
+		return nil, errors.Errorf("unexpected CALL reply of length %d", len(reply))
+	}
+
+	msg, err := parseMessage(reply[0], reply[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.Payload, nil
+}
+
+// Reply to the request with the given ID from the twin on the topic, and
+// return the ID of the reply
+func (c *Client) Reply(ctx context.Context, dtid uint64, topic string, requestID string, payload []byte) (string, error) {
+	id, err := c.redis.Do(ctx, "REPLY", key(dtid, topic), requestID, payload).Text()
+	return id, errors.Wrap(err, "could not reply")
+}
+
+// Subscription delivers the messages from a twin on a topic, as they arrive
+type Subscription struct {
+	messages chan Message
+	cancel   context.CancelFunc
+
+	err  error
+	lock sync.Mutex
+}
+
+// Subscribe to the messages from the twin on the topic, as for Receive. The
+// messages are removed from the mailbox as they are delivered. The
+// subscription survives connection failures, it ends when the context is
+// done, it is closed, or the broker rejects the subscription.
+func (c *Client) Subscribe(ctx context.Context, dtid uint64, topic string) *Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &Subscription{
+		messages: make(chan Message),
+		cancel:   cancel,
+	}
+
+	go sub.run(ctx, c, dtid, topic)
+
+	return sub
+}
+
+// Messages returns the channel the messages are delivered on. It is closed
+// when the subscription ends.
+func (s *Subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Err returns the reason the subscription ended, if the broker rejected it
+func (s *Subscription) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.err
+}
+
+// Close the subscription
+func (s *Subscription) Close() {
+	s.cancel()
+}
+
+func (s *Subscription) run(ctx context.Context, c *Client, dtid uint64, topic string) {
+	defer close(s.messages)
+
+	backoff := c.opts.minBackoff
+	for {
+		msg, err := c.BlockingReceive(ctx, dtid, topic)
+		if ctx.Err() != nil {
+			return
+		}
+
+		var rerr redis.Error
+		if errors.As(err, &rerr) {
+			// errors replied by the broker don't go away by retrying
+			s.lock.Lock()
+			s.err = err
+			s.lock.Unlock()
+			return
+		} else if err != nil {
+			// wait for the broker to become reachable again
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > c.opts.maxBackoff {
+				backoff = c.opts.maxBackoff
+			}
+			continue
+		}
+		backoff = c.opts.minBackoff
+
+		select {
+		case s.messages <- msg:
+		case <-ctx.Done():
+			// the message is lost, since it is already removed from the
+			// mailbox
+			return
+		}
+	}
+}
+
+// retry runs a command which does not change the mailbox, retrying it after
+// network errors with a backoff
+func (c *Client) retry(ctx context.Context, args ...interface{}) *redis.Cmd {
+	backoff := c.opts.minBackoff
+	for attempt := 0; ; attempt++ {
+		cmd := c.redis.Do(ctx, args...)
+		var rerr redis.Error
+		if cmd.Err() == nil || errors.As(cmd.Err(), &rerr) || attempt >= c.opts.maxRetries {
+			return cmd
+		}
+
+		select {
+		case <-ctx.Done():
+			return cmd
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.opts.maxBackoff {
+			backoff = c.opts.maxBackoff
+		}
+	}
+}
+
+// toArgs converts strings to command arguments
+func toArgs(strs []string) []interface{} {
+	args := make([]interface{}, len(strs))
+	for i, s := range strs {
+		args[i] = s
+	}
+	return args
+}
+
+// key formats the key of a twin and topic
+func key(dtid uint64, topic string) string {
+	return fmt.Sprintf("%d:%s", dtid, topic)
+}
+
+// parseMessage parses a key and payload, as replied by the broker
+func parseMessage(rawKey interface{}, rawPayload interface{}) (Message, error) {
+	k, ok := rawKey.(string)
+	if !ok {
+		return Message{}, errors.Errorf("unexpected key %T", rawKey)
+	}
+	payload, ok := rawPayload.(string)
+	if !ok {
+		return Message{}, errors.Errorf("unexpected payload %T", rawPayload)
+	}
+
+	parts := strings.SplitN(k, ":", 2)
+	if len(parts) != 2 {
+		return Message{}, errors.Errorf("malformed key %q", k)
+	}
+	sender, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Message{}, errors.Wrapf(err, "malformed key %q", k)
+	}
+
+	return Message{
+		Sender:  sender,
+		Topic:   parts[1],
+		Payload: []byte(payload),
+	}, nil
+}
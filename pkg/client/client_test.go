@@ -0,0 +1,501 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfagent/pkg"
+	"github.com/threefoldtech/tfagent/pkg/keys"
+)
+
+// testStore is a PeerStore with a generated ed25519 key per digital twin
+type testStore struct {
+	keys  map[uint64]*keys.Key
+	peers map[uint64]string
+	lock  sync.Mutex
+}
+
+func newTestStore(t *testing.T, dtids ...uint64) *testStore {
+	ts := &testStore{
+		keys:  make(map[uint64]*keys.Key),
+		peers: make(map[uint64]string),
+	}
+	for _, dtid := range dtids {
+		seed := make([]byte, 32)
+		if _, err := rand.Read(seed); err != nil {
+			t.Fatal(err)
+		}
+		key, err := keys.FromURI(keys.Ed25519, "0x"+hex.EncodeToString(seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.keys[dtid] = key
+	}
+	return ts
+}
+
+func (ts *testStore) PeerID(dtid uint64) (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	pid, ok := ts.peers[dtid]
+	if !ok {
+		return "", errors.New("unknown twin")
+	}
+	return pid, nil
+}
+
+func (ts *testStore) PublicKey(dtid uint64) (pkg.TwinKey, error) {
+	pk := pkg.TwinKey{}
+	key, ok := ts.keys[dtid]
+	if !ok {
+		return pk, errors.New("unknown twin")
+	}
+	pk.Type = key.Type()
+	copy(pk.Public[:], key.Public())
+	return pk, nil
+}
+
+func (ts *testStore) SetPeerID(dtid uint64, pid string) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.peers[dtid] = pid
+}
+
+// broker runs an agent serving all twins of the store, and returns its address
+func broker(t *testing.T, store *testStore, opts ...pkg.Option) string {
+	agent, err := pkg.New(append([]pkg.Option{
+		pkg.WithPeerStore(store),
+		pkg.WithTransport(pkg.NewMemoryNetwork().NewTransport()),
+		pkg.WithPort(0),
+		pkg.WithLogger(&pkg.NOOPLogger{}),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- agent.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	})
+
+	select {
+	case <-agent.Ready():
+	case err := <-errs:
+		t.Fatal(err)
+	}
+	for dtid := range store.keys {
+		store.SetPeerID(dtid, agent.PeerID())
+	}
+
+	return agent.Addr().String()
+}
+
+func (ts *testStore) client(t *testing.T, addr string, dtid uint64, opts ...Option) *Client {
+	c, err := NewWithSigner(addr, dtid, ts.keys[dtid], opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCall(t *testing.T) {
+	store := newTestStore(t, 1, 2)
+	addr := broker(t, store)
+	caller, callee := store.client(t, addr, 1), store.client(t, addr, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the callee echoes the first request
+	go func() {
+		request, err := callee.BlockingReceive(ctx, 1, "echo")
+		if err != nil {
+			return
+		}
+		callee.Reply(ctx, request.Sender, request.Topic, request.ID, append([]byte("re: "), request.Payload...))
+	}()
+
+	reply, err := caller.Call(ctx, 2, "echo", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "re: hello" {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	store := newTestStore(t, 1, 2)
+	addr := broker(t, store)
+	caller := store.client(t, addr, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := caller.Call(ctx, 2, "echo", []byte("hello")); err != ErrTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	store := newTestStore(t, 1, 2)
+	addr := broker(t, store)
+	c1, c2 := store.client(t, addr, 1), store.client(t, addr, 2)
+	ctx := context.Background()
+
+	if err := c1.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, payload := range []string{"a", "b", "c"} {
+		id, err := c1.Send(ctx, 2, "chat", []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err := c2.Len(ctx, 1, "chat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("messages were not delivered, mailbox has %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	messages, err := c2.Range(ctx, 0, "", 1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Message{
+		{ID: ids[1], Sender: 1, Topic: "chat", Payload: []byte("b")},
+		{ID: ids[2], Sender: 1, Topic: "chat", Payload: []byte("c")},
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("expected range %+v, got %+v", expected, messages)
+	}
+
+	msg, err := c2.Receive(ctx, 1, "chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg, Message{ID: ids[0], Sender: 1, Topic: "chat", Payload: []byte("a")}) {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	if _, err := c2.Receive(ctx, 1, "other"); err != ErrNoMessage {
+		t.Errorf("expected no message, got %v", err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	store := newTestStore(t, 1, 2)
+	addr := broker(t, store)
+	c1, c2 := store.client(t, addr, 1), store.client(t, addr, 2)
+	ctx := context.Background()
+
+	id, err := c1.Send(ctx, 2, "jobs", []byte("work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var msg Message
+	for {
+		if msg, err = c2.Lease(ctx, 1, "jobs", 100*time.Millisecond); err != ErrNoMessage {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("message was not delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Lease == "" || !reflect.DeepEqual(msg, Message{ID: id, Sender: 1, Topic: "jobs", Payload: []byte("work"), Deliveries: 1, Lease: msg.Lease}) {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	// the message is redelivered once the lease expires
+	time.Sleep(200 * time.Millisecond)
+	if msg, err = c2.Lease(ctx, 1, "jobs", time.Minute); err != nil || msg.Deliveries != 2 {
+		t.Fatalf("expected message to be redelivered, got %+v %v", msg, err)
+	}
+	if n, err := c2.Nack(ctx, msg.Lease); err != nil || n != 1 {
+		t.Errorf("expected message to be returned to the mailbox, got %d %v", n, err)
+	}
+	if msg, err = c2.Lease(ctx, 1, "jobs", time.Minute); err != nil || msg.Deliveries != 3 {
+		t.Fatalf("expected message to be redelivered, got %+v %v", msg, err)
+	}
+	if n, err := c2.Ack(ctx, msg.Lease); err != nil || n != 1 {
+		t.Errorf("expected message to be acknowledged, got %d %v", n, err)
+	}
+	if _, err := c2.Lease(ctx, 1, "jobs", time.Minute); err != ErrNoMessage {
+		t.Errorf("expected no message after acknowledging, got %v", err)
+	}
+}
+
+func TestSr25519(t *testing.T) {
+	const alice = "bottom drive obey lake curtain smoke basket hold race lonely fit walk//Alice"
+	store := newTestStore(t, 2)
+	key, err := keys.FromURI(keys.Sr25519, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.keys[1] = key
+	addr := broker(t, store)
+	ctx := context.Background()
+
+	c1, c2 := store.client(t, addr, 1), store.client(t, addr, 2)
+	if _, err := c1.Send(ctx, 2, "chat", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	msg, err := c2.BlockingReceive(ctx, 1, "chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Payload) != "hello" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	// the ed25519 key derived from the same secret is not the twin key
+	other, err := keys.FromURI(keys.Ed25519, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewWithSigner(addr, 1, other, WithRetries(0, time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err == nil {
+		t.Error("expected authentication with the ed25519 key to fail")
+	}
+}
+
+func TestTrustedSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := unixSocketPrefix + filepath.Join(dir, "resp.sock")
+
+	store := newTestStore(t, 1, 2)
+	addr := broker(t, store, pkg.WithListener(pkg.ListenerConfig{Address: socket, Twin: 1}))
+	ctx := context.Background()
+
+	// the socket authenticates the client as twin 1
+	c1, err := NewWithSigner(socket, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	if _, err := c1.Send(ctx, 2, "chat", []byte("local")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	msg, err := store.client(t, addr, 2).BlockingReceive(ctx, 1, "chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Payload) != "local" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	store := newTestStore(t, 1, 2)
+	addr := broker(t, store)
+	c1, c2 := store.client(t, addr, 1), store.client(t, addr, 2, WithPollInterval(10*time.Millisecond))
+	ctx := context.Background()
+
+	sub := c2.Subscribe(ctx, 1, "chat")
+	for _, payload := range []string{"a", "b"} {
+		if _, err := c1.Send(ctx, 2, "chat", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range []string{"a", "b"} {
+		select {
+		case msg := <-sub.Messages():
+			if string(msg.Payload) != expected {
+				t.Errorf("expected %s, got %s", expected, msg.Payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not delivered to the subscription")
+		}
+	}
+
+	sub.Close()
+	if _, ok := <-sub.Messages(); ok {
+		t.Error("expected closed subscription")
+	}
+	if err := sub.Err(); err != nil {
+		t.Errorf("expected no error after close, got %v", err)
+	}
+}
+
+func TestSubscribeRejected(t *testing.T) {
+	store := newTestStore(t, 1)
+	addr := broker(t, store)
+
+	// the key of another twin
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(addr, 1, key, WithRetries(0, time.Millisecond, time.Millisecond))
+	defer c.Close()
+
+	if err := c.Connect(context.Background()); err == nil {
+		t.Error("expected authentication to fail")
+	}
+
+	sub := c.Subscribe(context.Background(), 0, "")
+	defer sub.Close()
+	select {
+	case _, ok := <-sub.Messages():
+		if ok {
+			t.Fatal("unexpected message")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected subscription to end")
+	}
+	if sub.Err() == nil {
+		t.Error("expected subscription error")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	store := newTestStore(t, 1, 2)
+	p := newProxy(t, broker(t, store))
+	c := store.client(t, p.addr(), 1)
+	ctx := context.Background()
+
+	if _, err := c.Send(ctx, 2, "chat", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// reads are retried, so the client reconnects and authenticates again
+	p.drop()
+	if _, err := c.Len(ctx, 2, "chat"); err != nil {
+		t.Fatal(err)
+	}
+	if p.accepted() != 2 {
+		t.Errorf("expected a new connection, got %d connections", p.accepted())
+	}
+
+	// commands changing the mailbox are not retried, as they could have been
+	// executed before the connection failed
+	p.drop()
+	if _, err := c.Send(ctx, 2, "chat", []byte("b")); err == nil {
+		t.Error("expected send on a dropped connection to fail")
+	}
+	if _, err := c.Send(ctx, 2, "chat", []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if p.accepted() != 3 {
+		t.Errorf("expected a new connection, got %d connections", p.accepted())
+	}
+}
+
+// proxy forwards connections to the broker, and can drop them to simulate
+// network failures
+type proxy struct {
+	ln    net.Listener
+	conns []net.Conn
+	count int
+	lock  sync.Mutex
+}
+
+func newProxy(t *testing.T, target string) *proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		p.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.lock.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.count++
+			p.lock.Unlock()
+
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+
+	return p
+}
+
+func (p *proxy) addr() string {
+	return p.ln.Addr().String()
+}
+
+func (p *proxy) accepted() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.count
+}
+
+// drop all connections
+func (p *proxy) drop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
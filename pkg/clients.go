@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientInfo describes a client connected to the server
+type ClientInfo struct {
+	// ID of the client, unique for the lifetime of the server
+	ID uint64 `json:"id"`
+	// RemoteAddr of the client connection
+	RemoteAddr string `json:"remote_addr"`
+	// Listener the client connected to
+	Listener string `json:"listener"`
+	// TLS is true if the client connected over TLS
+	TLS bool `json:"tls"`
+	// Name of the client, set with HELLO SETNAME
+	Name string `json:"name,omitempty"`
+	// Proto is the RESP version used by the client
+	Proto int `json:"proto"`
+	// Twin the client authenticated as, 0 if it is not authenticated
+	Twin uint64 `json:"twin"`
+	// ConnectedAt is the time the client connected
+	ConnectedAt time.Time `json:"connected_at"`
+	// LastCommand executed by the client
+	LastCommand string `json:"last_command"`
+	// LastActive is the time the last command was received
+	LastActive time.Time `json:"last_active"`
+	// Commands executed by the client
+	Commands uint64 `json:"commands"`
+}
+
+// client tracks a connected client, it is updated by the goroutine handling
+// the connection and read by the admin interface
+type client struct {
+	conn net.Conn
+	// ip the connection is counted for in the limit per address
+	ip   string
+	info ClientInfo
+	lock sync.Mutex
+}
+
+func (c *client) command(cmd string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.info.LastCommand = cmd
+	c.info.LastActive = time.Now()
+	c.info.Commands++
+}
+
+func (c *client) authenticated(dtid uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.info.Twin = dtid
+}
+
+// hello records the protocol version and name negotiated with HELLO. The name
+// is kept if it is empty.
+func (c *client) hello(proto int, name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.info.Proto = proto
+	if name != "" {
+		c.info.Name = name
+	}
+}
+
+func (c *client) snapshot() ClientInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.info
+}
+
+// clients connected to a server
+type clients struct {
+	clients map[*client]struct{}
+	// perIP counts the tcp clients per remote address
+	perIP  map[string]int
+	nextID uint64
+	// closed is set once all clients are closed, new clients are closed
+	// immediately
+	closed bool
+	lock   sync.Mutex
+}
+
+// add a client, unless it exceeds the connection limits
+func (cs *clients) add(conn net.Conn, listener string, limits Limits) (*client, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if cs.clients == nil {
+		cs.clients = make(map[*client]struct{})
+		cs.perIP = make(map[string]int)
+	}
+
+	ip := remoteIP(conn)
+	if limits.MaxConnections > 0 && len(cs.clients) >= limits.MaxConnections {
+		return nil, errMaxClients
+	}
+	if ip != "" && limits.MaxConnectionsPerIP > 0 && cs.perIP[ip] >= limits.MaxConnectionsPerIP {
+		return nil, errMaxClientsPerIP
+	}
+
+	_, isTLS := conn.(*tls.Conn)
+	if ws, ok := conn.(*wsConn); ok {
+		isTLS = ws.tls
+	}
+
+	cs.nextID++
+	c := &client{conn: conn, ip: ip, info: ClientInfo{
+		ID:          cs.nextID,
+		RemoteAddr:  remoteAddr(conn),
+		Listener:    listener,
+		TLS:         isTLS,
+		Proto:       resp2,
+		ConnectedAt: time.Now(),
+	}}
+	cs.clients[c] = struct{}{}
+	if ip != "" {
+		cs.perIP[ip]++
+	}
+	if cs.closed {
+		conn.Close()
+	}
+
+	return c, nil
+}
+
+func (cs *clients) remove(c *client) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	delete(cs.clients, c)
+	if c.ip == "" {
+		return
+	}
+	cs.perIP[c.ip]--
+	if cs.perIP[c.ip] == 0 {
+		delete(cs.perIP, c.ip)
+	}
+}
+
+// list the connected clients, ordered by ID
+func (cs *clients) list() []ClientInfo {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	out := make([]ClientInfo, 0, len(cs.clients))
+	for c := range cs.clients {
+		out = append(out, c.snapshot())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+
+	return out
+}
+
+// isClosed returns true once all clients are closed
+func (cs *clients) isClosed() bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	return cs.closed
+}
+
+// closeAll closes the connections of all clients
+func (cs *clients) closeAll() {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.closed = true
+	for c := range cs.clients {
+		c.conn.Close()
+	}
+}
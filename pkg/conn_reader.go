@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// connReaderBufferSize is the size of the reads from the connection
+const connReaderBufferSize = 4096
+
+// connReader reads a connection in the background, so a client going away is
+// noticed while a command blocks. Commands are parsed from the reader, and
+// its context is done once reading the connection fails.
+type connReader struct {
+	*io.PipeReader
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newConnReader(ctx context.Context, conn net.Conn) *connReader {
+	pr, pw := io.Pipe()
+	r := &connReader{PipeReader: pr}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+
+	go func() {
+		defer r.cancel()
+
+		buf := make([]byte, connReaderBufferSize)
+		for {
+			n, err := conn.Read(buf)
+			// writing blocks until the data is parsed, so a slow parser
+			// slows down reading the connection
+			if n > 0 {
+				if _, werr := pw.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+// Close the reader and cancel its context. The background read stops once the
+// connection is closed.
+func (r *connReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
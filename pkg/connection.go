@@ -1,10 +1,70 @@
 package pkg
 
-// connection from a digital twin
+import (
+	"context"
+	"time"
+)
+
+// mailboxKey selects messages in the mailbox by sender and subject. A zero
+// sender or empty subject matches all.
+type mailboxKey struct {
+	dtid    uint64
+	subject string
+}
+
+// connection from a digital twin. The list operations work on the mailbox of
+// the twin, filtered by sender and subject. The mailbox is ordered by arrival,
+// so the head of the list is the oldest message. Indices can be negative to
+// count from the tail, as is done by redis.
 type connection interface {
 	Auth(dtid uint64, rawSig []byte) error
-	LPush(receiverDtid uint64, subject string, payload []byte) error
+	// LPush sends a message, and returns its ID
+	LPush(receiverDtid uint64, subject string, payload []byte) (string, error)
+	RPush(receiverDtid uint64, subject string, payload []byte) (string, error)
 	LPop(dtid uint64, subject string) (Message, error)
+	RPop(dtid uint64, subject string) (Message, error)
 	LLen(dtid uint64, subject string) (uint64, error)
 	LRange(dtid uint64, subject string, start int, end int) ([]Message, error)
+	LIndex(dtid uint64, subject string, index int) (Message, error)
+	LRem(dtid uint64, subject string, count int, payload []byte) (uint64, error)
+	LTrim(dtid uint64, subject string, start int, end int) error
+	LPos(dtid uint64, subject string, payload []byte, rank int, count int, maxLen int) ([]int, error)
+	// LPopMsg pops the oldest message, like LPop, the message ID included
+	LPopMsg(dtid uint64, subject string) (Message, error)
+	// Lease pops the oldest message, like LPopMsg, but the message is put back
+	// in the mailbox unless it is acknowledged before the timeout. The ID of
+	// the lease is returned with the message.
+	Lease(dtid uint64, subject string, timeout time.Duration) (Message, string, error)
+	// Ack removes the messages of the leases with the IDs for good, and
+	// returns how many of them were leased
+	Ack(ids []string) (uint64, error)
+	// Nack puts the messages of the leases with the IDs back in the mailbox
+	// right away, and returns how many of them were leased
+	Nack(ids []string) (uint64, error)
+	// Call sends a request, and waits for the reply of the receiver. If the
+	// timeout is 0, it waits until the context is done.
+	Call(ctx context.Context, receiverDtid uint64, subject string, payload []byte, timeout time.Duration) (Message, error)
+	// Reply sends a reply to the request with the given ID, and returns the ID
+	// of the reply
+	Reply(receiverDtid uint64, subject string, requestID string, payload []byte) (string, error)
+	// Next pops the oldest message matching one of the keys, waiting for it
+	// until the context is done
+	Next(ctx context.Context, keys []mailboxKey) (Message, error)
+	// Peek returns the oldest message matching one of the keys without
+	// popping it, waiting for it until the context is done
+	Peek(ctx context.Context, keys []mailboxKey) (Message, error)
+	Trace(id string) ([]TraceEvent, error)
+	// DeadLetters lists the messages of the twin which could not be delivered
+	// to the receiver on the subject, oldest first
+	DeadLetters(receiverDtid uint64, subject string) ([]DeadLetter, error)
+	// DeadLetterPop pops the oldest dead letter, as listed by DeadLetters
+	DeadLetterPop(receiverDtid uint64, subject string) (DeadLetter, error)
+	// SetBounce enables or disables bounce messages for dead letters. Bounces
+	// are only sent for messages which fail after they were queued, as other
+	// failures are already returned when the message is pushed.
+	SetBounce(enabled bool) error
+	ACLSet(dtid uint64, subject string, allow bool) error
+	ACLDel(dtid uint64, subject string) (bool, error)
+	ACLList() ([]ACLRule, error)
+	ACLReset() error
 }
@@ -1,12 +1,34 @@
 package pkg
 
-import "crypto/ed25519"
+import (
+	"crypto/ed25519"
 
+	"github.com/threefoldtech/tfagent/pkg/keys"
+)
+
+// Ed25519 and sr25519 keys and signatures have the same size
 const (
 	PublicKeySize = ed25519.PublicKeySize
 	SignatureSize = ed25519.SignatureSize
 )
 
-func signatureValid(pk [PublicKeySize]byte, sig [SignatureSize]byte) bool {
-	return ed25519.Verify(ed25519.PublicKey(pk[:]), []byte("A"), sig[:])
+// TwinKey is the public key of a digital twin
+type TwinKey struct {
+	// Type of the key, ed25519 if empty
+	Type keys.Type
+	// Public key
+	Public [PublicKeySize]byte
+}
+
+// Verify the signature of the message
+func (k TwinKey) Verify(msg []byte, sig []byte) bool {
+	t := k.Type
+	if t == "" {
+		t = keys.Ed25519
+	}
+	return keys.Verify(t, k.Public[:], msg, sig)
+}
+
+func signatureValid(pk TwinKey, sig [SignatureSize]byte) bool {
+	return pk.Verify([]byte(keys.AuthChallenge), sig[:])
 }
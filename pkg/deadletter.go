@@ -0,0 +1,219 @@
+package pkg
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxDeadLetters kept per twin, the oldest are dropped first
+	maxDeadLetters = 1000
+	// deadLetterTTL is how long dead letters are kept
+	deadLetterTTL = 24 * time.Hour
+)
+
+// BounceTopic is the topic of the messages notifying a twin that one of its
+// messages could not be delivered. Bounces are sent by twin 0, and carry a
+// Bounce as JSON payload.
+const BounceTopic = "tfagent.bounce"
+
+// reasons messages are dead lettered, as reported in metrics
+const (
+	deadUnknownReceiver = "unknown_receiver"
+	deadSendFailed      = "send_failed"
+	deadRejected        = "rejected"
+	deadExpired         = "expired"
+)
+
+// DeadLetter is a message sent by a digital twin which could not be delivered
+type DeadLetter struct {
+	Message
+	// Reason the message could not be delivered
+	Reason string `json:"reason"`
+	// Time the message was given up on
+	Time time.Time `json:"time"`
+}
+
+// Bounce is the payload of a message on the BounceTopic. The message replies
+// to the undeliverable message.
+type Bounce struct {
+	// ID of the undeliverable message
+	ID string `json:"id"`
+	// Receiver of the undeliverable message
+	Receiver uint64 `json:"receiver"`
+	// Topic of the undeliverable message
+	Topic string `json:"topic"`
+	// Reason the message could not be delivered
+	Reason string `json:"reason"`
+	// Time the message was given up on
+	Time time.Time `json:"time"`
+}
+
+// DeadLetters keeps the messages which could not be delivered per sending
+// digital twin, oldest first. This includes the failures which were returned
+// to the sender when it pushed the message.
+type DeadLetters struct {
+	letters map[uint64][]DeadLetter
+	// bounce is set for twins which are notified of dead letters
+	bounce map[uint64]bool
+	lock   sync.Mutex
+}
+
+// NewDeadLetters creates a new empty dead letter store
+func NewDeadLetters() *DeadLetters {
+	return &DeadLetters{
+		letters: make(map[uint64][]DeadLetter),
+		bounce:  make(map[uint64]bool),
+	}
+}
+
+// Add the dead letter for its sender. Returns true if the sender is notified
+// of dead letters.
+func (d *DeadLetters) Add(letter DeadLetter) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	letters := append(d.letters[letter.Sender], letter)
+	if len(letters) > maxDeadLetters {
+		letters = append([]DeadLetter(nil), letters[len(letters)-maxDeadLetters:]...)
+	}
+	d.letters[letter.Sender] = letters
+
+	return d.bounce[letter.Sender]
+}
+
+// List the dead letters of the sender to the receiver on the topic, oldest
+// first. A zero receiver or empty topic matches all.
+func (d *DeadLetters) List(sender uint64, receiver uint64, topic string) []DeadLetter {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	out := []DeadLetter{}
+	for _, letter := range d.letters[sender] {
+		if letter.matches(receiver, topic) {
+			out = append(out, letter)
+		}
+	}
+	return out
+}
+
+// Pop the oldest dead letter of the sender to the receiver on the topic, as
+// for List. Returns false if there is none.
+func (d *DeadLetters) Pop(sender uint64, receiver uint64, topic string) (DeadLetter, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	letters := d.letters[sender]
+	for i, letter := range letters {
+		if letter.matches(receiver, topic) {
+			d.letters[sender] = append(letters[:i], letters[i+1:]...)
+			return letter, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+// SetBounce enables or disables bounce messages for the sender
+func (d *DeadLetters) SetBounce(sender uint64, enabled bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if enabled {
+		d.bounce[sender] = true
+	} else {
+		delete(d.bounce, sender)
+	}
+}
+
+// expire removes the dead letters from before the given time, and returns how
+// many were removed
+func (d *DeadLetters) expire(before time.Time) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var n int
+	for sender, letters := range d.letters {
+		kept := letters[:0]
+		for _, letter := range letters {
+			if letter.Time.Before(before) {
+				n++
+			} else {
+				kept = append(kept, letter)
+			}
+		}
+		if len(kept) == 0 {
+			delete(d.letters, sender)
+		} else {
+			d.letters[sender] = kept
+		}
+	}
+	return n
+}
+
+// counts of the dead letters per sender
+func (d *DeadLetters) counts() map[uint64]int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	out := make(map[uint64]int, len(d.letters))
+	for sender, letters := range d.letters {
+		if len(letters) > 0 {
+			out[sender] = len(letters)
+		}
+	}
+	return out
+}
+
+func (letter DeadLetter) matches(receiver uint64, topic string) bool {
+	return (receiver == 0 || letter.Receiver == receiver) && (topic == "" || letter.Topic == topic)
+}
+
+// deadLetter gives up on delivering the message, and notifies the sender if
+// it asked for bounces. Failures which were returned to the sender when it
+// pushed the message are only kept as dead letter, so the sender does not hear
+// about them twice. The reason is reported in metrics, the detail to the
+// sender.
+func (bn *BufferedNode) deadLetter(msg Message, reason string, detail string, returned bool) {
+	letter := DeadLetter{Message: msg, Reason: detail, Time: time.Now()}
+	bn.trace(msg, eventDeadLettered, detail)
+	bn.metrics.deadLettered(reason)
+	if !bn.deadLetters.Add(letter) || returned {
+		return
+	}
+
+	payload, err := json.Marshal(Bounce{
+		ID:       msg.ID,
+		Receiver: msg.Receiver,
+		Topic:    msg.Topic,
+		Reason:   detail,
+		Time:     letter.Time,
+	})
+	if err != nil {
+		bn.log.WithField("error", err).Error("could not encode bounce")
+		return
+	}
+
+	// the sender is served by this node, so the bounce is delivered locally
+	bounce := Message{
+		ID:       uuid.New().String(),
+		Receiver: msg.Sender,
+		Topic:    BounceTopic,
+		TTL:      time.Now().Add(defaultMsgTTL),
+		Payload:  payload,
+		ReplyTo:  msg.ID,
+	}
+	bn.recvQLock.Lock()
+	bn.recvQ = append(bn.recvQ, bounce)
+	close(bn.recvNotify)
+	bn.recvNotify = make(chan struct{})
+	bn.recvQLock.Unlock()
+	bn.trace(bounce, eventEnqueued, "bounce")
+}
+
+// DeadLetters of the digital twins served by this node
+func (bn *BufferedNode) DeadLetters() *DeadLetters {
+	return bn.deadLetters
+}
@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterUnknownReceiver(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	client := h.client(1)
+	ctx := context.Background()
+
+	if err := client.Do(ctx, "LPUSH", "3:chat", "hello").Err(); err == nil {
+		t.Fatal("expected message to unknown twin to fail")
+	}
+	if n, err := client.Do(ctx, "DEADLETTER", "LEN", "0:").Int(); err != nil || n != 1 {
+		t.Fatalf("expected 1 dead letter, got %d %v", n, err)
+	}
+	if queues := h.node.Queues(); !reflect.DeepEqual(queues, []QueueInfo{{Twin: 1, DeadLetters: 1}}) {
+		t.Errorf("unexpected queues %+v", queues)
+	}
+
+	// dead letters are filtered by receiver and topic
+	for key, expected := range map[string]int{"3:": 1, "3:chat": 1, "0:chat": 1, "2:": 0, "3:other": 0} {
+		if n, err := client.Do(ctx, "DEADLETTER", "LEN", key).Int(); err != nil || n != expected {
+			t.Errorf("expected %d dead letters for %s, got %d %v", expected, key, n, err)
+		}
+	}
+
+	reply, err := client.Do(ctx, "DEADLETTER", "RANGE", "0:", 0, -1).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 1 {
+		t.Fatalf("expected 1 dead letter, got %v", reply)
+	}
+	letter := reply[0].([]interface{})
+	if letter[0] != "3:chat" || letter[1] != "hello" || !strings.Contains(letter[3].(string), "could not load receiver peerID") {
+		t.Errorf("unexpected dead letter %v", letter)
+	}
+
+	popped, err := client.Do(ctx, "DEADLETTER", "POP", "3:chat").Slice()
+	if err != nil || !reflect.DeepEqual(popped, letter) {
+		t.Errorf("expected to pop dead letter %v, got %v %v", letter, popped, err)
+	}
+	if err := client.Do(ctx, "DEADLETTER", "POP", "3:chat").Err(); err == nil || err.Error() != "redis: nil" {
+		t.Errorf("expected no dead letter, got %v", err)
+	}
+
+	// twins only see their own dead letters, and don't get bounces unless
+	// they ask for them
+	if n, err := h.client(2).Do(ctx, "DEADLETTER", "LEN", "0:").Int(); err != nil || n != 0 {
+		t.Errorf("expected no dead letters for other twin, got %d %v", n, err)
+	}
+	if n, err := client.LLen(ctx, "0:"+BounceTopic).Result(); err != nil || n != 0 {
+		t.Errorf("expected no bounce, got %d %v", n, err)
+	}
+}
+
+func TestDeadLetterBounce(t *testing.T) {
+	network := NewMemoryNetwork()
+	store := newTestStore(t, 1, 2)
+	b1 := newBroker(t, network, store, 1)
+	b2 := newBroker(t, network, store, 2)
+	ctx := context.Background()
+
+	c := b1.respConn()
+	c.do("HELLO", 3, "AUTH", 1, store.sig(1))
+	if reply := c.do("DEADLETTER", "BOUNCE", "ON"); reply != "OK" {
+		t.Fatalf("expected bounces to be enabled, got %v", reply)
+	}
+	if _, ok := c.do("DEADLETTER", "BOUNCE", "MAYBE").(respError); !ok {
+		t.Error("expected invalid bounce option to fail")
+	}
+
+	// the message is queued while partitioned, until its TTL expires
+	network.Partition(b1.peerID(), b2.peerID())
+	id := c.do("LPUSHID", "2:chat", "lost")
+	b1.node.expire(time.Now().Add(2 * defaultMsgTTL))
+
+	bounce, ok := c.do("LPOPMSG", "0:"+BounceTopic).(map[string]interface{})
+	if !ok || bounce["key"] != "0:"+BounceTopic || bounce["reply_to"] != id {
+		t.Fatalf("expected bounce, got %v", bounce)
+	}
+	var payload Bounce
+	if err := json.Unmarshal([]byte(bounce["payload"].(string)), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != id || payload.Receiver != 2 || payload.Topic != "chat" || payload.Reason != "TTL expired in send queue" {
+		t.Errorf("unexpected bounce %+v", payload)
+	}
+
+	letter, ok := c.do("DEADLETTER", "POP", "2:").(map[string]interface{})
+	if !ok || letter["id"] != id || letter["payload"] != "lost" || letter["receiver"] != int64(2) {
+		t.Errorf("unexpected dead letter %v", letter)
+	}
+
+	// failures returned when the message is pushed are not bounced
+	if err := b1.client(1).Do(ctx, "LPUSH", "3:chat", "hello").Err(); err == nil {
+		t.Fatal("expected message to unknown twin to fail")
+	}
+	if n := c.do("LLEN", "0:"+BounceTopic); n != int64(0) {
+		t.Errorf("expected no bounce, got %v", n)
+	}
+	if n := c.do("DEADLETTER", "LEN", "0:"); n != int64(1) {
+		t.Errorf("expected 1 dead letter, got %v", n)
+	}
+
+	// once disabled, no more bounces are sent
+	c.do("DEADLETTER", "BOUNCE", "OFF")
+	c.do("LPUSHID", "2:chat", "lost again")
+	b1.node.expire(time.Now().Add(2 * defaultMsgTTL))
+	if n := c.do("LLEN", "0:"+BounceTopic); n != int64(0) {
+		t.Errorf("expected no bounce, got %v", n)
+	}
+	if n := c.do("DEADLETTER", "LEN", "0:"); n != int64(2) {
+		t.Errorf("expected 2 dead letters, got %v", n)
+	}
+}
+
+func TestDeadLetterRejected(t *testing.T) {
+	network := NewMemoryNetwork()
+	store := newTestStore(t, 1, 2)
+	b1 := newBroker(t, network, store, 1)
+	b2 := newBroker(t, network, store, 2)
+	b2.node.ACL().Set(2, ACLRule{Sender: 1, Allow: false})
+
+	c := b1.respConn()
+	c.do("HELLO", 3, "AUTH", 1, store.sig(1))
+	c.do("DEADLETTER", "BOUNCE", "ON")
+
+	reply, ok := c.do("LPUSHID", "2:chat", "denied").(respError)
+	if !ok || !strings.Contains(string(reply), "rejected by receiver: denied by receiver ACL") {
+		t.Fatalf("expected message to be rejected, got %v", reply)
+	}
+
+	letter, ok := c.do("DEADLETTER", "POP", "2:chat").(map[string]interface{})
+	if !ok || letter["payload"] != "denied" || !strings.Contains(letter["reason"].(string), "rejected by receiver") {
+		t.Errorf("unexpected dead letter %v", letter)
+	}
+	if n := c.do("LLEN", "0:"+BounceTopic); n != int64(0) {
+		t.Errorf("expected no bounce, got %v", n)
+	}
+	if mailbox := b2.node.Mailbox(2); len(mailbox) != 0 {
+		t.Errorf("expected rejected message not to be delivered, got %v", mailbox)
+	}
+
+	// the sender is not told about failures of queued messages when they are
+	// pushed, so those are bounced
+	network.Partition(b1.peerID(), b2.peerID())
+	id := c.do("LPUSHID", "2:chat", "queued")
+	network.Heal(b1.peerID(), b2.peerID())
+	b1.node.retry()
+
+	bounce, ok := c.do("LPOPMSG", "0:"+BounceTopic).(map[string]interface{})
+	if !ok || bounce["reply_to"] != id || !strings.Contains(bounce["payload"].(string), "rejected by receiver") {
+		t.Errorf("expected bounce, got %v", bounce)
+	}
+}
+
+func TestDeadLettersLimits(t *testing.T) {
+	d := NewDeadLetters()
+	now := time.Now()
+
+	for i := 0; i < maxDeadLetters+10; i++ {
+		d.Add(DeadLetter{Message: Message{Sender: 1, Receiver: 2}, Time: now.Add(time.Duration(i) * time.Second)})
+	}
+	d.Add(DeadLetter{Message: Message{Sender: 3, Receiver: 2}, Time: now.Add(-deadLetterTTL)})
+
+	letters := d.List(1, 0, "")
+	if len(letters) != maxDeadLetters || !letters[0].Time.Equal(now.Add(10*time.Second)) {
+		t.Errorf("expected the oldest dead letters to be dropped, got %d from %s", len(letters), letters[0].Time)
+	}
+
+	if n := d.expire(now.Add(5 * time.Second)); n != 1 {
+		t.Errorf("expected 1 dead letter to expire, got %d", n)
+	}
+	if counts := d.counts(); !reflect.DeepEqual(counts, map[uint64]int{1: maxDeadLetters}) {
+		t.Errorf("unexpected dead letter counts %v", counts)
+	}
+}
@@ -0,0 +1,144 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// fileVersion of the key file format
+const fileVersion = 1
+
+// scrypt parameters, as recommended for interactive logins in 2017
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltSize     = 32
+	nonceSize    = 24
+)
+
+// ErrWrongPassphrase is returned if a key file can't be decrypted
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// file is the format of a key file. The secret URI of the key is encrypted
+// with a key derived from the passphrase with scrypt.
+type file struct {
+	Version int    `json:"version"`
+	Type    Type   `json:"type"`
+	Public  []byte `json:"public"`
+	KDF     kdf    `json:"kdf"`
+	Nonce   []byte `json:"nonce"`
+	Secret  []byte `json:"secret"`
+}
+
+type kdf struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+// Save the key to a new file, encrypted with the passphrase. The file is only
+// readable by the owner, and is not overwritten if it exists.
+func Save(path string, key *Key, passphrase string) error {
+	f := file{
+		Version: fileVersion,
+		Type:    key.typ,
+		Public:  key.Public(),
+		KDF:     kdf{Name: "scrypt", Salt: make([]byte, saltSize), N: scryptN, R: scryptR, P: scryptP},
+		Nonce:   make([]byte, nonceSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, f.KDF.Salt); err != nil {
+		return errors.Wrap(err, "could not generate salt")
+	}
+	if _, err := io.ReadFull(rand.Reader, f.Nonce); err != nil {
+		return errors.Wrap(err, "could not generate nonce")
+	}
+
+	secret, err := f.KDF.derive(passphrase)
+	if err != nil {
+		return err
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], f.Nonce)
+	f.Secret = secretbox.Seal(nil, []byte(key.uri), &nonce, secret)
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not encode key file")
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not create key file")
+	}
+	if _, err = out.Write(append(data, '\n')); err != nil {
+		out.Close()
+		return errors.Wrap(err, "could not write key file")
+	}
+
+	return errors.Wrap(out.Close(), "could not write key file")
+}
+
+// Load a key from a file, decrypting it with the passphrase
+func Load(path string, passphrase string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read key file")
+	}
+
+	var f file
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, errors.Wrap(err, "could not decode key file")
+	}
+	if f.Version != fileVersion {
+		return nil, errors.Errorf("unsupported key file version %d", f.Version)
+	}
+	if len(f.Nonce) != nonceSize {
+		return nil, errors.New("invalid key file nonce")
+	}
+
+	secret, err := f.KDF.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], f.Nonce)
+	uri, ok := secretbox.Open(nil, f.Secret, &nonce, secret)
+	if !ok {
+		return nil, ErrWrongPassphrase
+	}
+
+	return FromURI(f.Type, string(uri))
+}
+
+// IsKeyFile checks if the data looks like a key file, rather than a raw key
+func IsKeyFile(data []byte) bool {
+	var f file
+	return json.Unmarshal(data, &f) == nil && f.Version != 0
+}
+
+// derive the encryption key from the passphrase
+func (k kdf) derive(passphrase string) (*[scryptKeyLen]byte, error) {
+	if k.Name != "scrypt" {
+		return nil, errors.Errorf("unsupported key derivation %q", k.Name)
+	}
+
+	raw, err := scrypt.Key([]byte(passphrase), k.Salt, k.N, k.R, k.P, scryptKeyLen)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not derive encryption key")
+	}
+
+	var secret [scryptKeyLen]byte
+	copy(secret[:], raw)
+	return &secret, nil
+}
@@ -0,0 +1,128 @@
+// Package keys manages the keys of digital twins. Keys are derived from
+// substrate secret URIs, so the same mnemonic gives the same key as the
+// substrate tooling used for grid accounts.
+package keys
+
+import (
+	"github.com/cosmos/go-bip39"
+	"github.com/pkg/errors"
+	"github.com/vedhavyas/go-subkey"
+	"github.com/vedhavyas/go-subkey/ed25519"
+	"github.com/vedhavyas/go-subkey/sr25519"
+)
+
+// Type of a key
+type Type string
+
+const (
+	// Ed25519 keys are used by twins created before sr25519 support
+	Ed25519 Type = "ed25519"
+	// Sr25519 keys are the default for substrate accounts
+	Sr25519 Type = "sr25519"
+)
+
+// DefaultNetwork is the SS58 network prefix of generic substrate addresses
+const DefaultNetwork = 42
+
+// AuthChallenge is the message signed to authenticate to a broker
+const AuthChallenge = "A"
+
+// mnemonicEntropy is the entropy of generated mnemonics in bits, giving 12
+// words
+const mnemonicEntropy = 128
+
+var errUnknownType = errors.New("unknown key type")
+
+// ParseType parses the name of a key type
+func ParseType(name string) (Type, error) {
+	switch t := Type(name); t {
+	case Ed25519, Sr25519:
+		return t, nil
+	default:
+		return "", errors.Wrapf(errUnknownType, "%q", name)
+	}
+}
+
+func (t Type) scheme() (subkey.Scheme, error) {
+	switch t {
+	case Ed25519:
+		return ed25519.Scheme{}, nil
+	case Sr25519:
+		return sr25519.Scheme{}, nil
+	default:
+		return nil, errors.Wrapf(errUnknownType, "%q", string(t))
+	}
+}
+
+// Key of a digital twin
+type Key struct {
+	typ  Type
+	uri  string
+	pair subkey.KeyPair
+}
+
+// FromURI derives a key from a substrate secret URI: a mnemonic or hex seed,
+// optionally followed by a derivation path and password, e.g.
+// "<mnemonic>//hard/soft///password"
+func FromURI(t Type, uri string) (*Key, error) {
+	scheme, err := t.scheme()
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := subkey.DeriveKeyPair(scheme, uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not derive key")
+	}
+
+	return &Key{typ: t, uri: uri, pair: pair}, nil
+}
+
+// Generate a new key, and return it with its mnemonic, which can be used to
+// restore the key
+func Generate(t Type) (*Key, string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropy)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not generate entropy")
+	}
+
+	mnemonic, err := bip39.NewMnemonic(entropy)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not generate mnemonic")
+	}
+
+	key, err := FromURI(t, mnemonic)
+	return key, mnemonic, err
+}
+
+// Type of the key
+func (k *Key) Type() Type {
+	return k.typ
+}
+
+// Public key
+func (k *Key) Public() []byte {
+	return k.pair.Public()
+}
+
+// SS58 address of the key on the network
+func (k *Key) SS58(network uint8) (string, error) {
+	addr, err := k.pair.SS58Address(network)
+	return addr, errors.Wrap(err, "could not encode address")
+}
+
+// Sign the message. Sr25519 signatures use the substrate signing context.
+func (k *Key) Sign(msg []byte) ([]byte, error) {
+	sig, err := k.pair.Sign(msg)
+	return sig, errors.Wrap(err, "could not sign message")
+}
+
+// Verify the signature of the message with the public key
+func (k *Key) Verify(msg []byte, sig []byte) bool {
+	return k.pair.Verify(msg, sig)
+}
+
+// Seed of the key, nil for sr25519 keys with a soft derivation
+func (k *Key) Seed() []byte {
+	return k.pair.Seed()
+}
@@ -0,0 +1,169 @@
+package keys
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// devPhrase is the well known development mnemonic of substrate
+const devPhrase = "bottom drive obey lake curtain smoke basket hold race lonely fit walk"
+
+func TestFromURI(t *testing.T) {
+	// vectors from subkey inspect
+	for _, tc := range []struct {
+		typ    Type
+		uri    string
+		public string
+		ss58   string
+	}{
+		{Sr25519, devPhrase + "//Alice", "d43593c715fdd31c61141abd04a99fd6822c8558854ccde39a5684e7a56da27d", "5GrwvaEF5zXb26Fz9rcQpDWS57CtERHpNehXCPcNoHGKutQY"},
+		{Ed25519, devPhrase + "//Alice", "88dc3417d5058ec4b4503e0c12ea1a0a89be200fe98922423d4334014fa6b0ee", "5FA9nQDVg267DEd8m1ZypXLBnvN7SFxYwV7ndqSYGiN9TTpu"},
+	} {
+		key, err := FromURI(tc.typ, tc.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if public := hex.EncodeToString(key.Public()); public != tc.public {
+			t.Errorf("%s: expected public key %s, got %s", tc.typ, tc.public, public)
+		}
+		ss58, err := key.SS58(DefaultNetwork)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ss58 != tc.ss58 {
+			t.Errorf("%s: expected address %s, got %s", tc.typ, tc.ss58, ss58)
+		}
+	}
+
+	if _, err := FromURI(Sr25519, "not a mnemonic"); err == nil {
+		t.Error("expected invalid mnemonic to fail")
+	}
+	if _, err := ParseType("rsa"); err == nil {
+		t.Error("expected unknown key type to fail")
+	}
+}
+
+func TestSign(t *testing.T) {
+	for _, typ := range []Type{Ed25519, Sr25519} {
+		key, mnemonic, err := Generate(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sig, err := key.Sign([]byte(AuthChallenge))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !key.Verify([]byte(AuthChallenge), sig) {
+			t.Errorf("%s: signature does not verify", typ)
+		}
+		if key.Verify([]byte("B"), sig) {
+			t.Errorf("%s: signature verifies other message", typ)
+		}
+
+		// the mnemonic restores the key
+		restored, err := FromURI(typ, mnemonic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(restored.Public()) != hex.EncodeToString(key.Public()) {
+			t.Errorf("%s: mnemonic does not restore the key", typ)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	// RFC 8032 test vector 1
+	public, _ := hex.DecodeString("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+	sig, _ := hex.DecodeString("e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b")
+	if !Verify(Ed25519, public, nil, sig) {
+		t.Error("expected ed25519 test vector to verify")
+	}
+	if Verify(Sr25519, public, nil, sig) {
+		t.Error("expected ed25519 signature not to verify as sr25519")
+	}
+
+	// signed by the rust schnorrkel library used by substrate, in the
+	// substrate signing context. Vector from sr25519-crust test/ds.cpp.
+	public, _ = hex.DecodeString("46ebddef8cd9bb167dc30878d7113b7e168e6f0646beffd77d69d39bad76b47a")
+	sig, _ = hex.DecodeString("4e172314444b8f820bb54c22e95076f220ed25373e5c178234aa6c211d29271244b947e3ff3418ff6b45fd1df1140c8cbff69fc58ee6dc96df70936a2bb74b82")
+	if !Verify(Sr25519, public, []byte("this is a message"), sig) {
+		t.Error("expected sr25519 test vector to verify")
+	}
+
+	// sr25519 signatures are randomized, so sign with the key of the subkey
+	// vector of TestFromURI
+	alice, err := FromURI(Sr25519, devPhrase+"//Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err = alice.Sign([]byte(AuthChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Verify(Sr25519, alice.Public(), []byte(AuthChallenge), sig) {
+		t.Error("expected sr25519 signature to verify")
+	}
+	if Verify(Ed25519, alice.Public(), []byte(AuthChallenge), sig) {
+		t.Error("expected sr25519 signature not to verify as ed25519")
+	}
+	if Verify(Sr25519, alice.Public(), []byte("B"), sig) {
+		t.Error("expected sr25519 signature not to verify other message")
+	}
+	if Verify(Sr25519, alice.Public()[1:], []byte(AuthChallenge), sig) {
+		t.Error("expected short public key not to verify")
+	}
+	if Verify("rsa", alice.Public(), []byte(AuthChallenge), sig) {
+		t.Error("expected unknown key type not to verify")
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "twin.key")
+
+	key, err := FromURI(Sr25519, devPhrase+"//Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Save(path, key, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected key file mode 0600, got %s", info.Mode())
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsKeyFile(data) {
+		t.Error("expected key file to be recognized")
+	}
+
+	if err = Save(path, key, "secret"); err == nil {
+		t.Error("expected existing key file not to be overwritten")
+	}
+	if _, err = Load(path, "wrong"); err != ErrWrongPassphrase {
+		t.Errorf("expected wrong passphrase error, got %v", err)
+	}
+
+	loaded, err := Load(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Type() != Sr25519 || hex.EncodeToString(loaded.Public()) != hex.EncodeToString(key.Public()) {
+		t.Errorf("loaded key %s %x does not match", loaded.Type(), loaded.Public())
+	}
+}
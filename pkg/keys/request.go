@@ -0,0 +1,39 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Headers of a request signed by a twin
+const (
+	// HeaderTwin is the ID of the twin signing the request
+	HeaderTwin = "X-Twin-Id"
+	// HeaderTimestamp is the time the request was signed, in unix seconds
+	HeaderTimestamp = "X-Twin-Timestamp"
+	// HeaderNonce is unique to each request of the twin, so identical
+	// requests signed in the same second are told apart
+	HeaderNonce = "X-Twin-Nonce"
+	// HeaderSignature is the hex encoded signature of the RequestMessage
+	HeaderSignature = "X-Twin-Signature"
+)
+
+// requestPrefix separates signed requests from other signed messages
+const requestPrefix = "tfagent-request"
+
+// RequestMessage is the message signed by a twin to authenticate an http
+// request. It covers the method, the request URI with the query, the
+// timestamp, the nonce and the body.
+func RequestMessage(method string, uri string, timestamp int64, nonce string, body []byte) []byte {
+	hash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		requestPrefix,
+		strings.ToUpper(method),
+		uri,
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		hex.EncodeToString(hash[:]),
+	}, "\n"))
+}
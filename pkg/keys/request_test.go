@@ -0,0 +1,12 @@
+package keys
+
+import "testing"
+
+func TestRequestMessage(t *testing.T) {
+	// clients in other languages build the same message
+	expected := "tfagent-request\nPOST\n/twins/2/topics/chat?x=1\n1600000000\nn1\n" +
+		"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if msg := string(RequestMessage("post", "/twins/2/topics/chat?x=1", 1600000000, "n1", []byte("hello"))); msg != expected {
+		t.Errorf("unexpected request message %q", msg)
+	}
+}
@@ -0,0 +1,43 @@
+package keys
+
+import (
+	"crypto/ed25519"
+
+	schnorrkel "github.com/ChainSafe/go-schnorrkel"
+)
+
+// signingContext of sr25519 signatures made by substrate
+var signingContext = []byte("substrate")
+
+// Verify the signature of the message with a public key of the given type.
+// Sr25519 signatures are verified in the substrate signing context.
+func Verify(t Type, public []byte, msg []byte, sig []byte) bool {
+	switch t {
+	case Ed25519:
+		if len(public) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+			return false
+		}
+		return ed25519.Verify(ed25519.PublicKey(public), msg, sig)
+	case Sr25519:
+		var rawPub [schnorrkel.PublicKeySize]byte
+		var rawSig [schnorrkel.SignatureSize]byte
+		if len(public) != len(rawPub) || len(sig) != len(rawSig) {
+			return false
+		}
+		copy(rawPub[:], public)
+		copy(rawSig[:], sig)
+
+		pub, err := schnorrkel.NewPublicKey(rawPub)
+		if err != nil {
+			return false
+		}
+		var s schnorrkel.Signature
+		if err = s.Decode(rawSig); err != nil {
+			return false
+		}
+		ok, err := pub.Verify(&s, schnorrkel.NewSigningContext(signingContext, msg))
+		return err == nil && ok
+	default:
+		return false
+	}
+}
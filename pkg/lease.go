@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+var errLeaseTimeout = errors.New("lease timeout must be positive")
+
+// lease of a message. Leased messages are removed from the receive queue, and
+// put back at its head if they are not acknowledged before the timer fires.
+type lease struct {
+	// id of the lease, generated by the broker as message IDs are set by
+	// the sender and need not be unique
+	id    string
+	msg   Message
+	timer *time.Timer
+}
+
+// lease the message at the given index of the receive queue for the timeout,
+// and return the ID of the lease. The recvQLock must be held by the caller.
+func (bn *BufferedNode) lease(id int, timeout time.Duration) (string, Message) {
+	msg := bn.recvQ[id]
+	bn.recvQ = append(bn.recvQ[:id], bn.recvQ[id+1:]...)
+	msg.Deliveries++
+
+	l := &lease{id: uuid.New().String(), msg: msg}
+	// the timer can't fire before the lease is stored, as it needs the lock
+	l.timer = time.AfterFunc(timeout, func() {
+		bn.recvQLock.Lock()
+		defer bn.recvQLock.Unlock()
+
+		// the message can be acknowledged in the meantime
+		if bn.leases[l.id] == l {
+			bn.redeliver(l, "lease expired")
+		}
+	})
+	bn.leases[l.id] = l
+	bn.trace(msg, eventLeased, timeout.String())
+
+	return l.id, msg
+}
+
+// ack removes the leased message of the receiver for good, and returns false
+// if the receiver has no lease with the ID
+func (bn *BufferedNode) ack(receiver uint64, id string) bool {
+	bn.recvQLock.Lock()
+	defer bn.recvQLock.Unlock()
+
+	l, ok := bn.leases[id]
+	if !ok || l.msg.Receiver != receiver {
+		return false
+	}
+	l.timer.Stop()
+	delete(bn.leases, id)
+	bn.trace(l.msg, eventAcked, "")
+
+	return true
+}
+
+// nack puts the leased message of the receiver back in its mailbox right
+// away, and returns false if the receiver has no lease with the ID
+func (bn *BufferedNode) nack(receiver uint64, id string) bool {
+	bn.recvQLock.Lock()
+	defer bn.recvQLock.Unlock()
+
+	l, ok := bn.leases[id]
+	if !ok || l.msg.Receiver != receiver {
+		return false
+	}
+	l.timer.Stop()
+	bn.redeliver(l, "negative acknowledgement")
+
+	return true
+}
+
+// redeliver puts the leased message back at the head of the receive queue, as
+// it is older than the messages which arrived during the lease. The
+// recvQLock must be held by the caller.
+func (bn *BufferedNode) redeliver(l *lease, reason string) {
+	delete(bn.leases, l.id)
+	bn.recvQ = append([]Message{l.msg}, bn.recvQ...)
+	close(bn.recvNotify)
+	bn.recvNotify = make(chan struct{})
+
+	bn.trace(l.msg, eventRedelivered, reason)
+	bn.metrics.redelivered()
+}
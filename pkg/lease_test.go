@@ -0,0 +1,195 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// leased fills the mailbox of twin 1 with messages which have an ID
+func leased(h *harness) {
+	first, second := msg(2, 1, "jobs", "one"), msg(2, 1, "jobs", "two")
+	first.ID, second.ID = "first", "second"
+	h.deliver(first, second)
+}
+
+func TestLeaseAck(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	client := h.client(1)
+	ctx := context.Background()
+	leased(h)
+
+	reply, err := client.Do(ctx, "LEASE", "2:jobs", 10).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 5 || !reflect.DeepEqual(reply[:4], []interface{}{"2:jobs", "one", "first", int64(1)}) {
+		t.Fatalf("unexpected LEASE reply %v", reply)
+	}
+	lease := reply[4].(string)
+
+	// leased messages are not in the mailbox
+	if n, err := client.LLen(ctx, "2:jobs").Result(); err != nil || n != 1 {
+		t.Errorf("expected 1 message in the mailbox, got %d %v", n, err)
+	}
+	if queues := h.node.Queues(); !reflect.DeepEqual(queues, []QueueInfo{{Twin: 1, Received: 1, Leased: 1}}) {
+		t.Errorf("unexpected queues %+v", queues)
+	}
+
+	// only the receiver can acknowledge its messages, by the ID of the lease
+	if n, err := h.client(2).Do(ctx, "ACK", lease).Int(); err != nil || n != 0 {
+		t.Errorf("expected other twin not to acknowledge the message, got %d %v", n, err)
+	}
+	if n, err := client.Do(ctx, "ACK", lease, "first", "unknown").Int(); err != nil || n != 1 {
+		t.Errorf("expected 1 message to be acknowledged, got %d %v", n, err)
+	}
+	if n, err := client.Do(ctx, "ACK", lease).Int(); err != nil || n != 0 {
+		t.Errorf("expected message to be acknowledged once, got %d %v", n, err)
+	}
+	if queues := h.node.Queues(); !reflect.DeepEqual(queues, []QueueInfo{{Twin: 1, Received: 1}}) {
+		t.Errorf("unexpected queues %+v", queues)
+	}
+}
+
+func TestLeaseExpires(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.client(1)
+	ctx := context.Background()
+	leased(h)
+
+	first, err := client.Do(ctx, "LEASE", "2:jobs", 0.1).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the message reappears at the head of the mailbox
+	h.eventually(func() bool {
+		n, err := client.LLen(ctx, "2:jobs").Result()
+		return err == nil && n == 2
+	}, "leased message was not redelivered")
+
+	reply, err := client.Do(ctx, "LEASE", "2:jobs", 10).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply[:4], []interface{}{"2:jobs", "one", "first", int64(2)}) {
+		t.Errorf("expected message to be redelivered, got %v", reply)
+	}
+
+	// acknowledging an expired lease fails, even if the message is leased
+	// again
+	if n, err := client.Do(ctx, "ACK", first[4]).Int(); err != nil || n != 0 {
+		t.Errorf("expected expired lease not to be acknowledged, got %d %v", n, err)
+	}
+}
+
+func TestNack(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.client(1)
+	ctx := context.Background()
+	leased(h)
+
+	reply, err := client.Do(ctx, "LEASE", "2:jobs", 10).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Do(ctx, "NACK", reply[4]).Int(); err != nil || n != 1 {
+		t.Errorf("expected message to be redelivered, got %d %v", n, err)
+	}
+
+	reply, err = client.Do(ctx, "LPOP", "2:jobs").Slice()
+	if err != nil || !reflect.DeepEqual(reply, []interface{}{"2:jobs", "one"}) {
+		t.Errorf("expected redelivered message at the head of the mailbox, got %v %v", reply, err)
+	}
+
+	var events []string
+	for _, event := range h.node.Trace("first") {
+		events = append(events, event.Event)
+	}
+	if !reflect.DeepEqual(events[len(events)-3:], []string{eventLeased, eventRedelivered, eventPopped}) {
+		t.Errorf("unexpected trace events %v", events)
+	}
+}
+
+func TestLeaseRESP3(t *testing.T) {
+	h := newHarness(t, 1)
+	c := h.respConn()
+	c.do("HELLO", 3, "AUTH", 1, h.store.sig(1))
+	leased(h)
+
+	reply, ok := c.do("LEASE", "2:jobs", 10).(map[string]interface{})
+	if !ok || reply["id"] != "first" || reply["deliveries"] != int64(1) || reply["lease"] == "" {
+		t.Errorf("unexpected LEASE reply %v", reply)
+	}
+
+	for _, tc := range []struct {
+		timeout interface{}
+		err     error
+	}{
+		{0, errLeaseTimeout},
+		{-1, errNegativeArg},
+		{"soon", errInvalidTimeout},
+	} {
+		if err, ok := c.do("LEASE", "2:jobs", tc.timeout).(respError); !ok || string(err) != tc.err.Error() {
+			t.Errorf("expected LEASE with timeout %v to fail with %v, got %v", tc.timeout, tc.err, err)
+		}
+	}
+	if reply := c.do("LEASE", "3:jobs", 10); reply != nil {
+		t.Errorf("expected no message, got %v", reply)
+	}
+}
+
+func TestLeaseSameID(t *testing.T) {
+	h := newHarness(t, 1, 2, 3)
+	client := h.client(1)
+	ctx := context.Background()
+
+	// message IDs are set by the senders, so they can collide
+	first, second := msg(2, 1, "jobs", "one"), msg(3, 1, "jobs", "two")
+	first.ID, second.ID = "same", "same"
+	h.deliver(first, second)
+
+	var leases []interface{}
+	for _, key := range []string{"2:jobs", "3:jobs"} {
+		reply, err := client.Do(ctx, "LEASE", key, 0.1).Slice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		leases = append(leases, reply[4])
+	}
+	if leases[0] == leases[1] {
+		t.Fatalf("expected distinct leases, got %v", leases)
+	}
+
+	// only the first message is acknowledged, the second is redelivered
+	if n, err := client.Do(ctx, "ACK", leases[0]).Int(); err != nil || n != 1 {
+		t.Fatalf("expected 1 message to be acknowledged, got %d %v", n, err)
+	}
+	h.eventually(func() bool {
+		n, err := client.LLen(ctx, "0:jobs").Result()
+		return err == nil && n == 1
+	}, "leased message was not redelivered")
+
+	reply, err := client.Do(ctx, "LPOP", "0:jobs").Slice()
+	if err != nil || !reflect.DeepEqual(reply, []interface{}{"3:jobs", "two"}) {
+		t.Errorf("expected second message to be redelivered, got %v %v", reply, err)
+	}
+}
+
+func TestPurgeLeased(t *testing.T) {
+	h := newHarness(t, 1)
+	leased(h)
+
+	h.node.recvQLock.Lock()
+	h.node.lease(0, 50*time.Millisecond)
+	h.node.recvQLock.Unlock()
+
+	if n := h.node.PurgeMailbox(1); n != 2 {
+		t.Errorf("expected 2 messages to be purged, got %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if mailbox := h.node.Mailbox(1); len(mailbox) != 0 {
+		t.Errorf("expected purged lease not to be redelivered, got %v", mailbox)
+	}
+}
@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errMaxClients      = errors.New("max number of clients reached")
+	errMaxClientsPerIP = errors.New("max number of clients from this address reached")
+)
+
+// Limits protect the server against clients holding on to resources. A zero
+// value disables a limit.
+type Limits struct {
+	// MaxConnections is the number of connections served on all listeners
+	MaxConnections int
+	// MaxConnectionsPerIP is the number of tcp connections served per remote
+	// IP address. Unix socket connections are not limited per address.
+	MaxConnectionsPerIP int
+	// AuthTimeout is the time a connection has to authenticate, including the
+	// TLS handshake
+	AuthTimeout time.Duration
+	// IdleTimeout closes authenticated connections which don't send a command
+	// for this long. Subscribed connections are not idle.
+	IdleTimeout time.Duration
+	// WriteTimeout is the time a client has to read a reply or push message
+	WriteTimeout time.Duration
+}
+
+// DefaultLimits of the server
+func DefaultLimits() Limits {
+	return Limits{
+		MaxConnections: 10000,
+		AuthTimeout:    10 * time.Second,
+		WriteTimeout:   30 * time.Second,
+	}
+}
+
+// ConnectionStats counts the connections of the server, and the connections
+// which were rejected or closed because of the limits
+type ConnectionStats struct {
+	Accepted           uint64 `json:"accepted"`
+	RejectedMaxClients uint64 `json:"rejected_max_clients"`
+	RejectedMaxPerIP   uint64 `json:"rejected_max_per_ip"`
+	AuthTimeouts       uint64 `json:"auth_timeouts"`
+	IdleTimeouts       uint64 `json:"idle_timeouts"`
+	WriteTimeouts      uint64 `json:"write_timeouts"`
+}
+
+// connStats is updated concurrently by the connections of the server
+type connStats struct {
+	accepted           uint64
+	rejectedMaxClients uint64
+	rejectedMaxPerIP   uint64
+	authTimeouts       uint64
+	idleTimeouts       uint64
+	writeTimeouts      uint64
+}
+
+func (cs *connStats) rejected(err error) {
+	if err == errMaxClientsPerIP {
+		atomic.AddUint64(&cs.rejectedMaxPerIP, 1)
+		return
+	}
+	atomic.AddUint64(&cs.rejectedMaxClients, 1)
+}
+
+func (cs *connStats) snapshot() ConnectionStats {
+	return ConnectionStats{
+		Accepted:           atomic.LoadUint64(&cs.accepted),
+		RejectedMaxClients: atomic.LoadUint64(&cs.rejectedMaxClients),
+		RejectedMaxPerIP:   atomic.LoadUint64(&cs.rejectedMaxPerIP),
+		AuthTimeouts:       atomic.LoadUint64(&cs.authTimeouts),
+		IdleTimeouts:       atomic.LoadUint64(&cs.idleTimeouts),
+		WriteTimeouts:      atomic.LoadUint64(&cs.writeTimeouts),
+	}
+}
+
+// remoteIP of a tcp connection, empty for other connections
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// isTimeout returns true if the error is caused by a deadline of the
+// connection
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
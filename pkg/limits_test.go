@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// limitsHarness starts a broker with the given limits
+func limitsHarness(t *testing.T, limits Limits, dtids ...uint64) *harness {
+	setup := func(s *Server) error {
+		s.SetLimits(limits)
+		return nil
+	}
+	return newBrokerWith(t, NewMemoryNetwork(), newTestStore(t, dtids...), setup, dtids...)
+}
+
+// closedByServer waits for the server to close the connection
+func closedByServer(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Errorf("expected connection to be closed by the server, got %v", err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	h := limitsHarness(t, Limits{MaxConnections: 2}, 1)
+	ctx := context.Background()
+
+	first, second := h.respConn(), h.respConn()
+	first.do("PING")
+	second.do("PING")
+
+	err := h.client(1).Ping(ctx).Err()
+	if err == nil || err.Error() != errMaxClients.Error() {
+		t.Errorf("expected max clients error, got %v", err)
+	}
+	if stats := h.server.ConnectionStats(); stats.Accepted != 2 || stats.RejectedMaxClients == 0 {
+		t.Errorf("unexpected connection stats %+v", stats)
+	}
+
+	// a connection is available again once a client disconnects
+	first.conn.Close()
+	h.eventually(func() bool {
+		return h.client(1).Ping(ctx).Err() == nil
+	}, "connection was not accepted after a client disconnected")
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	socket := filepath.Join(tempDir(t), "resp.sock")
+	setup := func(s *Server) error {
+		s.SetLimits(Limits{MaxConnectionsPerIP: 1})
+		return s.Listen(ListenerConfig{Address: unixSocketPrefix + socket})
+	}
+	h := newBrokerWith(t, NewMemoryNetwork(), newTestStore(t, 1), setup, 1)
+	ctx := context.Background()
+
+	h.respConn().do("PING")
+	err := h.anonClient().Ping(ctx).Err()
+	if err == nil || err.Error() != errMaxClientsPerIP.Error() {
+		t.Errorf("expected max clients per ip error, got %v", err)
+	}
+	if stats := h.server.ConnectionStats(); stats.RejectedMaxPerIP == 0 || stats.RejectedMaxClients != 0 {
+		t.Errorf("unexpected connection stats %+v", stats)
+	}
+
+	// unix socket clients are not limited per address
+	for i := 0; i < 2; i++ {
+		if err := h.unixClient(socket).Ping(ctx).Err(); err != nil {
+			t.Errorf("expected unix client to connect, got %v", err)
+		}
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	h := limitsHarness(t, Limits{AuthTimeout: 200 * time.Millisecond}, 1)
+
+	// clients which don't authenticate, or trickle a command, are closed
+	idle := h.respConn()
+	trickle := h.respConn()
+	trickle.conn.Write([]byte("*3\r\n$4\r\nAUTH\r\n"))
+	authenticated := h.respConn()
+	if reply := authenticated.do("AUTH", 1, h.store.sig(1)); reply != "Authenticated" {
+		t.Fatalf("expected to authenticate, got %v", reply)
+	}
+
+	start := time.Now()
+	closedByServer(t, idle.conn)
+	closedByServer(t, trickle.conn)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected connections to be closed after the auth timeout, took %s", elapsed)
+	}
+
+	if reply := authenticated.do("PING"); reply != "PONG" {
+		t.Errorf("expected authenticated connection to stay open, got %v", reply)
+	}
+	if stats := h.server.ConnectionStats(); stats.AuthTimeouts != 2 {
+		t.Errorf("expected 2 auth timeouts, got %+v", stats)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	h := limitsHarness(t, Limits{IdleTimeout: 200 * time.Millisecond}, 1)
+
+	idle := h.respConn()
+	idle.do("AUTH", 1, h.store.sig(1))
+	subscribed := h.respConn()
+	subscribed.do("HELLO", 3, "AUTH", 1, h.store.sig(1))
+	subscribed.do("SUBSCRIBE", "0:chat")
+
+	closedByServer(t, idle.conn)
+	if stats := h.server.ConnectionStats(); stats.IdleTimeouts != 1 {
+		t.Errorf("expected 1 idle timeout, got %+v", stats)
+	}
+
+	// subscribed connections wait for messages
+	h.deliver(msg(2, 1, "chat", "hello"))
+	if reply := subscribed.read(); !reflect.DeepEqual(reply, push{"message", "2:chat", "hello", ""}) {
+		t.Errorf("expected message to be pushed, got %v", reply)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	h := limitsHarness(t, Limits{WriteTimeout: 200 * time.Millisecond}, 1)
+
+	// more than fits in the socket buffers
+	payload := strings.Repeat("x", 1<<20)
+	for i := 0; i < 32; i++ {
+		h.deliver(msg(2, 1, "chat", payload))
+	}
+
+	c := h.respConn()
+	c.do("AUTH", 1, h.store.sig(1))
+	// the reply is never read
+	c.send("LRANGE", "0:", 0, -1)
+
+	h.eventually(func() bool {
+		return h.server.ConnectionStats().WriteTimeouts == 1 && len(h.server.Clients()) == 0
+	}, "slow client was not disconnected")
+}
@@ -0,0 +1,354 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// mailbox fills the mailbox of twin 1 with messages from twins 2 and 3 on
+// different topics
+func mailbox(h *harness) {
+	h.deliver(
+		msg(2, 1, "a", "one"),
+		msg(3, 1, "a", "two"),
+		msg(2, 1, "b", "three"),
+		msg(2, 4, "a", "other"),
+		msg(2, 1, "a", "four"),
+		msg(3, 1, "b", "one"),
+	)
+}
+
+func payloads(t *testing.T, reply []interface{}) []string {
+	if len(reply)%2 != 0 {
+		t.Fatalf("reply has odd length %d", len(reply))
+	}
+	out := []string{}
+	for i := 1; i < len(reply); i += 2 {
+		out = append(out, reply[i].(string))
+	}
+	return out
+}
+
+func TestLRange(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.client(1)
+	ctx := context.Background()
+	mailbox(h)
+
+	cases := []struct {
+		key        string
+		start, end int
+		expected   []string
+	}{
+		{"0:", 0, -1, []string{"one", "two", "three", "four", "one"}},
+		{"0:", 0, 0, []string{"one"}},
+		{"0:", -2, -1, []string{"four", "one"}},
+		{"0:", -100, 1, []string{"one", "two"}},
+		{"0:", 3, 100, []string{"four", "one"}},
+		{"0:", 3, 1, []string{}},
+		{"0:", 5, 10, []string{}},
+		{"0:a", 0, -1, []string{"one", "two", "four"}},
+		{"2:", 0, -1, []string{"one", "three", "four"}},
+		{"2:a", -1, -1, []string{"four"}},
+		{"5:", 0, -1, []string{}},
+	}
+
+	for _, tc := range cases {
+		reply, err := client.Do(ctx, "LRANGE", tc.key, tc.start, tc.end).Slice()
+		if err != nil {
+			t.Fatalf("LRANGE %s %d %d: %s", tc.key, tc.start, tc.end, err)
+		}
+		if got := payloads(t, reply); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("LRANGE %s %d %d: expected %v, got %v", tc.key, tc.start, tc.end, tc.expected, got)
+		}
+	}
+
+	reply, err := client.Do(ctx, "LRANGE", "0:b", 0, -1).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, []interface{}{"2:b", "three", "3:b", "one"}) {
+		t.Errorf("unexpected LRANGE reply %v", reply)
+	}
+}
+
+func TestLRangeMsg(t *testing.T) {
+	h := newHarness(t, 1)
+	ctx := context.Background()
+	first, second := msg(2, 1, "a", "one"), msg(3, 1, "a", "two")
+	first.ID, second.ID = "first", "second"
+	h.deliver(first, second)
+
+	reply, err := h.client(1).Do(ctx, "LRANGEMSG", "0:a", 0, -1).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		[]interface{}{"2:a", "one", "first"},
+		[]interface{}{"3:a", "two", "second"},
+	}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("unexpected LRANGEMSG reply %v", reply)
+	}
+
+	// messages are maps in RESP3
+	c := h.respConn()
+	c.do("HELLO", 3, "AUTH", 1, h.store.sig(1))
+	messages, ok := c.do("LRANGEMSG", "3:", 0, -1).([]interface{})
+	if !ok || len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %v", messages)
+	}
+	if m, ok := messages[0].(map[string]interface{}); !ok || m["id"] != "second" || m["payload"] != "two" {
+		t.Errorf("unexpected message %v", messages[0])
+	}
+}
+
+func TestLPopRPop(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.client(1)
+	ctx := context.Background()
+	mailbox(h)
+
+	reply, err := client.Do(ctx, "LPOP", "0:a").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, []interface{}{"2:a", "one"}) {
+		t.Errorf("unexpected LPOP reply %v", reply)
+	}
+
+	reply, err = client.Do(ctx, "RPOP", "0:").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, []interface{}{"3:b", "one"}) {
+		t.Errorf("unexpected RPOP reply %v", reply)
+	}
+
+	reply, err = client.Do(ctx, "RPOP", "3:").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, []interface{}{"3:a", "two"}) {
+		t.Errorf("unexpected RPOP reply %v", reply)
+	}
+
+	if _, err = client.Do(ctx, "LPOP", "3:").Slice(); err != redis.Nil {
+		t.Errorf("expected nil reply for empty mailbox, got %v", err)
+	}
+
+	if n := client.LLen(ctx, "0:").Val(); n != 2 {
+		t.Errorf("expected 2 messages left, got %d", n)
+	}
+
+	// messages for other twins are untouched
+	if len(h.node.recvQ) != 3 {
+		t.Errorf("expected 3 messages in the receive queue, got %d", len(h.node.recvQ))
+	}
+}
+
+func TestLIndex(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.client(1)
+	ctx := context.Background()
+	mailbox(h)
+
+	cases := []struct {
+		key      string
+		index    int
+		expected []interface{}
+	}{
+		{"0:", 0, []interface{}{"2:a", "one"}},
+		{"0:", -1, []interface{}{"3:b", "one"}},
+		{"0:a", 2, []interface{}{"2:a", "four"}},
+		{"0:a", -3, []interface{}{"2:a", "one"}},
+		{"0:a", 3, nil},
+		{"0:a", -4, nil},
+	}
+
+	for _, tc := range cases {
+		reply, err := client.Do(ctx, "LINDEX", tc.key, tc.index).Slice()
+		if tc.expected == nil {
+			if err != redis.Nil {
+				t.Errorf("LINDEX %s %d: expected nil reply, got %v (%v)", tc.key, tc.index, reply, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("LINDEX %s %d: %s", tc.key, tc.index, err)
+		}
+		if !reflect.DeepEqual(reply, tc.expected) {
+			t.Errorf("LINDEX %s %d: expected %v, got %v", tc.key, tc.index, tc.expected, reply)
+		}
+	}
+}
+
+func TestLRem(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.client(1)
+	ctx := context.Background()
+
+	h.deliver(
+		msg(2, 1, "a", "x"),
+		msg(2, 1, "a", "y"),
+		msg(2, 1, "a", "x"),
+		msg(3, 1, "a", "x"),
+		msg(2, 1, "a", "x"),
+		msg(2, 1, "b", "x"),
+	)
+
+	if n := client.LRem(ctx, "2:a", -1, "x").Val(); n != 1 {
+		t.Errorf("expected 1 removed message, got %d", n)
+	}
+	if n := client.LRem(ctx, "0:a", 2, "x").Val(); n != 2 {
+		t.Errorf("expected 2 removed messages, got %d", n)
+	}
+
+	reply, err := client.Do(ctx, "LRANGE", "0:", 0, -1).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, []interface{}{"2:a", "y", "3:a", "x", "2:b", "x"}) {
+		t.Errorf("unexpected mailbox after LREM %v", reply)
+	}
+
+	if n := client.LRem(ctx, "0:", 0, "x").Val(); n != 2 {
+		t.Errorf("expected 2 removed messages, got %d", n)
+	}
+	if n := client.LRem(ctx, "0:", 0, "z").Val(); n != 0 {
+		t.Errorf("expected no removed messages, got %d", n)
+	}
+	if n := client.LLen(ctx, "0:").Val(); n != 1 {
+		t.Errorf("expected 1 message left, got %d", n)
+	}
+}
+
+func TestLTrim(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.client(1)
+	ctx := context.Background()
+	mailbox(h)
+
+	if err := client.LTrim(ctx, "0:a", 1, -1).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := client.Do(ctx, "LRANGE", "0:", 0, -1).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(t, reply); !reflect.DeepEqual(got, []string{"two", "three", "four", "one"}) {
+		t.Errorf("unexpected mailbox after LTRIM %v", got)
+	}
+
+	// an empty range clears the filtered list
+	if err := client.LTrim(ctx, "0:b", 1, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.LLen(ctx, "0:").Val(); n != 2 {
+		t.Errorf("expected 2 messages left, got %d", n)
+	}
+}
+
+func TestLPos(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.client(1)
+	ctx := context.Background()
+
+	h.deliver(
+		msg(2, 1, "a", "x"),
+		msg(2, 1, "a", "y"),
+		msg(2, 1, "a", "x"),
+		msg(2, 1, "b", "x"),
+		msg(2, 1, "a", "z"),
+		msg(2, 1, "a", "x"),
+	)
+
+	intCases := []struct {
+		key      string
+		element  string
+		args     redis.LPosArgs
+		expected int64
+	}{
+		{"0:", "x", redis.LPosArgs{}, 0},
+		{"0:", "y", redis.LPosArgs{}, 1},
+		{"0:", "x", redis.LPosArgs{Rank: 3}, 3},
+		{"0:", "x", redis.LPosArgs{Rank: -1}, 5},
+		{"0:", "x", redis.LPosArgs{Rank: -2}, 3},
+		{"0:a", "x", redis.LPosArgs{Rank: 3}, 4},
+		{"0:a", "z", redis.LPosArgs{}, 3},
+	}
+	for _, tc := range intCases {
+		pos, err := client.LPos(ctx, tc.key, tc.element, tc.args).Result()
+		if err != nil {
+			t.Fatalf("LPOS %s %s %+v: %s", tc.key, tc.element, tc.args, err)
+		}
+		if pos != tc.expected {
+			t.Errorf("LPOS %s %s %+v: expected %d, got %d", tc.key, tc.element, tc.args, tc.expected, pos)
+		}
+	}
+
+	if _, err := client.LPos(ctx, "0:", "q", redis.LPosArgs{}).Result(); err != redis.Nil {
+		t.Errorf("expected nil reply for missing element, got %v", err)
+	}
+	if _, err := client.LPos(ctx, "0:", "z", redis.LPosArgs{MaxLen: 4}).Result(); err != redis.Nil {
+		t.Errorf("expected nil reply outside of MAXLEN, got %v", err)
+	}
+	if err := client.LPos(ctx, "0:", "x", redis.LPosArgs{Rank: 0}).Err(); err != nil {
+		t.Errorf("no RANK argument should be sent for rank 0, got %v", err)
+	}
+	if err := client.Do(ctx, "LPOS", "0:", "x", "RANK", 0).Err(); err == nil {
+		t.Error("expected an error for RANK 0")
+	}
+
+	sliceCases := []struct {
+		count    int64
+		args     redis.LPosArgs
+		expected []int64
+	}{
+		{0, redis.LPosArgs{}, []int64{0, 2, 3, 5}},
+		{2, redis.LPosArgs{}, []int64{0, 2}},
+		{2, redis.LPosArgs{Rank: -1}, []int64{5, 3}},
+		{0, redis.LPosArgs{Rank: 2, MaxLen: 4}, []int64{2, 3}},
+	}
+	for _, tc := range sliceCases {
+		pos, err := client.LPosCount(ctx, "0:", "x", tc.count, tc.args).Result()
+		if err != nil {
+			t.Fatalf("LPOS COUNT %d %+v: %s", tc.count, tc.args, err)
+		}
+		if !reflect.DeepEqual(pos, tc.expected) {
+			t.Errorf("LPOS COUNT %d %+v: expected %v, got %v", tc.count, tc.args, tc.expected, pos)
+		}
+	}
+
+	pos, err := client.LPosCount(ctx, "0:", "q", 0, redis.LPosArgs{}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pos) != 0 {
+		t.Errorf("expected empty reply, got %v", pos)
+	}
+}
+
+func TestListRequiresAuth(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.anonClient()
+	ctx := context.Background()
+
+	for _, args := range [][]interface{}{
+		{"RPUSH", "2:a", "x"},
+		{"RPOP", "0:"},
+		{"LINDEX", "0:", 0},
+		{"LREM", "0:", 0, "x"},
+		{"LTRIM", "0:", 0, -1},
+		{"LPOS", "0:", "x"},
+	} {
+		err := client.Do(ctx, args...).Err()
+		if err == nil || err.Error() != errNotAuthenticated.Error() {
+			t.Errorf("%v: expected not authenticated error, got %v", args, err)
+		}
+	}
+}
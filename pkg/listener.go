@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultSocketMode of unix sockets, only accessible to the owner
+const defaultSocketMode = 0600
+
+var errTrustedTCP = errors.New("only unix socket listeners can authenticate connections as a twin")
+
+// ListenerConfig configures a listener of the server, and the policy of the
+// connections it accepts
+type ListenerConfig struct {
+	// Address to listen on. This is either a tcp address, e.g. :8889, the
+	// path of a unix socket prefixed with unix://, e.g.
+	// unix:///run/tfagent/resp.sock, or a WebSocket endpoint, e.g.
+	// ws://:8890/resp
+	Address string
+	// SocketMode is the file mode of a unix socket, defaults to 0600. The
+	// owner and group of the socket are those of the agent process.
+	SocketMode os.FileMode
+	// TLS served on the listener, if set
+	TLS *TLSConfig
+	// Twin connections are authenticated as without AUTH, if not 0. Only
+	// allowed on unix sockets, where access is controlled by the socket
+	// permissions.
+	Twin uint64
+	// AllowedOrigins of browsers connecting to a WebSocket endpoint, e.g.
+	// https://dashboard.grid.tf. Defaults to the origin of the endpoint, "*"
+	// allows all origins.
+	AllowedOrigins []string
+}
+
+// listener of the server, with the config of its connections
+type listener struct {
+	net.Listener
+	cfg ListenerConfig
+}
+
+// newListener binds the address of the config. TLS certificates are shared
+// with the other listeners through the cache.
+func newListener(ctx context.Context, cfg ListenerConfig, certs *tlsCache, log Log) (*listener, error) {
+	var ln net.Listener
+	var err error
+	var wsPath string
+	if path := strings.TrimPrefix(cfg.Address, unixSocketPrefix); path != cfg.Address {
+		mode := cfg.SocketMode
+		if mode == 0 {
+			mode = defaultSocketMode
+		}
+		ln, err = listenUnix(ctx, path, mode)
+	} else if cfg.Twin != 0 {
+		return nil, errTrustedTCP
+	} else if strings.HasPrefix(cfg.Address, webSocketPrefix) {
+		var u *url.URL
+		if u, err = url.Parse(cfg.Address); err != nil {
+			return nil, errors.Wrap(err, "invalid WebSocket address")
+		}
+		if wsPath = u.Path; wsPath == "" {
+			wsPath = "/"
+		}
+		ln, err = (&net.ListenConfig{}).Listen(ctx, "tcp", u.Host)
+		err = errors.Wrap(err, "failed to create WebSocket listener")
+	} else {
+		ln, err = (&net.ListenConfig{}).Listen(ctx, "tcp", cfg.Address)
+		err = errors.Wrap(err, "failed to create tcp listener")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener{Listener: ln, cfg: cfg}
+	if cfg.TLS != nil {
+		if err = l.enableTLS(*cfg.TLS, certs, log); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	// TLS is served by the http server of the WebSocket endpoint
+	if wsPath != "" {
+		l.Listener = newWSListener(l.Listener, wsPath, cfg.AllowedOrigins, log)
+	}
+
+	return l, nil
+}
+
+// enableTLS wraps the listener to serve TLS
+func (l *listener) enableTLS(cfg TLSConfig, cache *tlsCache, log Log) error {
+	certs, err := cache.certs(cfg, log)
+	if err != nil {
+		return err
+	}
+
+	l.Listener = tls.NewListener(l.Listener, certs.config())
+	l.cfg.TLS = &cfg
+	log.WithField("addr", l.cfg.Address).WithField("fingerprint", certs.fingerprint()).WithField("client_auth", cfg.ClientCAFile != "").Info("TLS enabled")
+
+	return nil
+}
+
+// remoteAddr of the connection. Clients of unix sockets are usually unnamed,
+// so they are described by the socket path instead.
+func remoteAddr(conn net.Conn) string {
+	if addr, ok := conn.LocalAddr().(*net.UnixAddr); ok {
+		return unixSocketPrefix + addr.Name
+	}
+	return conn.RemoteAddr().String()
+}
+
+// listenUnix listens on a unix socket with the given mode, removing a stale
+// socket of a previous run. Other files at the path are left alone.
+func listenUnix(ctx context.Context, path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "could not remove existing socket")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "could not check existing socket")
+	}
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create unix listener")
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, errors.Wrap(err, "could not set socket permissions")
+	}
+	return ln, nil
+}
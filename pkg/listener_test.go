@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// unixClient connects to the unix socket without authenticating
+func (h *harness) unixClient(path string) *redis.Client {
+	client := redis.NewClient(&redis.Options{Network: "unix", Addr: path})
+	h.t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func TestUnixListener(t *testing.T) {
+	dir := tempDir(t)
+	trusted := filepath.Join(dir, "trusted.sock")
+	untrusted := filepath.Join(dir, "untrusted.sock")
+
+	setup := func(s *Server) error {
+		if err := s.Listen(ListenerConfig{Address: unixSocketPrefix + trusted, SocketMode: 0660, Twin: 1}); err != nil {
+			return err
+		}
+		return s.Listen(ListenerConfig{Address: unixSocketPrefix + untrusted})
+	}
+	h := newBrokerWith(t, NewMemoryNetwork(), newTestStore(t, 1, 2), setup, 1, 2)
+	ctx := context.Background()
+
+	if addrs := h.server.Addrs(); len(addrs) != 3 || addrs[1].String() != trusted {
+		t.Errorf("unexpected listener addresses %v", addrs)
+	}
+	for path, mode := range map[string]os.FileMode{trusted: 0660, untrusted: defaultSocketMode} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("expected %s to have mode %s, got %s", path, mode, info.Mode().Perm())
+		}
+	}
+
+	// the trusted socket is authenticated as twin 1 without AUTH
+	c := h.unixClient(trusted)
+	if err := c.Do(ctx, "LPUSH", "2:chat", "hello").Err(); err != nil {
+		t.Fatal(err)
+	}
+	h.eventually(func() bool {
+		n, err := h.client(2).LLen(ctx, "1:chat").Result()
+		return err == nil && n == 1
+	}, "message from the trusted socket was not delivered")
+
+	err := c.Do(ctx, "AUTH", 2, h.store.sig(2)).Err()
+	if err == nil || err.Error() != errAlreadyAuthenticated.Error() {
+		t.Errorf("expected already authenticated error, got %v", err)
+	}
+
+	var found bool
+	for _, info := range h.server.Clients() {
+		if info.Listener == unixSocketPrefix+trusted {
+			found = true
+			if info.Twin != 1 || info.RemoteAddr != unixSocketPrefix+trusted {
+				t.Errorf("unexpected client info %+v", info)
+			}
+		}
+	}
+	if !found {
+		t.Error("client of the trusted socket is not listed")
+	}
+
+	// other sockets still require AUTH
+	err = h.unixClient(untrusted).LLen(ctx, "2:").Err()
+	if err == nil || err.Error() != errNotAuthenticated.Error() {
+		t.Errorf("expected unauthenticated error, got %v", err)
+	}
+}
+
+func TestTrustedTCPListener(t *testing.T) {
+	_, err := newListener(context.Background(), ListenerConfig{Address: "127.0.0.1:0", Twin: 1}, &tlsCache{}, &NOOPLogger{})
+	if err != errTrustedTCP {
+		t.Errorf("expected trusted tcp listener to be rejected, got %v", err)
+	}
+}
+
+func TestUnixListenerExisting(t *testing.T) {
+	dir := tempDir(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a stale socket of a previous run is replaced
+	stale := filepath.Join(dir, "stale.sock")
+	ln, err := listenUnix(ctx, stale, defaultSocketMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if ln, err = listenUnix(ctx, stale, defaultSocketMode); err != nil {
+		t.Fatalf("expected stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+
+	// other files are left alone
+	file := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = listenUnix(ctx, file, defaultSocketMode); err == nil {
+		t.Error("expected listening on a regular file to fail")
+	}
+	if data, err := ioutil.ReadFile(file); err != nil || string(data) != "data" {
+		t.Errorf("expected file to be kept, got %q %v", data, err)
+	}
+}
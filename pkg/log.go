@@ -1,5 +1,16 @@
 package pkg
 
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// Log is the logger used by all components
 type Log interface {
 	Debug(v ...interface{})
 	Debugf(format string, v ...interface{})
@@ -9,15 +20,181 @@ type Log interface {
 	Warnf(format string, v ...interface{})
 	Error(v ...interface{})
 	Errorf(format string, v ...interface{})
+	// WithField returns a logger which adds the field to every message
+	WithField(key string, value interface{}) Log
+}
+
+// LevelLog is a Log of which the level can be changed at runtime
+type LevelLog interface {
+	Log
+	// Level of the logger, messages below this level are discarded
+	Level() Level
+	// SetLevel of the logger, and all loggers derived from it with WithField
+	SetLevel(level Level)
+}
+
+// debugEnabled reports whether the logger writes debug messages, so callers
+// can skip building fields for them. Loggers without a level are assumed to
+// write them.
+func debugEnabled(log Log) bool {
+	switch l := log.(type) {
+	case *NOOPLogger:
+		return false
+	case LevelLog:
+		return l.Level() <= DebugLevel
+	default:
+		return true
+	}
 }
 
+// LogSetter is implemented by components which accept a logger. The agent
+// passes its logger to the peer store and transport if they implement this,
+// before they are started.
+type LogSetter interface {
+	SetLogger(log Log)
+}
+
+// Level of a log message
+type Level int32
+
+const (
+	// DebugLevel is the most verbose level
+	DebugLevel Level = iota
+	// InfoLevel for regular operation
+	InfoLevel
+	// WarnLevel for unexpected events which are handled
+	WarnLevel
+	// ErrorLevel for failures
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level, as returned by Level.String
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level %q", name)
+}
+
+// NOOPLogger discards all messages
 type NOOPLogger struct{}
 
-func (n *NOOPLogger) Debug(v ...interface{})                 {}
-func (n *NOOPLogger) Debugf(v ...interface{})                {}
-func (n *NOOPLogger) Info(v ...interface{})                  {}
-func (n *NOOPLogger) Infof(format string, v ...interface{})  {}
-func (n *NOOPLogger) Warn(v ...interface{})                  {}
-func (n *NOOPLogger) Warnf(format string, v ...interface{})  {}
-func (n *NOOPLogger) Error(v ...interface{})                 {}
-func (n *NOOPLogger) Errorf(format string, v ...interface{}) {}
+func (n *NOOPLogger) Debug(v ...interface{})                      {}
+func (n *NOOPLogger) Debugf(format string, v ...interface{})      {}
+func (n *NOOPLogger) Info(v ...interface{})                       {}
+func (n *NOOPLogger) Infof(format string, v ...interface{})       {}
+func (n *NOOPLogger) Warn(v ...interface{})                       {}
+func (n *NOOPLogger) Warnf(format string, v ...interface{})       {}
+func (n *NOOPLogger) Error(v ...interface{})                      {}
+func (n *NOOPLogger) Errorf(format string, v ...interface{})      {}
+func (n *NOOPLogger) WithField(key string, value interface{}) Log { return n }
+
+// ZerologLogger is a LevelLog writing to a zerolog logger. Fields are added as
+// structured fields.
+type ZerologLogger struct {
+	logger zerolog.Logger
+	// level is shared with all derived loggers
+	level *int32
+}
+
+// NewZerologLogger creates a new logger on top of the zerolog logger. The
+// level starts at DebugLevel, so only the level of the zerolog logger applies
+// until it is changed.
+func NewZerologLogger(logger zerolog.Logger) *ZerologLogger {
+	level := int32(DebugLevel)
+	return &ZerologLogger{
+		logger: logger,
+		level:  &level,
+	}
+}
+
+// DefaultLogger is used by components which are not given a logger. It logs
+// to the global zerolog logger.
+func DefaultLogger() Log {
+	return NewZerologLogger(zlog.Logger)
+}
+
+// Level implements LevelLog
+func (z *ZerologLogger) Level() Level {
+	return Level(atomic.LoadInt32(z.level))
+}
+
+// SetLevel implements LevelLog
+func (z *ZerologLogger) SetLevel(level Level) {
+	atomic.StoreInt32(z.level, int32(level))
+}
+
+// WithField implements Log
+func (z *ZerologLogger) WithField(key string, value interface{}) Log {
+	return &ZerologLogger{
+		logger: z.logger.With().Fields(map[string]interface{}{key: value}).Logger(),
+		level:  z.level,
+	}
+}
+
+func (z *ZerologLogger) event(level Level) *zerolog.Event {
+	if level < z.Level() {
+		return nil
+	}
+	switch level {
+	case DebugLevel:
+		return z.logger.Debug()
+	case InfoLevel:
+		return z.logger.Info()
+	case WarnLevel:
+		return z.logger.Warn()
+	default:
+		return z.logger.Error()
+	}
+}
+
+// Debug implements Log
+func (z *ZerologLogger) Debug(v ...interface{}) {
+	z.event(DebugLevel).Msg(fmt.Sprint(v...))
+}
+
+// Debugf implements Log
+func (z *ZerologLogger) Debugf(format string, v ...interface{}) {
+	z.event(DebugLevel).Msgf(format, v...)
+}
+
+// Info implements Log
+func (z *ZerologLogger) Info(v ...interface{}) {
+	z.event(InfoLevel).Msg(fmt.Sprint(v...))
+}
+
+// Infof implements Log
+func (z *ZerologLogger) Infof(format string, v ...interface{}) {
+	z.event(InfoLevel).Msgf(format, v...)
+}
+
+// Warn implements Log
+func (z *ZerologLogger) Warn(v ...interface{}) {
+	z.event(WarnLevel).Msg(fmt.Sprint(v...))
+}
+
+// Warnf implements Log
+func (z *ZerologLogger) Warnf(format string, v ...interface{}) {
+	z.event(WarnLevel).Msgf(format, v...)
+}
+
+// Error implements Log
+func (z *ZerologLogger) Error(v ...interface{}) {
+	z.event(ErrorLevel).Msg(fmt.Sprint(v...))
+}
+
+// Errorf implements Log
+func (z *ZerologLogger) Errorf(format string, v ...interface{}) {
+	z.event(ErrorLevel).Msgf(format, v...)
+}
@@ -0,0 +1,190 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	_ LevelLog  = &ZerologLogger{}
+	_ Log       = &NOOPLogger{}
+	_ LogSetter = &Server{}
+	_ LogSetter = &BufferedNode{}
+	_ LogSetter = &P2PNode{}
+)
+
+// lockedBuffer is a buffer which can be written and read concurrently
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buf.String()
+}
+
+// lines decodes the json log lines in the buffer
+func lines(t *testing.T, buf fmt.Stringer) []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+func TestZerologLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewZerologLogger(zerolog.New(buf))
+	derived := logger.WithField("dtid", uint64(1)).WithField("error", context.Canceled)
+
+	derived.Debugf("hello %s", "world")
+	logger.SetLevel(WarnLevel)
+	derived.Info("dropped")
+	derived.Warn("kept")
+
+	entries := lines(t, buf)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 log lines, got %v", entries)
+	}
+	if entries[0]["message"] != "hello world" || entries[0]["level"] != "debug" {
+		t.Errorf("unexpected entry %v", entries[0])
+	}
+	if entries[0]["dtid"] != float64(1) || entries[0]["error"] != "context canceled" {
+		t.Errorf("expected fields on derived logger, got %v", entries[0])
+	}
+	if entries[1]["message"] != "kept" || entries[1]["level"] != "warn" {
+		t.Errorf("unexpected entry %v", entries[1])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{DebugLevel, InfoLevel, WarnLevel, ErrorLevel} {
+		parsed, err := ParseLevel(strings.ToUpper(level.String()))
+		if err != nil || parsed != level {
+			t.Errorf("could not parse %s: %v", level, err)
+		}
+	}
+	if _, err := ParseLevel("trace"); err == nil {
+		t.Error("expected unknown level to fail")
+	}
+}
+
+// fieldCountingLog counts the fields added to it and its derived loggers
+type fieldCountingLog struct {
+	*ZerologLogger
+	fields *int
+}
+
+func (fl fieldCountingLog) WithField(key string, value interface{}) Log {
+	*fl.fields++
+	return fieldCountingLog{fl.ZerologLogger.WithField(key, value).(*ZerologLogger), fl.fields}
+}
+
+func TestDebugFieldsSkipped(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := fieldCountingLog{NewZerologLogger(zerolog.New(buf)), new(int)}
+	logger.SetLevel(InfoLevel)
+
+	node := NewBufferedNode(newTestStore(t), NewMemoryNetwork().NewTransport())
+	node.SetLogger(logger)
+	node.trace(msg(1, 2, "a", "hi"), eventQueued, "detail")
+	if *logger.fields != 0 || buf.Len() != 0 {
+		t.Errorf("expected no fields with debug disabled, got %d", *logger.fields)
+	}
+
+	logger.SetLevel(DebugLevel)
+	node.trace(msg(1, 2, "a", "hi"), eventQueued, "detail")
+	if *logger.fields != 4 || len(lines(t, buf)) != 1 {
+		t.Errorf("expected traced message to be logged with its fields, got %d fields", *logger.fields)
+	}
+
+	if debugEnabled(&NOOPLogger{}) {
+		t.Error("expected debug to be disabled on the NOOP logger")
+	}
+}
+
+func TestConnectionLogFields(t *testing.T) {
+	h := newHarness(t, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a separate server, as the logger can't be changed once it runs
+	s, err := NewServer(ctx, 0, h.store, h.node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := &lockedBuffer{}
+	s.SetLogger(NewZerologLogger(zerolog.New(buf)))
+	go s.Run()
+	h.addr = s.Addr().String()
+
+	client := h.client(1)
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	h.eventually(func() bool {
+		return strings.Contains(buf.String(), "client closed connection")
+	}, "connection was not closed")
+
+	for _, entry := range lines(t, buf) {
+		if entry["remote"] == nil {
+			t.Errorf("expected remote address on all connection logs, got %v", entry)
+		}
+		if entry["message"] == "client PING command" && entry["dtid"] != float64(1) {
+			t.Errorf("expected dtid on logs after AUTH, got %v", entry)
+		}
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	h := newHarness(t, 1)
+	agent := h.agent(h.store)
+	logger := NewZerologLogger(zerolog.Nop())
+	agent.log = logger
+	do := h.adminFor(agent)
+
+	var level logLevel
+	if code := do(http.MethodGet, "/log/level", nil, &level); code != http.StatusOK || level.Level != "debug" {
+		t.Errorf("unexpected log level %d %v", code, level)
+	}
+	if code := do(http.MethodPut, "/log/level", strings.NewReader(`{"level":"error"}`), &level); code != http.StatusOK {
+		t.Errorf("unexpected status code %d", code)
+	}
+	if logger.Level() != ErrorLevel {
+		t.Errorf("expected level to be changed, got %s", logger.Level())
+	}
+	if code := do(http.MethodPut, "/log/level", strings.NewReader(`{"level":"loud"}`), nil); code != http.StatusBadRequest {
+		t.Errorf("expected bad request for unknown level, got %d", code)
+	}
+
+	agent.log = &NOOPLogger{}
+	if code := do(http.MethodGet, "/log/level", nil, nil); code != http.StatusNotImplemented {
+		t.Errorf("expected not implemented for logger without level, got %d", code)
+	}
+}
@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+)
+
+var errPeerUnreachable = errors.Wrap(context.DeadlineExceeded, "peer unreachable")
+
+// MemoryNetwork connects MemoryTransports in the same process. It can simulate
+// latency and network partitions, which makes it possible to test multiple
+// brokers without an actual network.
+type MemoryNetwork struct {
+	transports map[peer.ID]*MemoryTransport
+	// links which are down, keyed by both directions
+	down    map[[2]peer.ID]struct{}
+	latency time.Duration
+
+	lock sync.RWMutex
+}
+
+// NewMemoryNetwork creates a new empty network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[peer.ID]*MemoryTransport),
+		down:       make(map[[2]peer.ID]struct{}),
+	}
+}
+
+// NewTransport creates a new transport on this network. The transport joins
+// the network once it is started.
+func (n *MemoryNetwork) NewTransport() *MemoryTransport {
+	return &MemoryTransport{
+		network: n,
+		msgChan: make(chan Message),
+	}
+}
+
+// SetLatency sets the time it takes for a message to be delivered
+func (n *MemoryNetwork) SetLatency(latency time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.latency = latency
+}
+
+// Partition the network between the given peers. Messages between them can't
+// be sent until the link is healed.
+func (n *MemoryNetwork) Partition(a peer.ID, b peer.ID) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.down[[2]peer.ID{a, b}] = struct{}{}
+	n.down[[2]peer.ID{b, a}] = struct{}{}
+}
+
+// Heal a previous partition between the given peers
+func (n *MemoryNetwork) Heal(a peer.ID, b peer.ID) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	delete(n.down, [2]peer.ID{a, b})
+	delete(n.down, [2]peer.ID{b, a})
+}
+
+// route finds the transport of the receiver, as seen from the sender
+func (n *MemoryNetwork) route(from peer.ID, to peer.ID) (*MemoryTransport, time.Duration, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	t, ok := n.transports[to]
+	if !ok {
+		return nil, 0, errPeerUnreachable
+	}
+	if _, down := n.down[[2]peer.ID{from, to}]; down {
+		return nil, 0, errPeerUnreachable
+	}
+
+	return t, n.latency, nil
+}
+
+// peers reachable from the given peer
+func (n *MemoryNetwork) peers(from peer.ID) []PeerInfo {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	var out []PeerInfo
+	for id := range n.transports {
+		if id == from {
+			continue
+		}
+		if _, down := n.down[[2]peer.ID{from, id}]; down {
+			continue
+		}
+		out = append(out, PeerInfo{ID: id.Pretty()})
+	}
+	return out
+}
+
+func (n *MemoryNetwork) join(t *MemoryTransport) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.transports[t.id] = t
+}
+
+func (n *MemoryNetwork) leave(t *MemoryTransport) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.transports[t.id] == t {
+		delete(n.transports, t.id)
+	}
+}
+
+// MemoryTransport is a Transport on a MemoryNetwork
+type MemoryTransport struct {
+	network *MemoryNetwork
+	id      peer.ID
+	msgChan chan Message
+	// receive replaces msgChan if set
+	receive func(Message) error
+
+	ctx context.Context
+}
+
+// SetReceiver implements Receiver
+func (t *MemoryTransport) SetReceiver(receive func(Message) error) {
+	t.receive = receive
+}
+
+// Start implements Transport. The transport leaves the network once the context
+// is cancelled.
+func (t *MemoryTransport) Start(ctx context.Context, privateKey crypto.PrivKey) error {
+	id, err := peer.IDFromPrivateKey(privateKey)
+	if err != nil {
+		return errors.Wrap(err, "could not derive peer ID")
+	}
+
+	t.id = id
+	t.ctx = ctx
+	t.network.join(t)
+
+	go func() {
+		<-ctx.Done()
+		t.network.leave(t)
+	}()
+
+	return nil
+}
+
+// Send implements Transport. Address hints are ignored. Sending to a peer which
+// is not on the network, or which is partitioned from this peer, fails
+// immediately, rather than after the timeout.
+func (t *MemoryTransport) Send(message Message, remote peer.AddrInfo, timeout time.Duration) error {
+	if t.ctx.Err() != nil {
+		return errors.Wrap(t.ctx.Err(), "failed to send message")
+	}
+
+	dst, latency, err := t.network.route(t.id, remote.ID)
+	if err != nil {
+		return errors.Wrap(err, "could not open new stream to remote")
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	defer cancel()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "could not open new stream to remote")
+		}
+	}
+
+	if dst.receive != nil {
+		if dst.ctx.Err() != nil {
+			return errors.Wrap(errPeerUnreachable, "could not send message to remote")
+		}
+		if err := dst.receive(message); err != nil {
+			return &sendError{stage: "rejected", err: &RejectedError{Reason: err.Error()}}
+		}
+		return nil
+	}
+
+	select {
+	case dst.msgChan <- message:
+		return nil
+	case <-dst.ctx.Done():
+		return errors.Wrap(errPeerUnreachable, "could not send message to remote")
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "could not send message to remote")
+	}
+}
+
+// PeerID implements Transport
+func (t *MemoryTransport) PeerID() string {
+	return t.id.Pretty()
+}
+
+// Addrs implements Transport. Memory transports are only reachable by their
+// peer ID, so they have no addresses.
+func (t *MemoryTransport) Addrs() []string {
+	return nil
+}
+
+// Peers implements PeerLister. All peers on the network which are not
+// partitioned from this peer are considered connected.
+func (t *MemoryTransport) Peers() []PeerInfo {
+	return t.network.peers(t.id)
+}
+
+// Messages implements Transport
+func (t *MemoryTransport) Messages() <-chan Message {
+	return t.msgChan
+}
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMultiBroker(t *testing.T) {
+	network := NewMemoryNetwork()
+	store := newTestStore(t, 1, 2, 3)
+	b1 := newBroker(t, network, store, 1)
+	b2 := newBroker(t, network, store, 2, 3)
+	ctx := context.Background()
+
+	c1, c2, c3 := b1.client(1), b2.client(2), b2.client(3)
+
+	if err := c1.Do(ctx, "LPUSH", "2:chat", "hello").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c3.Do(ctx, "LPUSH", "1:chat", "hi").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	b2.eventually(func() bool { return c2.LLen(ctx, "0:").Val() == 1 }, "message was not delivered to twin 2")
+	b1.eventually(func() bool { return c1.LLen(ctx, "0:").Val() == 1 }, "message was not delivered to twin 1")
+
+	reply, err := c2.Do(ctx, "LPOP", "0:").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, []interface{}{"1:chat", "hello"}) {
+		t.Errorf("unexpected LPOP reply %v", reply)
+	}
+
+	reply, err = c1.Do(ctx, "LPOP", "0:").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, []interface{}{"3:chat", "hi"}) {
+		t.Errorf("unexpected LPOP reply %v", reply)
+	}
+
+	// twin 3 doesn't see messages for twin 2, even on the same broker
+	if n := c3.LLen(ctx, "0:").Val(); n != 0 {
+		t.Errorf("expected no messages for twin 3, got %d", n)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	network := NewMemoryNetwork()
+	store := newTestStore(t, 1, 2)
+	b1 := newBroker(t, network, store, 1)
+	b2 := newBroker(t, network, store, 2)
+	ctx := context.Background()
+
+	c1, c2 := b1.client(1), b2.client(2)
+
+	network.Partition(b1.peerID(), b2.peerID())
+	if err := c1.Do(ctx, "LPUSH", "2:chat", "lost").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	b1.node.sendQLock.Lock()
+	queued := len(b1.node.sendQ)
+	b1.node.sendQLock.Unlock()
+	if queued != 1 {
+		t.Errorf("expected message to be queued while partitioned, got %d", queued)
+	}
+
+	// queued messages are retried while partitioned
+	b1.node.retry()
+	if n := b1.node.Queues(); len(n) != 1 || n[0].Sending != 1 {
+		t.Errorf("expected message to stay queued while partitioned, got %+v", n)
+	}
+
+	network.Heal(b1.peerID(), b2.peerID())
+	b1.node.retry()
+	if err := c1.Do(ctx, "LPUSH", "2:chat", "found").Err(); err != nil {
+		t.Fatal(err)
+	}
+	b2.eventually(func() bool { return c2.LLen(ctx, "0:").Val() == 2 }, "messages were not delivered after healing")
+
+	reply, err := c2.Do(ctx, "LRANGE", "0:", 0, -1).Slice()
+	if err != nil || !reflect.DeepEqual(reply, []interface{}{"1:chat", "lost", "1:chat", "found"}) {
+		t.Errorf("expected queued message to be delivered first, got %v %v", reply, err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	network := NewMemoryNetwork()
+	store := newTestStore(t, 1, 2)
+	b1 := newBroker(t, network, store, 1)
+	newBroker(t, network, store, 2)
+	ctx := context.Background()
+
+	c1 := b1.client(1)
+	// make sure the connection is set up before measuring
+	if err := c1.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	network.SetLatency(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := c1.Do(ctx, "LPUSH", "2:chat", "slow").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected send to take at least 50ms, took %s", d)
+	}
+}
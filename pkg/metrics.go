@@ -0,0 +1,388 @@
+package pkg
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace   = "tfagent"
+	defaultMetricsPath = "/metrics"
+)
+
+// MetricsConfig configures the metrics endpoint of an agent
+type MetricsConfig struct {
+	// Address to serve metrics on, e.g. :9100
+	Address string
+	// Path of the metrics endpoint, defaults to /metrics
+	Path string
+}
+
+// Metrics collects the metrics of an agent. A nil *Metrics is valid, and
+// doesn't record anything.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	commands        *prometheus.CounterVec
+	commandDuration *prometheus.HistogramVec
+	authFailures    prometheus.Counter
+
+	messagesSent        prometheus.Counter
+	messagesReceived    prometheus.Counter
+	messagesQueued      prometheus.Counter
+	messagesDenied      prometheus.Counter
+	messagesRedelivered prometheus.Counter
+	messagesExpired     *prometheus.CounterVec
+	messagesDead        *prometheus.CounterVec
+
+	sendDuration prometheus.Histogram
+	sendFailures *prometheus.CounterVec
+}
+
+// newMetrics creates the metrics of an agent, on a registry of their own so
+// multiple agents can run in the same process
+func newMetrics(a *Agent) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "resp_commands_total",
+			Help:      "RESP commands handled, by command and result.",
+		}, []string{"command", "result"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "resp_command_duration_seconds",
+			Help:      "Time to handle RESP commands, by command.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"command"}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "auth_failures_total",
+			Help:      "Failed AUTH attempts.",
+		}),
+		messagesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_sent_total",
+			Help:      "Messages delivered to remote peers.",
+		}),
+		messagesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_received_total",
+			Help:      "Messages received from remote peers and accepted in a mailbox.",
+		}),
+		messagesQueued: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_queued_total",
+			Help:      "Messages queued because the remote peer could not be reached.",
+		}),
+		messagesDenied: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_denied_total",
+			Help:      "Received messages dropped by the ACL of the receiver.",
+		}),
+		messagesRedelivered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_redelivered_total",
+			Help:      "Leased messages put back in a mailbox because they were not acknowledged.",
+		}),
+		messagesExpired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_expired_total",
+			Help:      "Messages removed from a queue because their TTL expired, by queue.",
+		}, []string{"queue"}),
+		messagesDead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_dead_lettered_total",
+			Help:      "Messages which could not be delivered, kept as dead letter of the sender, by reason.",
+		}, []string{"reason"}),
+		sendDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "p2p_send_duration_seconds",
+			Help:      "Time to send a message over the transport, including failed attempts.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 9),
+		}),
+		sendFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "p2p_send_failures_total",
+			Help:      "Failed sends over the transport, by reason.",
+		}, []string{"reason"}),
+	}
+
+	m.registry.MustRegister(
+		m.commands,
+		m.commandDuration,
+		m.authFailures,
+		m.messagesSent,
+		m.messagesReceived,
+		m.messagesQueued,
+		m.messagesDenied,
+		m.messagesRedelivered,
+		m.messagesExpired,
+		m.messagesDead,
+		m.sendDuration,
+		m.sendFailures,
+		&queueCollector{node: a.node},
+		&connCollector{agent: a},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "p2p_peers",
+			Help:      "Peers the transport is connected to.",
+		}, func() float64 {
+			if !a.Healthy() {
+				return 0
+			}
+			return float64(len(a.node.Peers()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "resp_clients",
+			Help:      "Clients connected to the RESP server.",
+		}, func() float64 {
+			if !a.Healthy() {
+				return 0
+			}
+			return float64(len(a.server.Clients()))
+		}),
+	)
+
+	if cs, ok := a.store.(CachingStore); ok {
+		m.registry.MustRegister(
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   metricsNamespace,
+				Name:        "peerstore_cache_requests_total",
+				Help:        "Peer store lookups, by cache result.",
+				ConstLabels: prometheus.Labels{"result": "hit"},
+			}, func() float64 {
+				hits, _ := cs.CacheStats()
+				return float64(hits)
+			}),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   metricsNamespace,
+				Name:        "peerstore_cache_requests_total",
+				Help:        "Peer store lookups, by cache result.",
+				ConstLabels: prometheus.Labels{"result": "miss"},
+			}, func() float64 {
+				_, misses := cs.CacheStats()
+				return float64(misses)
+			}),
+		)
+	}
+
+	return m
+}
+
+// command records a handled RESP command
+func (m *Metrics) command(cmd string, failed bool, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if failed {
+		result = "error"
+	}
+	m.commands.WithLabelValues(cmd, result).Inc()
+	m.commandDuration.WithLabelValues(cmd).Observe(duration.Seconds())
+}
+
+func (m *Metrics) authFailed() {
+	if m == nil {
+		return
+	}
+	m.authFailures.Inc()
+}
+
+func (m *Metrics) received() {
+	if m == nil {
+		return
+	}
+	m.messagesReceived.Inc()
+}
+
+func (m *Metrics) denied() {
+	if m == nil {
+		return
+	}
+	m.messagesDenied.Inc()
+}
+
+func (m *Metrics) redelivered() {
+	if m == nil {
+		return
+	}
+	m.messagesRedelivered.Inc()
+}
+
+func (m *Metrics) queued() {
+	if m == nil {
+		return
+	}
+	m.messagesQueued.Inc()
+}
+
+func (m *Metrics) expired(queue string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.messagesExpired.WithLabelValues(queue).Add(float64(n))
+}
+
+func (m *Metrics) deadLettered(reason string) {
+	if m == nil {
+		return
+	}
+	m.messagesDead.WithLabelValues(reason).Inc()
+}
+
+// sent records an attempt to send a message over the transport
+func (m *Metrics) sent(err error, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.sendDuration.Observe(duration.Seconds())
+	if err != nil {
+		m.sendFailures.WithLabelValues(sendFailureReason(err)).Inc()
+		return
+	}
+	m.messagesSent.Inc()
+}
+
+// sendFailureReason classifies a transport send error
+func sendFailureReason(err error) string {
+	var serr *sendError
+	switch {
+	case errors.Is(err, errPeerUnreachable):
+		return "unreachable"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &serr):
+		return serr.stage
+	default:
+		return "other"
+	}
+}
+
+// queueCollector reports the queue depths per twin at scrape time
+type queueCollector struct {
+	node *BufferedNode
+}
+
+var queueDepthDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "queue_depth"),
+	"Messages waiting in a queue, by twin and queue.",
+	[]string{"twin", "queue"}, nil,
+)
+
+// Describe implements prometheus.Collector
+func (qc *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+// Collect implements prometheus.Collector
+func (qc *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, qi := range qc.node.Queues() {
+		twin := strconv.FormatUint(qi.Twin, 10)
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(qi.Received), twin, "recv")
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(qi.Sending), twin, "send")
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(qi.Leased), twin, "leased")
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(qi.DeadLetters), twin, "dead")
+	}
+}
+
+// connCollector reports the connection stats of the server at scrape time
+type connCollector struct {
+	agent *Agent
+}
+
+var (
+	connAcceptedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "resp_connections_total"),
+		"Connections accepted by the RESP server.",
+		nil, nil,
+	)
+	connRejectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "resp_connections_rejected_total"),
+		"Connections rejected by the RESP server, by exceeded limit.",
+		[]string{"reason"}, nil,
+	)
+	connTimeoutsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "resp_connection_timeouts_total"),
+		"Connections closed by the RESP server because of a timeout, by timeout.",
+		[]string{"timeout"}, nil,
+	)
+)
+
+// Describe implements prometheus.Collector
+func (cc *connCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connAcceptedDesc
+	ch <- connRejectedDesc
+	ch <- connTimeoutsDesc
+}
+
+// Collect implements prometheus.Collector
+func (cc *connCollector) Collect(ch chan<- prometheus.Metric) {
+	if !cc.agent.Healthy() {
+		return
+	}
+	stats := cc.agent.server.ConnectionStats()
+	ch <- prometheus.MustNewConstMetric(connAcceptedDesc, prometheus.CounterValue, float64(stats.Accepted))
+	ch <- prometheus.MustNewConstMetric(connRejectedDesc, prometheus.CounterValue, float64(stats.RejectedMaxClients), "max_clients")
+	ch <- prometheus.MustNewConstMetric(connRejectedDesc, prometheus.CounterValue, float64(stats.RejectedMaxPerIP), "max_clients_per_ip")
+	ch <- prometheus.MustNewConstMetric(connTimeoutsDesc, prometheus.CounterValue, float64(stats.AuthTimeouts), "auth")
+	ch <- prometheus.MustNewConstMetric(connTimeoutsDesc, prometheus.CounterValue, float64(stats.IdleTimeouts), "idle")
+	ch <- prometheus.MustNewConstMetric(connTimeoutsDesc, prometheus.CounterValue, float64(stats.WriteTimeouts), "write")
+}
+
+// metricsServer serves the metrics endpoint
+type metricsServer struct {
+	ln  net.Listener
+	srv *http.Server
+
+	ctx context.Context
+}
+
+func newMetricsServer(ctx context.Context, m *Metrics, cfg MetricsConfig) (*metricsServer, error) {
+	path := cfg.Path
+	if path == "" {
+		path = defaultMetricsPath
+	}
+
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", cfg.Address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create metrics listener")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+
+	return &metricsServer{
+		ln: ln,
+		srv: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		ctx: ctx,
+	}, nil
+}
+
+// Run the metrics server until the context is done
+func (ms *metricsServer) Run() error {
+	go func() {
+		<-ms.ctx.Done()
+		ms.srv.Close()
+	}()
+
+	err := ms.srv.Serve(ms.ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return errors.Wrap(err, "metrics server failed")
+}
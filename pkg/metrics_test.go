@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+func TestMetrics(t *testing.T) {
+	store := cachingStore{newTestStore(t, 1)}
+	agent, err := New(
+		WithPeerStore(store),
+		WithTransport(NewMemoryNetwork().NewTransport()),
+		WithPort(0),
+		WithMetrics(MetricsConfig{Address: "127.0.0.1:0", Path: "/custom"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAgent(t, agent)
+	store.SetPeerID(1, agent.PeerID())
+
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: agent.Addr().String()})
+	defer client.Close()
+
+	client.Do(ctx, "AUTH", 1, store.sig(1)[2:]+"00")
+	client.Do(ctx, "FOO")
+	if err = client.Do(ctx, "AUTH", 1, store.sig(1)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Do(ctx, "LPUSH", "1:self", "hello").Err(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.LLen(ctx, "0:").Val() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("message was not delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/custom", agent.MetricsAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		`tfagent_resp_commands_total{command="AUTH",result="error"} 1`,
+		`tfagent_resp_commands_total{command="AUTH",result="ok"} 1`,
+		`tfagent_resp_commands_total{command="UNKNOWN",result="error"} 1`,
+		`tfagent_resp_commands_total{command="LPUSH",result="ok"} 1`,
+		`tfagent_resp_commands_total{command="LLEN",result="ok"}`,
+		`tfagent_auth_failures_total 1`,
+		`tfagent_messages_sent_total 1`,
+		`tfagent_messages_received_total 1`,
+		`tfagent_queue_depth{queue="recv",twin="1"} 1`,
+		`tfagent_p2p_send_duration_seconds_count 1`,
+		`tfagent_resp_clients 1`,
+		`tfagent_resp_connections_total 1`,
+		`tfagent_resp_connections_rejected_total{reason="max_clients"} 0`,
+		`tfagent_resp_connection_timeouts_total{timeout="auth"} 0`,
+		`tfagent_peerstore_cache_requests_total{result="hit"} 3`,
+		`tfagent_peerstore_cache_requests_total{result="miss"} 1`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected metrics to contain %s", expected)
+		}
+	}
+}
+
+func TestSendFailureReason(t *testing.T) {
+	cases := map[string]error{
+		"unreachable": errors.Wrap(errPeerUnreachable, "could not send"),
+		"timeout":     errors.Wrap(context.DeadlineExceeded, "could not send"),
+		"canceled":    errors.Wrap(context.Canceled, "could not send"),
+		"stream":      &sendError{stage: "stream", err: errors.New("protocol not supported")},
+		"other":       errors.New("boom"),
+	}
+	for expected, err := range cases {
+		if reason := sendFailureReason(err); reason != expected {
+			t.Errorf("expected reason %s for %v, got %s", expected, err, reason)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	h := newHarness(t, 1)
+	now := time.Now()
+
+	expired, fresh, eternal := msg(2, 1, "", "expired"), msg(2, 1, "", "fresh"), msg(2, 1, "", "eternal")
+	expired.TTL = now.Add(-time.Second)
+	fresh.TTL = now.Add(time.Second)
+	h.node.recvQ = append(h.node.recvQ, expired, fresh, eternal)
+	h.node.sendQ = append(h.node.sendQ, expired, fresh)
+
+	h.node.expire(now)
+
+	if len(h.node.recvQ) != 2 || string(h.node.recvQ[0].Payload) != "fresh" || string(h.node.recvQ[1].Payload) != "eternal" {
+		t.Errorf("unexpected receive queue after expiry %+v", h.node.recvQ)
+	}
+	if len(h.node.sendQ) != 1 || string(h.node.sendQ[0].Payload) != "fresh" {
+		t.Errorf("unexpected send queue after expiry %+v", h.node.sendQ)
+	}
+}
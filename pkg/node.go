@@ -3,6 +3,7 @@ package pkg
 import (
 	"context"
 	"encoding/json"
+	"os"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
@@ -11,104 +12,311 @@ import (
 	"github.com/libp2p/go-libp2p-core/host"
 	p2pnetwork "github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/routing"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
 	secio "github.com/libp2p/go-libp2p-secio"
 	libp2ptls "github.com/libp2p/go-libp2p-tls"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
 )
 
 const protocolID = "/tfagent/message/1.0.0"
 
+// responseProtocolID is the message protocol in which the receiving peer
+// responds whether it accepted the message. Peers which don't support it
+// fall back to protocolID.
+const responseProtocolID = "/tfagent/message/1.1.0"
+
+// response of the receiving peer to a message
+type response struct {
+	// Rejected is the reason the message was rejected, empty if it was
+	// accepted
+	Rejected string `json:"rejected,omitempty"`
+}
+
+// PrivateDHTProtocolPrefix can be used as DHT protocol prefix to run a DHT
+// separate from the public IPFS DHT, i.e. /tfagent/kad/1.0.0
+const PrivateDHTProtocolPrefix = "/tfagent"
+
+// P2PConfig configures the libp2p host of a P2PNode. The zero value joins the
+// public IPFS DHT.
+type P2PConfig struct {
+	// ListenAddrs of the host as multiaddrs. Defaults to random tcp and quic
+	// ports on all interfaces.
+	ListenAddrs []string
+	// BootstrapPeers to connect to, as multiaddrs including the peer ID, e.g.
+	// /ip4/1.2.3.4/tcp/4001/p2p/QmPeer. These are used in addition to the
+	// public bootstrap peers, unless DisablePublicBootstrap is set.
+	BootstrapPeers []string
+	// DisablePublicBootstrap prevents connecting to the public IPFS
+	// bootstrap peers
+	DisablePublicBootstrap bool
+	// DHTProtocolPrefix replaces the default /ipfs prefix of the DHT protocols.
+	// Only peers using the same prefix join the same DHT.
+	DHTProtocolPrefix string
+	// DHTServer forces the DHT in server mode, rather than only becoming a
+	// server once the host is publicly reachable. This is needed for small or
+	// local networks.
+	DHTServer bool
+	// PrivateNetworkKey if set, only allows connections with peers using the
+	// same pre shared key. QUIC is disabled, as it does not support private
+	// networks.
+	PrivateNetworkKey pnet.PSK
+}
+
+func (cfg P2PConfig) bootstrapPeers() ([]peer.AddrInfo, error) {
+	var addrs []ma.Multiaddr
+	for _, s := range cfg.BootstrapPeers {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid bootstrap peer %s", s)
+		}
+		addrs = append(addrs, addr)
+	}
+
+	if !cfg.DisablePublicBootstrap {
+		addrs = append(addrs, dht.DefaultBootstrapPeers...)
+	}
+
+	peers, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	return peers, errors.Wrap(err, "invalid bootstrap peer")
+}
+
+// LoadPSK loads a pre shared key for a private network from a file, in the
+// format used by IPFS for swarm.key files
+func LoadPSK(path string) (pnet.PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open pre shared key file")
+	}
+	defer f.Close()
+
+	psk, err := pnet.DecodeV1PSK(f)
+	return psk, errors.Wrap(err, "could not decode pre shared key")
+}
+
 // P2PNode handles streams amd connections
 type P2PNode struct {
 	ctx     context.Context
+	cfg     P2PConfig
 	host    host.Host
 	routing routing.PeerRouting
-	msgChan chan<- Message
+	msgChan chan Message
+	// receive replaces msgChan if set
+	receive func(Message) error
+	log     Log
 }
 
-func NewP2PNode(msgChan chan<- Message) *P2PNode {
+// NewP2PNode creates a new P2PNode. The libp2p host is only created once the
+// node is started.
+func NewP2PNode(cfg P2PConfig) *P2PNode {
 	return &P2PNode{
-		msgChan: msgChan,
+		cfg:     cfg,
+		msgChan: make(chan Message),
+		log:     DefaultLogger(),
 	}
 }
 
-// Send sends a message to a list of addresses
-func (c *P2PNode) Send(message Message, peerID peer.ID, timeout time.Duration) error {
+// SetLogger implements LogSetter. It must be called before the component is
+// started.
+func (c *P2PNode) SetLogger(log Log) {
+	c.log = log
+}
+
+// SetReceiver implements Receiver
+func (c *P2PNode) SetReceiver(receive func(Message) error) {
+	c.receive = receive
+}
+
+// Send implements Transport
+func (c *P2PNode) Send(message Message, remote peer.AddrInfo, timeout time.Duration) error {
 	if c.ctx.Err() != nil {
 		return errors.Wrap(c.ctx.Err(), "failed to send message")
 	}
 	ctx, cancel := context.WithTimeout(c.ctx, timeout)
 	defer cancel()
 
-	s, err := c.host.NewStream(ctx, peerID, protocolID)
+	if err := c.connect(ctx, remote); err != nil {
+		return &sendError{stage: "connect", err: errors.Wrap(err, "could not connect to remote")}
+	}
+
+	s, err := c.host.NewStream(ctx, remote.ID, responseProtocolID, protocolID)
 	if err != nil {
-		return errors.Wrap(err, "could not open new stream to remote")
+		return &sendError{stage: "stream", err: errors.Wrap(err, "could not open new stream to remote")}
 	}
+	defer s.Close()
 
 	if err = json.NewEncoder(s).Encode(message); err != nil {
-		log.Error().Err(err).Str("peerID", string(peerID)).Msg("could not send message to peer")
-		return err
+		c.log.WithField("error", err).WithField("peerID", remote.ID.Pretty()).Error("could not send message to peer")
+		return &sendError{stage: "write", err: err}
+	}
+
+	if s.Protocol() == responseProtocolID {
+		if deadline, ok := ctx.Deadline(); ok {
+			s.SetReadDeadline(deadline)
+		}
+		var resp response
+		if err = json.NewDecoder(s).Decode(&resp); err != nil {
+			return &sendError{stage: "response", err: errors.Wrap(err, "could not read response of remote")}
+		}
+		if resp.Rejected != "" {
+			return &sendError{stage: "rejected", err: &RejectedError{Reason: resp.Rejected}}
+		}
 	}
 
-	log.Debug().Str("peerID", string(peerID)).Msg("sent message")
+	c.log.WithField("peerID", remote.ID.Pretty()).Debug("sent message")
 
-	return err
+	return nil
+}
+
+// connect to the remote using the address hints. If there are no hints, the
+// host looks up the peer in the DHT when opening a stream. Because the host
+// doesn't fall back to the DHT if it already knows addresses of the peer, that
+// is done here if the hints turn out to be stale.
+func (c *P2PNode) connect(ctx context.Context, remote peer.AddrInfo) error {
+	if len(remote.Addrs) == 0 || c.host.Network().Connectedness(remote.ID) == p2pnetwork.Connected {
+		return nil
+	}
+
+	c.host.Peerstore().AddAddrs(remote.ID, remote.Addrs, peerstore.TempAddrTTL)
+	err := c.host.Connect(ctx, remote)
+	if err == nil {
+		return nil
+	}
+
+	c.log.WithField("error", err).WithField("peerID", remote.ID.Pretty()).Debug("could not connect using address hints, looking up peer")
+	found, ferr := c.routing.FindPeer(ctx, remote.ID)
+	if ferr != nil {
+		return errors.Wrapf(err, "could not find peer (%s) after failing to connect", ferr)
+	}
+
+	return c.host.Connect(ctx, found)
 }
 
-// Start creates a libp2p host and starts handling connections
+// Start implements Transport. It creates a libp2p host and starts handling
+// connections
 func (c *P2PNode) Start(ctx context.Context, privateKey crypto.PrivKey) error {
 	c.ctx = ctx
 	var err error
-	c.host, c.routing, err = createLibp2pHost(ctx, privateKey)
+	c.host, c.routing, err = createLibp2pHost(ctx, privateKey, c.cfg, c.log)
 	if err != nil {
 		return err
 	}
 
-	log.Info().Str("ID", c.host.ID().Pretty()).Msg("started dht peer")
+	c.log.WithField("ID", c.host.ID().Pretty()).Info("started dht peer")
 
-	c.host.SetStreamHandler(protocolID, func(s p2pnetwork.Stream) {
-		connection := s.Conn()
+	c.host.SetStreamHandler(protocolID, func(s p2pnetwork.Stream) { c.handle(ctx, s) })
+	c.host.SetStreamHandler(responseProtocolID, func(s p2pnetwork.Stream) { c.handle(ctx, s) })
 
-		log.Debug().Str("peerID", connection.RemotePeer().Pretty()).Msg("got a new stream from remote")
+	return nil
+}
 
-		msg := Message{}
-		if err = json.NewDecoder(s).Decode(&msg); err != nil {
-			log.Debug().Err(err).Msg("could not decode message from peer")
-			return
-		}
+// handle a stream carrying a message, and respond whether it is accepted if
+// the protocol of the stream has a response
+func (c *P2PNode) handle(ctx context.Context, s p2pnetwork.Stream) {
+	defer s.Close() // TODO: don't close it immediately but reuse when possible.
+	log := c.log.WithField("peerID", s.Conn().RemotePeer().Pretty())
+	log.Debug("got a new stream from remote")
 
-		c.msgChan <- msg
-		s.Close() // TODO: don't close it immediately but reuse when possible.
-	})
+	msg := Message{}
+	if err := json.NewDecoder(s).Decode(&msg); err != nil {
+		log.WithField("error", err).Debug("could not decode message from peer")
+		return
+	}
 
-	return nil
+	if c.receive == nil {
+		select {
+		case c.msgChan <- msg:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	var resp response
+	if err := c.receive(msg); err != nil {
+		resp.Rejected = err.Error()
+	}
+	if s.Protocol() != responseProtocolID {
+		return
+	}
+	if err := json.NewEncoder(s).Encode(resp); err != nil {
+		log.WithField("error", err).Debug("could not send response to peer")
+	}
 }
 
+// PeerID implements Transport
 func (c *P2PNode) PeerID() string {
 	return c.host.ID().Pretty()
 }
 
-func createLibp2pHost(ctx context.Context, privateKey crypto.PrivKey) (host.Host, routing.PeerRouting, error) {
+// Addrs implements Transport
+func (c *P2PNode) Addrs() []string {
+	addrs := c.host.Addrs()
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, addr.String())
+	}
+	return out
+}
+
+// Peers implements PeerLister
+func (c *P2PNode) Peers() []PeerInfo {
+	network := c.host.Network()
+	peers := network.Peers()
+	out := make([]PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		info := PeerInfo{ID: p.Pretty()}
+		for _, conn := range network.ConnsToPeer(p) {
+			info.Addrs = append(info.Addrs, conn.RemoteMultiaddr().String())
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+// Messages implements Transport
+func (c *P2PNode) Messages() <-chan Message {
+	return c.msgChan
+}
+
+func createLibp2pHost(ctx context.Context, privateKey crypto.PrivKey, cfg P2PConfig, log Log) (host.Host, routing.PeerRouting, error) {
+	bootstrapPeers, err := cfg.bootstrapPeers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listenAddrs := cfg.ListenAddrs
+	if len(listenAddrs) == 0 {
+		listenAddrs = []string{
+			"/ip4/0.0.0.0/tcp/0", // regular tcp connections
+		}
+		if cfg.PrivateNetworkKey == nil {
+			listenAddrs = append(listenAddrs, "/ip4/0.0.0.0/udp/0/quic") // a UDP endpoint for the QUIC transport
+		}
+	}
+
+	dhtOpts := []dht.Option{dht.BootstrapPeers(bootstrapPeers...)}
+	if cfg.DHTProtocolPrefix != "" {
+		dhtOpts = append(dhtOpts, dht.ProtocolPrefix(protocol.ID(cfg.DHTProtocolPrefix)))
+	}
+	if cfg.DHTServer {
+		dhtOpts = append(dhtOpts, dht.Mode(dht.ModeServer))
+	}
+
 	var idht *dht.IpfsDHT
-	var err error
-	libp2phost, err := libp2p.New(ctx,
+	opts := []libp2p.Option{
 		// Use the keypair we generated
 		libp2p.Identity(privateKey),
 		// Multiple listen addresses
-		libp2p.ListenAddrStrings(
-			"/ip4/0.0.0.0/tcp/0",      // regular tcp connections
-			"/ip4/0.0.0.0/udp/0/quic", // a UDP endpoint for the QUIC transport
-		),
+		libp2p.ListenAddrStrings(listenAddrs...),
 		// support TLS connections
 		libp2p.Security(libp2ptls.ID, libp2ptls.New),
 		// support secio connections
 		libp2p.Security(secio.ID, secio.New),
-		// support QUIC
-		libp2p.Transport(libp2pquic.NewTransport),
 		// support any other default transports (TCP)
 		libp2p.DefaultTransports,
 		// Let's prevent our peer from having too many
@@ -122,20 +330,35 @@ func createLibp2pHost(ctx context.Context, privateKey crypto.PrivKey) (host.Host
 		libp2p.NATPortMap(),
 		// Let this host use the DHT to find other hosts
 		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
-			idht, err = dht.New(ctx, h)
+			var err error
+			idht, err = dht.New(ctx, h, dhtOpts...)
 			return idht, err
 		}),
 		// Let this host use relays and advertise itself on relays if
 		// it finds it is behind NAT. Use libp2p.Relay(options...) to
 		// enable active relays and more.
 		libp2p.EnableAutoRelay(),
-	)
-	// This connects to public bootstrappers
-	for _, addr := range dht.DefaultBootstrapPeers {
-		pi, _ := peer.AddrInfoFromP2pAddr(addr)
+	}
+	if cfg.PrivateNetworkKey != nil {
+		// QUIC does not support private networks
+		opts = append(opts, libp2p.PrivateNetwork(cfg.PrivateNetworkKey))
+	} else {
+		// support QUIC
+		opts = append(opts, libp2p.Transport(libp2pquic.NewTransport))
+	}
+
+	libp2phost, err := libp2p.New(ctx, opts...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create libp2p host")
+	}
+
+	// This connects to the bootstrappers
+	for _, pi := range bootstrapPeers {
 		// We ignore errors as some bootstrap peers may be down
 		// and that is fine.
-		libp2phost.Connect(ctx, *pi)
+		if err := libp2phost.Connect(ctx, pi); err != nil {
+			log.WithField("error", err).WithField("peerID", pi.ID.Pretty()).Debug("could not connect to bootstrap peer")
+		}
 	}
-	return libp2phost, idht, err
+	return libp2phost, idht, nil
 }
@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/pkg/errors"
+)
+
+const testBootstrapPeer = "/ip4/10.0.0.1/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ"
+
+func TestBootstrapPeers(t *testing.T) {
+	peers, err := P2PConfig{}.bootstrapPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != len(dht.DefaultBootstrapPeers) {
+		t.Errorf("expected the public bootstrap peers, got %d peers", len(peers))
+	}
+
+	peers, err = P2PConfig{
+		BootstrapPeers:         []string{testBootstrapPeer},
+		DisablePublicBootstrap: true,
+	}.bootstrapPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].ID.Pretty() != "QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ" {
+		t.Errorf("expected only the configured bootstrap peer, got %v", peers)
+	}
+
+	if _, err = (P2PConfig{BootstrapPeers: []string{"/ip4/10.0.0.1/tcp/4001"}}).bootstrapPeers(); err == nil {
+		t.Error("expected an error for a bootstrap peer without peer ID")
+	}
+	if _, err = (P2PConfig{BootstrapPeers: []string{"10.0.0.1:4001"}}).bootstrapPeers(); err == nil {
+		t.Error("expected an error for an invalid multiaddr")
+	}
+}
+
+func TestLoadPSK(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+	path := filepath.Join(t.TempDir(), "swarm.key")
+	data := "/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	psk, err := LoadPSK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(psk, key) {
+		t.Errorf("unexpected key %x", []byte(psk))
+	}
+
+	if _, err = LoadPSK(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestAddrHints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := P2PConfig{
+		ListenAddrs:            []string{"/ip4/127.0.0.1/tcp/0"},
+		DisablePublicBootstrap: true,
+	}
+
+	received := make(chan Message, 1)
+	nodes := make([]*P2PNode, 3)
+	for i := range nodes {
+		priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = NewP2PNode(cfg)
+		nodes[i].SetReceiver(func(msg Message) error {
+			if string(msg.Payload) == "denied" {
+				return errDenied
+			}
+			received <- msg
+			return nil
+		})
+		if err = nodes[i].Start(ctx, priv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// hints is the address info of the node with the given addresses
+	hints := func(node *P2PNode, addrs ...string) peer.AddrInfo {
+		id, err := peer.Decode(node.PeerID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := peer.AddrInfo{ID: id}
+		for _, raw := range addrs {
+			addr, err := ma.NewMultiaddr(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info.Addrs = append(info.Addrs, addr)
+		}
+		return info
+	}
+
+	// there is no DHT to find the peer, so this only works with the hints
+	remote := hints(nodes[1], nodes[1].Addrs()...)
+	if err := nodes[0].Send(Message{Sender: 1, Receiver: 2, Topic: "a", Payload: []byte("hi")}, remote, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if string(msg.Payload) != "hi" {
+			t.Errorf("unexpected message %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+
+	// the receiver responds to messages it rejects
+	err := nodes[0].Send(Message{Sender: 1, Receiver: 2, Topic: "a", Payload: []byte("denied")}, remote, 5*time.Second)
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.Reason != errDenied.Error() {
+		t.Errorf("expected message to be rejected, got %v", err)
+	}
+
+	// stale hints fall back to the DHT, which can't find the peer either
+	err = nodes[0].Send(Message{Sender: 1, Receiver: 3, Topic: "a", Payload: []byte("hi")}, hints(nodes[2], "/ip4/127.0.0.1/tcp/1"), 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "could not find peer") {
+		t.Errorf("expected peer lookup to fail, got %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package pkg
 
+import "time"
+
 // TwinInfo information about a digital twin
 // type TwinInfo struct {
 // 	// PubKey of this digital twin
@@ -12,11 +14,38 @@ package pkg
 type PeerStore interface {
 	// PeerID currently associated with this digital twin
 	PeerID(dtid uint64) (string, error)
-	// PublicKey of this digital twin
-	PublicKey(dtid uint64) ([PublicKeySize]byte, error)
+	// PublicKey of this digital twin, with its type
+	PublicKey(dtid uint64) (TwinKey, error)
 	// SetPeerId of this digital twin. This should override a cached peer ID of
 	// a digital twin. NOTE: because the transport does not validate keys of remote
 	// digital twins, a malicous entity could emulate a peer ID and poison the peer
 	// cache. As such, this should only be used in development.
 	SetPeerID(dtid uint64, pid string)
 }
+
+// CachingStore is an optional extension of a PeerStore which caches lookups. It
+// exposes the cached entries for inspection.
+type CachingStore interface {
+	// Cached entries which are not yet expired
+	Cached() []CachedTwin
+	// CacheStats returns the amount of lookups served from the cache, and the
+	// amount of lookups which had to go to the wrapped store
+	CacheStats() (hits uint64, misses uint64)
+}
+
+// CachedTwin is the cached info of a digital twin. Fields which are not cached
+// have their zero value.
+type CachedTwin struct {
+	// ID of the digital twin
+	ID uint64 `json:"id"`
+	// PeerID of the twin, if cached
+	PeerID string `json:"peer_id,omitempty"`
+	// PeerIDExpires is the time the cached peer ID expires
+	PeerIDExpires time.Time `json:"peer_id_expires"`
+	// PublicKey of the twin, hex encoded, if cached
+	PublicKey string `json:"public_key,omitempty"`
+	// KeyType of the public key, if cached
+	KeyType string `json:"key_type,omitempty"`
+	// PublicKeyExpires is the time the cached public key expires
+	PublicKeyExpires time.Time `json:"public_key_expires"`
+}
@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestPipeline(t *testing.T) {
+	h := newHarness(t, 1)
+	ctx := context.Background()
+
+	// enough replies to be flushed before the whole pipeline is handled
+	const n = 1000
+	for i := 0; i < n; i++ {
+		h.deliver(msg(2, 1, "chat", fmt.Sprintf("message %d", i)))
+	}
+
+	pipe := h.client(1).Pipeline()
+	cmds := make([]*redis.Cmd, n+1)
+	for i := range cmds {
+		cmds[i] = pipe.Do(ctx, "LPOPMSG", "2:chat")
+	}
+	_, err := pipe.Exec(ctx)
+	if err != redis.Nil {
+		t.Fatalf("expected the last pop to find no message, got %v", err)
+	}
+
+	for i, cmd := range cmds[:n] {
+		reply, err := cmd.Slice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload := fmt.Sprint(reply[1]); payload != fmt.Sprintf("message %d", i) {
+			t.Fatalf("expected reply %d to be message %d, got %s", i, i, payload)
+		}
+	}
+}
+
+// benchmarkPipeline sends b.N commands in pipelines of the given depth, so
+// ns/op is the time per command. fill is called before each pipeline, with
+// the amount of commands it sends.
+func benchmarkPipeline(b *testing.B, depth int, fill func(h *harness, n int), args ...interface{}) {
+	h := newHarness(b, 1)
+	ctx := context.Background()
+	client := h.client(1)
+	if err := client.Ping(ctx).Err(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += depth {
+		n := depth
+		if b.N-sent < n {
+			n = b.N - sent
+		}
+		if fill != nil {
+			b.StopTimer()
+			fill(h, n)
+			b.StartTimer()
+		}
+
+		pipe := client.Pipeline()
+		for i := 0; i < n; i++ {
+			pipe.Do(ctx, args...)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPipelinedPing(b *testing.B) {
+	for _, depth := range []int{1, 16, 128, 1024} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			benchmarkPipeline(b, depth, nil, "PING")
+		})
+	}
+}
+
+func BenchmarkPipelinedLPop(b *testing.B) {
+	// the mailbox only holds the messages popped by a single pipeline, as
+	// popping gets slower with the size of the mailbox
+	fill := func(h *harness, n int) {
+		msgs := make([]Message, n)
+		for i := range msgs {
+			msgs[i] = msg(2, 1, "chat", "hello")
+		}
+		h.deliver(msgs...)
+	}
+
+	for _, depth := range []int{1, 16, 128, 1024} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			benchmarkPipeline(b, depth, fill, "LPOP", "2:chat")
+		})
+	}
+}
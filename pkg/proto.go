@@ -4,6 +4,9 @@ import "time"
 
 // Message being sent between peers
 type Message struct {
+	// ID of the message, unique for every message. It is assigned when the
+	// message is pushed by the sender, and used to trace the message.
+	ID string `json:"id"`
 	// Sender digital twin ID
 	Sender uint64 `json:"sender"`
 	// Receiver digital twin ID
@@ -15,4 +18,12 @@ type Message struct {
 	TTL time.Time `json:"ttl"`
 	// Payload of the message
 	Payload []byte `json:"payload"`
+	// ReplyTo is the ID of the request this message is a reply to, if any
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Deliveries counts the leases of the message at the broker of the
+	// receiver, it is more than 1 if a lease expired before it was acknowledged
+	Deliveries int `json:"deliveries,omitempty"`
+	// Trace context of the message, used to continue a trace on the remote
+	// broker if tracing is enabled
+	Trace map[string]string `json:"trace,omitempty"`
 }
@@ -0,0 +1,289 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/secmask/go-redisproto"
+)
+
+// RESP versions a client can negotiate with HELLO. RESP2 is the default.
+const (
+	resp2 = 2
+	resp3 = 3
+)
+
+// maxPooledBuffer is the largest reply buffer returned to the pool, so a
+// single large reply doesn't pin its memory
+const maxPooledBuffer = 64 << 10
+
+// flushThreshold is the size of buffered replies which is written to the
+// connection, even if more pipelined commands are waiting
+const flushThreshold = 32 << 10
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return &bytes.Buffer{} },
+}
+
+// replyConn is the connection replies and push messages are written to. The
+// lock makes sure they are not interleaved.
+type replyConn struct {
+	w io.Writer
+	// timeout of a write, if w supports write deadlines
+	timeout time.Duration
+	// proto is the negotiated RESP version
+	proto int
+	// err of the first failed write, nothing is written after it
+	err  error
+	lock sync.Mutex
+}
+
+// replyWriter writes the replies of a connection in the negotiated RESP
+// version. Replies are buffered until they are flushed, and it keeps track of
+// error replies.
+type replyWriter struct {
+	*redisproto.Writer
+	buf   *bytes.Buffer
+	conn  *replyConn
+	proto int
+	// failed is set if an error was written
+	failed bool
+}
+
+func newReplyWriter(w io.Writer, timeout time.Duration) *replyWriter {
+	conn := &replyConn{w: w, timeout: timeout, proto: resp2}
+	return conn.writer(resp2)
+}
+
+// writer for a single reply or push message
+func (c *replyConn) writer(proto int) *replyWriter {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	return &replyWriter{Writer: redisproto.NewWriter(buf), buf: buf, conn: c, proto: proto}
+}
+
+// release the buffer of the writer to the pool. The writer can't be used
+// afterwards.
+func (w *replyWriter) release() {
+	buf := w.buf
+	w.buf, w.Writer = nil, nil
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// buffered is the size of the replies which are not flushed yet
+func (w *replyWriter) buffered() int {
+	return w.buf.Len()
+}
+
+// setProto sets the RESP version of subsequent replies and push messages
+func (w *replyWriter) setProto(proto int) {
+	w.conn.lock.Lock()
+	defer w.conn.lock.Unlock()
+
+	w.proto = proto
+	w.conn.proto = proto
+}
+
+// flush the buffered replies to the connection
+func (w *replyWriter) flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	w.conn.lock.Lock()
+	defer w.conn.lock.Unlock()
+
+	err := w.conn.write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// push writes a push message to the connection. Push messages are plain
+// arrays in RESP2.
+func (c *replyConn) push(items []interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	w := c.writer(c.proto)
+	defer w.release()
+	if err := w.writeAggregate('>', '*', items); err != nil {
+		return err
+	}
+
+	return c.write(w.buf.Bytes())
+}
+
+// write data to the connection, within the timeout. The lock must be held.
+func (c *replyConn) write(data []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	if d, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok && c.timeout > 0 {
+		if err := d.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+			c.err = err
+			return err
+		}
+	}
+	_, c.err = c.w.Write(data)
+	return c.err
+}
+
+// failure is the error of the first failed write, if any
+func (c *replyConn) failure() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err
+}
+
+// close the connection, so the client is disconnected after a failed push
+func (c *replyConn) close() {
+	if closer, ok := c.w.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// WriteError writes an error reply
+func (w *replyWriter) WriteError(msg string) error {
+	w.failed = true
+	return w.Writer.WriteError(msg)
+}
+
+// writeNull writes a null reply, for commands which reply with an array if
+// there is a result. This is a null array in RESP2.
+func (w *replyWriter) writeNull() error {
+	if w.proto == resp3 {
+		_, err := w.Write([]byte("_\r\n"))
+		return err
+	}
+	return w.WriteBulksSlice(nil)
+}
+
+// writeNullBulk writes a null reply, for commands which reply with a single
+// value if there is a result. This is a null bulk string in RESP2.
+func (w *replyWriter) writeNullBulk() error {
+	if w.proto == resp3 {
+		_, err := w.Write([]byte("_\r\n"))
+		return err
+	}
+	return w.WriteBulk(nil)
+}
+
+// writeMap writes a map of alternating keys and values. Maps are flat arrays
+// in RESP2.
+func (w *replyWriter) writeMap(pairs []interface{}) error {
+	if len(pairs)%2 != 0 {
+		return errors.New("map needs a value for every key")
+	}
+	if w.proto != resp3 {
+		return w.writeAggregate('*', '*', pairs)
+	}
+
+	w.Write([]byte{'%'})
+	w.Write([]byte(strconv.Itoa(len(pairs) / 2)))
+	w.Write([]byte("\r\n"))
+	for _, v := range pairs {
+		if err := w.writeValue(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAggregate writes the items with the RESP3 type, or the RESP2 type if
+// RESP3 was not negotiated
+func (w *replyWriter) writeAggregate(resp3Type byte, resp2Type byte, items []interface{}) error {
+	typ := resp2Type
+	if w.proto == resp3 {
+		typ = resp3Type
+	}
+
+	w.Write([]byte{typ})
+	w.Write([]byte(strconv.Itoa(len(items))))
+	w.Write([]byte("\r\n"))
+	for _, v := range items {
+		if err := w.writeValue(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeValue writes a single element of an aggregate
+func (w *replyWriter) writeValue(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		return w.writeNullBulk()
+	case []byte:
+		return w.WriteBulk(v)
+	case string:
+		return w.WriteBulkString(v)
+	case int:
+		return w.WriteInt(int64(v))
+	case int64:
+		return w.WriteInt(v)
+	case uint64:
+		return w.WriteInt(int64(v))
+	case []interface{}:
+		return w.writeAggregate('*', '*', v)
+	case respMap:
+		return w.writeMap(v)
+	default:
+		return errors.Errorf("unsupported reply value %T", v)
+	}
+}
+
+// respMap is a map of alternating keys and values in an aggregate
+type respMap []interface{}
+
+// deadLetterReply describes a dead letter with its metadata, as a map for
+// RESP3, and as the key, payload, ID and reason otherwise
+func deadLetterReply(proto int, letter DeadLetter) interface{} {
+	key := createKey(letter.Receiver, letter.Topic)
+	if proto != resp3 {
+		return []interface{}{key, letter.Payload, letter.ID, letter.Reason}
+	}
+	return respMap{
+		"key", key,
+		"id", letter.ID,
+		"receiver", letter.Receiver,
+		"topic", letter.Topic,
+		"payload", letter.Payload,
+		"reason", letter.Reason,
+		"time", letter.Time.Unix(),
+	}
+}
+
+// messageReply describes a message with its metadata, as a map for RESP3, and
+// as the key, payload and ID otherwise
+func messageReply(proto int, msg Message) interface{} {
+	if proto != resp3 {
+		return []interface{}{createKey(msg.Sender, msg.Topic), msg.Payload, msg.ID}
+	}
+	return respMap(messageMap(msg))
+}
+
+// messageMap describes a message with its metadata, for RESP3 replies
+func messageMap(msg Message) []interface{} {
+	pairs := []interface{}{
+		"key", createKey(msg.Sender, msg.Topic),
+		"id", msg.ID,
+		"sender", msg.Sender,
+		"topic", msg.Topic,
+		"payload", msg.Payload,
+	}
+	if msg.ReplyTo != "" {
+		pairs = append(pairs, "reply_to", msg.ReplyTo)
+	}
+	if msg.Deliveries > 0 {
+		pairs = append(pairs, "deliveries", msg.Deliveries)
+	}
+	return pairs
+}
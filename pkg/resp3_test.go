@@ -0,0 +1,314 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respConn is a raw connection to the server, which parses RESP3 replies
+type respConn struct {
+	t    testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// respError is an error reply
+type respError string
+
+// push is a push message
+type push []interface{}
+
+func (h *harness) respConn() *respConn {
+	conn, err := net.Dial("tcp", h.addr)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(func() { conn.Close() })
+
+	return &respConn{t: h.t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and reads the reply. Push messages received before the
+// reply are returned as well.
+func (c *respConn) do(args ...interface{}) interface{} {
+	c.send(args...)
+	return c.read()
+}
+
+func (c *respConn) send(args ...interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		s := fmt.Sprint(arg)
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(s), s)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read a single reply or push message
+func (c *respConn) read() interface{} {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	v, err := c.readValue()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return v
+}
+
+func (c *respConn) readValue() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	typ, rest := line[0], line[1:]
+
+	switch typ {
+	case '+':
+		return rest, nil
+	case '-':
+		return respError(rest), nil
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '_':
+		return nil, nil
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*', '>', '%':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		if typ == '%' {
+			n *= 2
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readValue(); err != nil {
+				return nil, err
+			}
+		}
+		switch typ {
+		case '>':
+			return push(items), nil
+		case '%':
+			m := make(map[string]interface{})
+			for i := 0; i < n; i += 2 {
+				m[items[i].(string)] = items[i+1]
+			}
+			return m, nil
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply type %q", typ)
+	}
+}
+
+func TestHello3(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	c := h.respConn()
+
+	reply := c.do("HELLO", 3, "AUTH", 1, h.store.sig(1), "SETNAME", "app")
+	expected := map[string]interface{}{
+		"server":  "tfagent",
+		"version": serverVersion,
+		"proto":   int64(3),
+		"id":      h.node.PeerID(),
+	}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Fatalf("expected HELLO reply %v, got %v", expected, reply)
+	}
+	clients := h.server.Clients()
+	if len(clients) != 1 || clients[0].Proto != resp3 || clients[0].Name != "app" || clients[0].Twin != 1 {
+		t.Errorf("unexpected client info %+v", clients)
+	}
+
+	// no message is a null, not a null array
+	if reply := c.do("LPOPMSG", "0:"); reply != nil {
+		t.Errorf("expected null, got %v", reply)
+	}
+	if reply := c.do("LPOS", "0:", "x"); reply != nil {
+		t.Errorf("expected null, got %v", reply)
+	}
+
+	h.deliver(Message{ID: "m1", Sender: 2, Receiver: 1, Topic: "chat", Payload: []byte("hello"), ReplyTo: "r1"})
+	reply = c.do("LPOPMSG", "2:chat")
+	expected = map[string]interface{}{
+		"key":      "2:chat",
+		"id":       "m1",
+		"sender":   int64(2),
+		"topic":    "chat",
+		"payload":  "hello",
+		"reply_to": "r1",
+	}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("expected message %v, got %v", expected, reply)
+	}
+
+	// back to RESP2
+	if reply, ok := c.do("HELLO", 2).([]interface{}); !ok || reply[5] != int64(2) {
+		t.Errorf("expected RESP2 HELLO reply, got %v", reply)
+	}
+	if reply := c.do("LPOPMSG", "0:"); reply != nil {
+		t.Errorf("expected null array, got %v", reply)
+	}
+}
+
+func TestHelloAuthFailed(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	c := h.respConn()
+
+	if reply := c.do("HELLO", 3, "AUTH", 1, h.store.sig(2)); reply != respError(errAuthorizationFailed.Error()) {
+		t.Errorf("expected authorization failure, got %v", reply)
+	}
+	// the protocol is not changed if HELLO fails
+	if reply := c.do("LLEN", "0:"); reply != respError(errNotAuthenticated.Error()) {
+		t.Errorf("expected not authenticated error, got %v", reply)
+	}
+	if clients := h.server.Clients(); len(clients) != 1 || clients[0].Proto != resp2 {
+		t.Errorf("unexpected client info %+v", clients)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	h := newHarness(t, 1)
+	ctx := context.Background()
+
+	// RESP2 subscriptions work like redis pub/sub
+	sub := h.client(1).Subscribe(ctx, "2:chat", "3:")
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h.deliver(msg(4, 1, "chat", "other"), msg(2, 1, "chat", "hello"), msg(3, 1, "news", "hi"))
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for _, expected := range []struct{ key, payload string }{{"2:chat", "hello"}, {"3:news", "hi"}} {
+		m, err := sub.ReceiveMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Channel != expected.key || m.Payload != expected.payload {
+			t.Errorf("expected %s on %s, got %+v", expected.payload, expected.key, m)
+		}
+	}
+
+	// messages which are not subscribed to stay in the mailbox
+	if n := h.client(1).LLen(ctx, "0:").Val(); n != 1 {
+		t.Errorf("expected 1 message in mailbox, got %d", n)
+	}
+}
+
+func TestSubscribeRESP2Restricted(t *testing.T) {
+	h := newHarness(t, 1)
+	c := h.respConn()
+
+	c.do("AUTH", 1, h.store.sig(1))
+	reply := c.do("SUBSCRIBE", "0:chat")
+	if !reflect.DeepEqual(reply, []interface{}{"subscribe", "0:chat", int64(1)}) {
+		t.Fatalf("unexpected subscribe reply %v", reply)
+	}
+	if reply := c.do("LLEN", "0:"); reply != respError(errSubscribed.Error()) {
+		t.Errorf("expected subscribed error, got %v", reply)
+	}
+	if reply := c.do("PING"); reply != "PONG" {
+		t.Errorf("expected PONG, got %v", reply)
+	}
+
+	reply = c.do("UNSUBSCRIBE")
+	if !reflect.DeepEqual(reply, []interface{}{"unsubscribe", "0:chat", int64(0)}) {
+		t.Fatalf("unexpected unsubscribe reply %v", reply)
+	}
+	if reply := c.do("LLEN", "0:"); reply != int64(0) {
+		t.Errorf("expected commands after unsubscribing, got %v", reply)
+	}
+}
+
+func TestSubscribeRESP3(t *testing.T) {
+	h := newHarness(t, 1)
+	c := h.respConn()
+
+	c.do("HELLO", 3, "AUTH", 1, h.store.sig(1))
+	reply := c.do("SUBSCRIBE", "0:chat", "2:")
+	if !reflect.DeepEqual(reply, push{"subscribe", "0:chat", int64(1)}) {
+		t.Fatalf("unexpected subscribe reply %v", reply)
+	}
+	if reply := c.read(); !reflect.DeepEqual(reply, push{"subscribe", "2:", int64(2)}) {
+		t.Fatalf("unexpected subscribe reply %v", reply)
+	}
+
+	// other commands can be used while subscribed
+	if reply := c.do("LLEN", "0:"); reply != int64(0) {
+		t.Errorf("expected empty mailbox, got %v", reply)
+	}
+
+	h.deliver(Message{ID: "m1", Sender: 3, Receiver: 1, Topic: "chat", Payload: []byte("hello")})
+	if reply := c.read(); !reflect.DeepEqual(reply, push{"message", "3:chat", "hello", "m1"}) {
+		t.Errorf("unexpected push message %v", reply)
+	}
+
+	reply = c.do("UNSUBSCRIBE", "0:chat")
+	if !reflect.DeepEqual(reply, push{"unsubscribe", "0:chat", int64(1)}) {
+		t.Fatalf("unexpected unsubscribe reply %v", reply)
+	}
+	h.deliver(msg(3, 1, "chat", "later"))
+	h.eventually(func() bool {
+		return c.do("LLEN", "3:chat") == int64(1)
+	}, "message after unsubscribing is not kept in the mailbox")
+}
+
+func TestSubscribeCallRESP3(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	ctx := context.Background()
+	c := h.respConn()
+
+	c.do("HELLO", 3, "AUTH", 1, h.store.sig(1))
+	if reply := c.do("SUBSCRIBE", "2:"); !reflect.DeepEqual(reply, push{"subscribe", "2:", int64(1)}) {
+		t.Fatalf("unexpected subscribe reply %v", reply)
+	}
+
+	// the reply to a call is not delivered to the subscription
+	c.send("CALL", "2:echo", "hello", 5)
+	c2 := h.client(2)
+	var request []interface{}
+	h.eventually(func() bool {
+		var err error
+		request, err = c2.Do(ctx, "LPOPMSG", "1:echo").Slice()
+		return err == nil
+	}, "request was not delivered")
+	if err := c2.Do(ctx, "REPLY", "1:echo", request[2], "re: hello").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, ok := c.read().(map[string]interface{})
+	if !ok || reply["payload"] != "re: hello" || reply["reply_to"] != request[2] {
+		t.Fatalf("unexpected CALL reply %v", reply)
+	}
+
+	// other messages are still delivered to the subscription
+	if err := c2.Do(ctx, "LPUSH", "1:chat", "hi").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if reply, ok := c.read().(push); !ok || len(reply) != 4 || reply[1] != "2:chat" || reply[2] != "hi" {
+		t.Errorf("unexpected push message %v", reply)
+	}
+}
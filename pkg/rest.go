@@ -0,0 +1,379 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfagent/pkg/keys"
+)
+
+const (
+	// maxRESTBody is the size of the largest payload sent over the REST API
+	maxRESTBody = 8 << 20
+	// maxRequestAge is how far the timestamp of a signed request can be off
+	maxRequestAge = 5 * time.Minute
+	// maxNonceLength is the length of the longest nonce of a signed request
+	maxNonceLength = 64
+	// maxLongPoll is the longest a request waits for a message
+	maxLongPoll = time.Minute
+	// bodyTooLarge is the error text of http.MaxBytesReader when the body
+	// is larger than its limit
+	bodyTooLarge = "http: request body too large"
+)
+
+// Headers describing the message returned by a GET request
+const (
+	headerMessageID      = "X-Message-Id"
+	headerMessageSender  = "X-Message-Sender"
+	headerMessageTopic   = "X-Message-Topic"
+	headerMessageReplyTo = "X-Message-Reply-To"
+)
+
+var (
+	errRequestUnsigned  = errors.New("request is not signed")
+	errRequestExpired   = errors.New("request timestamp is too far off")
+	errRequestNonce     = errors.New("request nonce is too long")
+	errRequestReplayed  = errors.New("request was already handled")
+	errRequestSignature = errors.New("invalid request signature")
+	errInvalidWait      = errors.New("wait is not a duration, or longer than a minute")
+)
+
+// RESTConfig configures the REST gateway of an agent
+type RESTConfig struct {
+	// Address to listen on, e.g. :8891
+	Address string
+	// TLS served on the listener, if set
+	TLS *TLSConfig
+}
+
+// RESTServer lets twins send and receive messages over http. Every request
+// is signed with the key of the twin, see keys.RequestMessage, and handled
+// with the same semantics as the RESP commands.
+//
+// The dtid in the path is the receiver of messages which are sent, and the
+// sender of messages which are received, like the keys of the RESP commands.
+// Topics are optional when receiving, and 0 matches all senders.
+//
+//	POST /twins/{dtid}/topics/{topic}          send the body as payload
+//	GET  /twins/{dtid}[/topics/{topic}]        pop the oldest message
+//	GET  /twins/{dtid}[/topics/{topic}]/length number of messages
+//
+// GET requests pop a message, unless ?peek=true is set. With ?wait=30s they
+// wait for a message to arrive. The message is returned as body, with its
+// metadata in the X-Message-* headers. 204 is returned if there is none.
+type RESTServer struct {
+	server  *Server
+	store   PeerStore
+	replays *replayCache
+
+	ln  net.Listener
+	srv *http.Server
+
+	ctx context.Context
+	log Log
+}
+
+func newRESTServer(ctx context.Context, server *Server, store PeerStore, cfg RESTConfig, log Log) (*RESTServer, error) {
+	ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", cfg.Address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create REST listener")
+	}
+	if cfg.TLS != nil {
+		certs, err := server.certs.certs(*cfg.TLS, log)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, certs.config())
+		log.WithField("addr", cfg.Address).WithField("fingerprint", certs.fingerprint()).Info("TLS enabled")
+	}
+
+	rs := &RESTServer{
+		server:  server,
+		store:   store,
+		replays: newReplayCache(),
+		ln:      ln,
+		ctx:     ctx,
+		log:     log,
+	}
+	rs.srv = &http.Server{
+		Handler:           rs.router(),
+		ReadHeaderTimeout: 10 * time.Second,
+		// long polling requests wait before writing
+		WriteTimeout: maxLongPoll + 10*time.Second,
+	}
+
+	return rs, nil
+}
+
+// Run the REST server until the context is done
+func (rs *RESTServer) Run() error {
+	go func() {
+		<-rs.ctx.Done()
+		rs.srv.Close()
+	}()
+
+	err := rs.srv.Serve(rs.ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return errors.Wrap(err, "REST server failed")
+}
+
+// Close the REST server
+func (rs *RESTServer) Close() error {
+	return errors.Wrap(rs.srv.Close(), "failed to close REST server")
+}
+
+func (rs *RESTServer) router() http.Handler {
+	r := mux.NewRouter()
+	r.Use(rs.authenticate)
+
+	r.HandleFunc("/twins/{dtid:[0-9]+}/topics/{topic}", rs.send).Methods(http.MethodPost)
+	r.HandleFunc("/twins/{dtid:[0-9]+}/topics/{topic}", rs.receive).Methods(http.MethodGet)
+	r.HandleFunc("/twins/{dtid:[0-9]+}", rs.receive).Methods(http.MethodGet)
+	r.HandleFunc("/twins/{dtid:[0-9]+}/topics/{topic}/length", rs.length).Methods(http.MethodGet)
+	r.HandleFunc("/twins/{dtid:[0-9]+}/length", rs.length).Methods(http.MethodGet)
+
+	return r
+}
+
+type restTwinKey struct{}
+
+// authenticate requests with the signature of the twin. The body is read to
+// verify the signature, and the authenticated twin is stored in the request
+// context.
+func (rs *RESTServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the headers are checked before the body is read, so requests which
+		// can't be authenticated don't get to send a large body
+		signed, err := rs.signature(r)
+		if err != nil {
+			rs.server.metrics.authFailed()
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRESTBody))
+		if err != nil {
+			status := http.StatusBadRequest
+			// the error of http.MaxBytesReader has no type to check for
+			if err.Error() == bodyTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			writeError(w, status, errors.Wrap(err, "could not read body"))
+			return
+		}
+
+		if err = rs.verify(r, signed, body); err != nil {
+			rs.server.metrics.authFailed()
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), restTwinKey{}, signed.dtid)))
+	})
+}
+
+// signedRequest holds the signature headers of a request
+type signedRequest struct {
+	dtid      uint64
+	timestamp int64
+	nonce     string
+	sig       []byte
+	key       TwinKey
+}
+
+// signature checks the signature headers of the request, and loads the key of
+// the twin which signed it
+func (rs *RESTServer) signature(r *http.Request) (signedRequest, error) {
+	rawTwin, rawTimestamp, rawSig := r.Header.Get(keys.HeaderTwin), r.Header.Get(keys.HeaderTimestamp), r.Header.Get(keys.HeaderSignature)
+	nonce := r.Header.Get(keys.HeaderNonce)
+	if rawTwin == "" || rawTimestamp == "" || rawSig == "" || nonce == "" {
+		return signedRequest{}, errRequestUnsigned
+	}
+	if len(nonce) > maxNonceLength {
+		return signedRequest{}, errRequestNonce
+	}
+
+	dtid, err := strconv.ParseUint(rawTwin, 10, 64)
+	if err != nil {
+		return signedRequest{}, errors.Wrap(err, "invalid twin")
+	}
+	timestamp, err := strconv.ParseInt(rawTimestamp, 10, 64)
+	if err != nil {
+		return signedRequest{}, errors.Wrap(err, "invalid timestamp")
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > maxRequestAge || age < -maxRequestAge {
+		return signedRequest{}, errRequestExpired
+	}
+	sig, err := hex.DecodeString(rawSig)
+	if err != nil || len(sig) != SignatureSize {
+		return signedRequest{}, errInvalidSignatureLength
+	}
+
+	pk, err := rs.store.PublicKey(dtid)
+	if err != nil {
+		return signedRequest{}, errors.Wrap(err, "could not get public key of twin")
+	}
+
+	return signedRequest{dtid: dtid, timestamp: timestamp, nonce: nonce, sig: sig, key: pk}, nil
+}
+
+// verify the signature of the request with its body
+func (rs *RESTServer) verify(r *http.Request, signed signedRequest, body []byte) error {
+	if !signed.key.Verify(keys.RequestMessage(r.Method, r.RequestURI, signed.timestamp, signed.nonce, body), signed.sig) {
+		return errRequestSignature
+	}
+
+	// nonces are chosen by the twin, so they are only unique per twin
+	nonce := strconv.FormatUint(signed.dtid, 10) + ":" + signed.nonce
+	if !rs.replays.add(nonce, time.Unix(signed.timestamp, 0).Add(maxRequestAge)) {
+		return errRequestReplayed
+	}
+
+	return nil
+}
+
+// conn of the twin which signed the request
+func (rs *RESTServer) conn(r *http.Request) connection {
+	return newAuthenticatedConn(r.Context().Value(restTwinKey{}).(uint64), rs.server)
+}
+
+// mailboxKey of the request path. Topics can't contain the separator of RESP
+// keys.
+func mailboxKeyOf(r *http.Request) (mailboxKey, error) {
+	vars := mux.Vars(r)
+	dtid, err := strconv.ParseUint(vars["dtid"], 10, 64)
+	if err != nil {
+		return mailboxKey{}, errors.Wrap(err, "could not parse dtid")
+	}
+	if strings.Contains(vars["topic"], keySeparator) {
+		return mailboxKey{}, errMalformedKey
+	}
+	return mailboxKey{dtid: dtid, subject: vars["topic"]}, nil
+}
+
+func (rs *RESTServer) send(w http.ResponseWriter, r *http.Request) {
+	key, err := mailboxKeyOf(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	payload, _ := ioutil.ReadAll(r.Body)
+
+	id, err := rs.conn(r).LPush(key.dtid, key.subject, payload)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+}
+
+func (rs *RESTServer) receive(w http.ResponseWriter, r *http.Request) {
+	key, err := mailboxKeyOf(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var wait time.Duration
+	if raw := r.URL.Query().Get("wait"); raw != "" {
+		if wait, err = time.ParseDuration(raw); err != nil || wait < 0 || wait > maxLongPoll {
+			writeError(w, http.StatusBadRequest, errInvalidWait)
+			return
+		}
+	}
+	peek := r.URL.Query().Get("peek") == "true"
+
+	// the request is done if the client goes away while waiting
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	c, keys := rs.conn(r), []mailboxKey{key}
+	var msg Message
+	if peek {
+		msg, err = c.Peek(ctx, keys)
+	} else {
+		msg, err = c.Next(ctx, keys)
+	}
+	if errors.Is(err, errNoMessage) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(headerMessageID, msg.ID)
+	w.Header().Set(headerMessageSender, strconv.FormatUint(msg.Sender, 10))
+	w.Header().Set(headerMessageTopic, msg.Topic)
+	if msg.ReplyTo != "" {
+		w.Header().Set(headerMessageReplyTo, msg.ReplyTo)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(msg.Payload)
+}
+
+func (rs *RESTServer) length(w http.ResponseWriter, r *http.Request) {
+	key, err := mailboxKeyOf(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	n, err := rs.conn(r).LLen(key.dtid, key.subject)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint64{"length": n})
+}
+
+// replayCache remembers the nonces of handled requests until their timestamp
+// expires, so a signed request can only be handled once
+type replayCache struct {
+	seen map[string]time.Time
+	// nextPrune is when expired nonces are removed next
+	nextPrune time.Time
+	lock      sync.Mutex
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]time.Time)}
+}
+
+// add the nonce, returns false if it was already seen
+func (rc *replayCache) add(nonce string, expires time.Time) bool {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	now := time.Now()
+	if now.After(rc.nextPrune) {
+		for s, exp := range rc.seen {
+			if now.After(exp) {
+				delete(rc.seen, s)
+			}
+		}
+		rc.nextPrune = now.Add(time.Minute)
+	}
+
+	if _, ok := rc.seen[nonce]; ok {
+		return false
+	}
+	rc.seen[nonce] = expires
+	return true
+}
@@ -0,0 +1,244 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/threefoldtech/tfagent/pkg/keys"
+)
+
+// restHarness serves the REST gateway on the broker of the harness
+type restHarness struct {
+	*harness
+	url string
+}
+
+func newRESTHarness(t *testing.T, dtids ...uint64) *restHarness {
+	h := newHarness(t, dtids...)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	rs, err := newRESTServer(ctx, h.server, h.store, RESTConfig{Address: "127.0.0.1:0"}, &NOOPLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rs.Run()
+
+	return &restHarness{harness: h, url: "http://" + rs.ln.Addr().String()}
+}
+
+// request signed by the twin at the given time, with a new nonce
+func (h *restHarness) request(dtid uint64, at time.Time, method string, uri string, body string) *http.Request {
+	req, err := http.NewRequest(method, h.url+uri, bytes.NewBufferString(body))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	nonce := uuid.New().String()
+	h.store.lock.Lock()
+	sig, err := h.store.keys[dtid].Sign(keys.RequestMessage(method, uri, at.Unix(), nonce, []byte(body)))
+	h.store.lock.Unlock()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	req.Header.Set(keys.HeaderTwin, strconv.FormatUint(dtid, 10))
+	req.Header.Set(keys.HeaderTimestamp, strconv.FormatInt(at.Unix(), 10))
+	req.Header.Set(keys.HeaderNonce, nonce)
+	req.Header.Set(keys.HeaderSignature, hex.EncodeToString(sig))
+	return req
+}
+
+// do the request, and return the status and body of the response
+func (h *restHarness) do(req *http.Request) (int, string, http.Header) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return resp.StatusCode, string(body), resp.Header
+}
+
+func TestRESTSendReceive(t *testing.T) {
+	h := newRESTHarness(t, 1, 2)
+	now := time.Now()
+
+	status, body, _ := h.do(h.request(1, now, http.MethodPost, "/twins/2/topics/chat", "hello"))
+	var sent struct{ ID string }
+	if err := json.Unmarshal([]byte(body), &sent); status != http.StatusCreated || err != nil || sent.ID == "" {
+		t.Fatalf("expected message to be sent, got %d %s", status, body)
+	}
+
+	var length struct{ Length uint64 }
+	h.eventually(func() bool {
+		status, body, _ := h.do(h.request(2, time.Now(), http.MethodGet, "/twins/1/topics/chat/length", ""))
+		return status == http.StatusOK && json.Unmarshal([]byte(body), &length) == nil && length.Length == 1
+	}, "message was not delivered")
+
+	// peeking leaves the message in the mailbox
+	for _, uri := range []string{"/twins/1/topics/chat?peek=true", "/twins/0?peek=true", "/twins/1"} {
+		status, body, header := h.do(h.request(2, now, http.MethodGet, uri, ""))
+		if status != http.StatusOK || body != "hello" {
+			t.Fatalf("expected message from %s, got %d %s", uri, status, body)
+		}
+		if header.Get(headerMessageID) != sent.ID || header.Get(headerMessageSender) != "1" || header.Get(headerMessageTopic) != "chat" {
+			t.Errorf("unexpected message headers %v", header)
+		}
+	}
+
+	status, body, _ = h.do(h.request(2, now, http.MethodGet, "/twins/1/length", ""))
+	if status != http.StatusOK || body != `{"length":0}`+"\n" {
+		t.Errorf("expected empty mailbox, got %d %s", status, body)
+	}
+	if status, _, _ := h.do(h.request(2, now, http.MethodGet, "/twins/0", "")); status != http.StatusNoContent {
+		t.Errorf("expected no message, got %d", status)
+	}
+}
+
+func TestRESTLongPoll(t *testing.T) {
+	h := newRESTHarness(t, 1)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		h.deliver(msg(2, 1, "chat", "hello"))
+	}()
+	start := time.Now()
+	status, body, _ := h.do(h.request(1, start, http.MethodGet, "/twins/2/topics/chat?wait=5s", ""))
+	if status != http.StatusOK || body != "hello" {
+		t.Errorf("expected to wait for the message, got %d %s", status, body)
+	}
+
+	status, _, _ = h.do(h.request(1, time.Now(), http.MethodGet, "/twins/2?wait=100ms", ""))
+	if status != http.StatusNoContent {
+		t.Errorf("expected no message after waiting, got %d", status)
+	}
+	if status, _, _ := h.do(h.request(1, time.Now(), http.MethodGet, "/twins/2?wait=1h", "")); status != http.StatusBadRequest {
+		t.Errorf("expected wait longer than a minute to be rejected, got %d", status)
+	}
+}
+
+func TestRESTAuthentication(t *testing.T) {
+	h := newRESTHarness(t, 1, 2)
+	now := time.Now()
+
+	unsigned, err := http.NewRequest(http.MethodGet, h.url+"/twins/0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := h.request(1, now, http.MethodPost, "/twins/2/topics/chat", "hello")
+	tampered.Body = ioutil.NopCloser(bytes.NewBufferString("bye"))
+	tampered.ContentLength = 3
+	impersonated := h.request(1, now, http.MethodGet, "/twins/0", "")
+	impersonated.Header.Set(keys.HeaderTwin, "2")
+	otherPath := h.request(1, now, http.MethodGet, "/twins/0", "")
+	otherPath.URL.Path = "/twins/2"
+	unknown := h.request(1, now, http.MethodGet, "/twins/0", "")
+	unknown.Header.Set(keys.HeaderTwin, "3")
+	noNonce := h.request(1, now, http.MethodGet, "/twins/0", "")
+	noNonce.Header.Del(keys.HeaderNonce)
+	otherNonce := h.request(1, now, http.MethodGet, "/twins/0", "")
+	otherNonce.Header.Set(keys.HeaderNonce, "other")
+	longNonce := h.request(1, now, http.MethodGet, "/twins/0", "")
+	longNonce.Header.Set(keys.HeaderNonce, strings.Repeat("n", maxNonceLength+1))
+
+	for name, req := range map[string]*http.Request{
+		"unsigned":     unsigned,
+		"tampered":     tampered,
+		"impersonated": impersonated,
+		"other path":   otherPath,
+		"expired":      h.request(1, now.Add(-maxRequestAge-time.Minute), http.MethodGet, "/twins/0", ""),
+		"future":       h.request(1, now.Add(maxRequestAge+time.Minute), http.MethodGet, "/twins/0", ""),
+		"unknown twin": unknown,
+		"no nonce":     noNonce,
+		"other nonce":  otherNonce,
+		"long nonce":   longNonce,
+	} {
+		if status, body, _ := h.do(req); status != http.StatusUnauthorized {
+			t.Errorf("expected %s request to be rejected, got %d %s", name, status, body)
+		}
+	}
+
+	// signed requests are handled once
+	req := h.request(1, now, http.MethodGet, "/twins/0", "")
+	replay := req.Clone(context.Background())
+	if status, _, _ := h.do(req); status != http.StatusNoContent {
+		t.Fatalf("expected signed request to be handled, got %d", status)
+	}
+	if status, body, _ := h.do(replay); status != http.StatusUnauthorized {
+		t.Errorf("expected replayed request to be rejected, got %d %s", status, body)
+	}
+
+	// identical requests in the same second are told apart by their nonce
+	for i := 0; i < 2; i++ {
+		if status, body, _ := h.do(h.request(1, now, http.MethodGet, "/twins/0", "")); status != http.StatusNoContent {
+			t.Errorf("expected identical request %d to be handled, got %d %s", i, status, body)
+		}
+	}
+}
+
+func TestRESTBody(t *testing.T) {
+	h := newRESTHarness(t, 1, 2)
+	large := strings.Repeat("a", maxRESTBody+1)
+
+	// requests which can't be authenticated are rejected before their body is
+	// read
+	unsigned, err := http.NewRequest(http.MethodPost, h.url+"/twins/2/topics/chat", strings.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body, _ := h.do(unsigned); status != http.StatusUnauthorized {
+		t.Errorf("expected unsigned request to be rejected, got %d %s", status, body)
+	}
+
+	if status, body, _ := h.do(h.request(1, time.Now(), http.MethodPost, "/twins/2/topics/chat", large)); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected large body to be rejected, got %d %s", status, body)
+	}
+
+	// a body shorter than its length is not too large
+	req := h.request(1, time.Now(), http.MethodPost, "/twins/2/topics/other", "hello")
+	conn, err := net.Dial("tcp", strings.TrimPrefix(h.url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /twins/2/topics/other HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n")
+	for _, name := range []string{keys.HeaderTwin, keys.HeaderTimestamp, keys.HeaderNonce, keys.HeaderSignature} {
+		fmt.Fprintf(conn, "%s: %s\r\n", name, req.Header.Get(name))
+	}
+	fmt.Fprint(conn, "\r\nhello")
+	conn.(*net.TCPConn).CloseWrite()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected truncated body to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestRESTMalformedTopic(t *testing.T) {
+	h := newRESTHarness(t, 1)
+
+	status, _, _ := h.do(h.request(1, time.Now(), http.MethodPost, "/twins/2/topics/a:b", "hello"))
+	if status != http.StatusBadRequest {
+		t.Errorf("expected topic with separator to be rejected, got %d", status)
+	}
+}
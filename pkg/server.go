@@ -2,14 +2,16 @@ package pkg
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog/log"
 	"github.com/secmask/go-redisproto"
 )
 
@@ -17,10 +19,23 @@ const keySeparator = ":"
 
 // Server accepting connections, running RESP with custom commands
 type Server struct {
+	// stats are updated atomically, so they are 64-bit aligned as the first
+	// field
+	stats connStats
+
 	ps   PeerStore
 	node *BufferedNode
 
-	ln net.Listener
+	// listeners of the server, the first one is bound to the port
+	listeners []*listener
+
+	clients clients
+	limits  Limits
+	// certs of the TLS listeners, shared with the REST gateway
+	certs tlsCache
+
+	metrics *Metrics
+	log     Log
 
 	ctx context.Context
 }
@@ -29,27 +44,74 @@ type Server struct {
 // yet accept incomming connections
 func NewServer(ctx context.Context, port uint16, ps PeerStore, node *BufferedNode) (*Server, error) {
 	s := &Server{
-		ps:   ps,
-		ctx:  ctx,
-		node: node,
+		ps:     ps,
+		ctx:    ctx,
+		node:   node,
+		limits: DefaultLimits(),
+		log:    DefaultLogger(),
 	}
 
-	// create a default listenerconfig so we can pass the context
-	listener, err := (&net.ListenConfig{}).Listen(ctx, "tcp", fmt.Sprintf(":%d", port))
+	if err := s.Listen(ListenerConfig{Address: fmt.Sprintf(":%d", port)}); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Listen binds an additional listener. It must be called before the server is
+// run.
+func (s *Server) Listen(cfg ListenerConfig) error {
+	l, err := newListener(s.ctx, cfg, &s.certs, s.log)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create tcp listener")
+		return err
 	}
 
-	// TODO: tls stuff if needed
+	s.listeners = append(s.listeners, l)
+	return nil
+}
 
-	s.ln = listener
+// EnableTLS serves TLS on the listener bound to the port. It must be called
+// before the server is run.
+func (s *Server) EnableTLS(cfg TLSConfig) error {
+	return s.listeners[0].enableTLS(cfg, &s.certs, s.log)
+}
 
-	return s, nil
+// SetLimits replaces the DefaultLimits of the connections. It must be called
+// before the server is run.
+func (s *Server) SetLimits(limits Limits) {
+	s.limits = limits
+}
+
+// ConnectionStats of the server
+func (s *Server) ConnectionStats() ConnectionStats {
+	return s.stats.snapshot()
 }
 
 // Run the server until the context is done, or an error is encountered while
-// accepting the connection. A new goroutine is spawned per new connection.
+// accepting a connection on one of the listeners. A new goroutine is spawned
+// per new connection.
 func (s *Server) Run() error {
+	errs := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		go func(l *listener) { errs <- s.accept(l) }(l)
+	}
+
+	err := <-errs
+	if err != nil {
+		// stop the other listeners, their errors are caused by closing them
+		for _, l := range s.listeners {
+			l.Close()
+		}
+	}
+	for i := 1; i < len(s.listeners); i++ {
+		<-errs
+	}
+
+	return err
+}
+
+// accept connections on the listener until the context is done
+func (s *Server) accept(l *listener) error {
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -58,7 +120,7 @@ func (s *Server) Run() error {
 
 		}
 
-		con, err := s.ln.Accept()
+		con, err := l.Accept()
 		if err != nil {
 			// context is done
 			if s.ctx.Err() != nil {
@@ -70,81 +132,310 @@ func (s *Server) Run() error {
 
 		go func() {
 			defer con.Close()
-			s.handleCon(con)
+			s.handleCon(con, l)
 		}()
 	}
 }
 
 // Close the server and its connections
 func (s *Server) Close() error {
-	return errors.Wrap(s.ln.Close(), "failed to close listener")
+	var err error
+	for _, l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.clients.closeAll()
+	return errors.Wrap(err, "failed to close listener")
+}
+
+// Addr the server is listening on with the listener bound to the port
+func (s *Server) Addr() net.Addr {
+	return s.listeners[0].Addr()
+}
+
+// Addrs of all listeners of the server
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// SetLogger implements LogSetter. It must be called before the component is
+// started.
+func (s *Server) SetLogger(log Log) {
+	s.log = log
 }
 
-func (s *Server) handleCon(conn net.Conn) {
-	parser := redisproto.NewParser(conn)
-	// writer := redisproto.NewWriter(bufio.NewWriter(conn))
-	writer := redisproto.NewWriter(conn)
+// Clients currently connected to the server
+func (s *Server) Clients() []ClientInfo {
+	return s.clients.list()
+}
+
+func (s *Server) handleCon(conn net.Conn, l *listener) {
+	logger := s.log.WithField("remote", remoteAddr(conn))
+
+	info, err := s.clients.add(conn, l.cfg.Address, s.limits)
+	if err != nil {
+		s.stats.rejected(err)
+		logger.WithField("reason", err).Warn("rejected connection")
+		// like redis, tell the client why it is disconnected. TLS clients are
+		// just disconnected, as this would need a handshake first.
+		if _, ok := conn.(*tls.Conn); !ok {
+			writer := newReplyWriter(conn, s.limits.WriteTimeout)
+			writer.WriteError(err.Error())
+			writer.flush()
+			writer.release()
+		}
+		return
+	}
+	defer s.clients.remove(info)
+	atomic.AddUint64(&s.stats.accepted, 1)
+
+	// the TLS handshake and authentication must complete before the deadline
+	var authDeadline time.Time
+	if s.limits.AuthTimeout > 0 && l.cfg.Twin == 0 {
+		authDeadline = time.Now().Add(s.limits.AuthTimeout)
+	}
+
+	// complete the handshake before reading commands, so failed handshakes
+	// are not reported as read errors
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(authDeadline)
+		if err := tc.Handshake(); err != nil {
+			if isTimeout(err) {
+				atomic.AddUint64(&s.stats.authTimeouts, 1)
+			}
+			logger.WithField("error", err).Debug("TLS handshake failed")
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	// read the connection in the background, so blocking commands and
+	// subscriptions stop once the client is gone
+	reader := newConnReader(s.ctx, conn)
+	defer reader.Close()
+
+	parser := redisproto.NewParser(reader)
+	writer := newReplyWriter(conn, s.limits.WriteTimeout)
+	defer writer.release()
 
 	var c connection = newUnauthenticatedConn(s)
 
+	// connections of a trusted listener don't need to AUTH
+	if l.cfg.Twin != 0 {
+		c = newAuthenticatedConn(l.cfg.Twin, s)
+		info.authenticated(l.cfg.Twin)
+		logger = logger.WithField("dtid", l.cfg.Twin)
+	}
+
+	subs := newSubscriptions(writer.conn, logger)
+	defer subs.stop()
+
+	// the parser panics on some malformed input, don't take the whole server
+	// down because of a single client
+	defer func() {
+		if r := recover(); r != nil {
+			logger.WithField("panic", r).Error("recovered from panic while handling connection")
+		}
+	}()
+
 	for {
+		authenticated := info.snapshot().Twin != 0
+		conn.SetReadDeadline(s.readDeadline(authenticated, authDeadline, subs.count() > 0))
+
 		// Don't use the `Commands()` channel here, as that exits on any error,
 		// including protocol errors
 		command, err := parser.ReadCommand()
 		if err != nil {
-			if errors.Is(err, &redisproto.ProtocolError{}) {
+			// a failed push closes the connection
+			if werr := writer.conn.failure(); werr != nil {
+				if isTimeout(werr) {
+					atomic.AddUint64(&s.stats.writeTimeouts, 1)
+				}
+				logger.WithField("error", werr).Error("could not write to connection")
+				return
+			}
+			if isTimeout(err) {
+				if authenticated {
+					atomic.AddUint64(&s.stats.idleTimeouts, 1)
+					logger.Debug("closing idle connection")
+				} else {
+					atomic.AddUint64(&s.stats.authTimeouts, 1)
+					logger.Debug("closing connection which did not authenticate in time")
+				}
+				return
+			}
+			var perr *redisproto.ProtocolError
+			if errors.As(err, &perr) {
+				// the parser can't recover from a protocol error, so report it
+				// to the client and close the connection, like redis does
+				logger.WithField("error", err).Debug("client protocol error")
 				writer.WriteError(err.Error())
-				continue
+				writer.flush()
+				return
 			}
 			if errors.Is(err, io.EOF) {
-				log.Debug().Msg("client closed connection")
+				logger.Debug("client closed connection")
 				return
 			}
-			log.Error().Err(err).Msg("failed to read command")
+			if s.clients.isClosed() {
+				logger.Debug("connection closed by server")
+				return
+			}
+			logger.WithField("error", err).Error("failed to read command")
 			return
 		}
 
+		// null arrays are parsed as a nil command, and don't tell if more
+		// commands are buffered
+		if command == nil {
+			if err = writer.flush(); err != nil {
+				logger.WithField("error", err).Error("could not write to connection")
+				return
+			}
+			continue
+		}
+
 		cmd := strings.ToUpper(string(command.Get(0)))
+		info.command(cmd)
+		start := time.Now()
+		writer.failed = false
+		if writer.proto == resp2 && subs.count() > 0 && !subscribedCommands[cmd] {
+			cmd = "SUBSCRIBED"
+		}
 		switch cmd {
+		case "SUBSCRIBED":
+			err = writer.WriteError(errSubscribed.Error())
 		case "PING":
-			log.Debug().Msg("client PING command")
+			logger.Debug("client PING command")
 			err = writer.WriteSimpleString("PONG")
 		case "HELLO":
-			log.Debug().Msg("client HELLO command")
-			if command.ArgCount() != 1 {
-				err = writer.WriteError(errInvalidArgCount.Error())
+			logger.Debug("client HELLO command")
+			// HELLO [protover [AUTH dtid signature] [SETNAME name]]
+			proto := writer.proto
+			if command.ArgCount() > 1 {
+				proto, err = strconv.Atoi(string(command.Get(1)))
+				if err != nil || (proto != resp2 && proto != resp3) {
+					err = writer.WriteError(errNoProto.Error())
+					break
+				}
+			}
+
+			var authArgs [][]byte
+			var name string
+			for i := 2; i < command.ArgCount() && err == nil; {
+				switch opt := strings.ToUpper(string(command.Get(i))); {
+				case opt == "AUTH" && i+2 < command.ArgCount():
+					authArgs = [][]byte{command.Get(i + 1), command.Get(i + 2)}
+					i += 3
+				case opt == "SETNAME" && i+1 < command.ArgCount():
+					name = string(command.Get(i + 1))
+					i += 2
+				default:
+					err = errSyntax
+				}
+			}
+			if err != nil {
+				err = writer.WriteError(err.Error())
 				break
 			}
-			err = writer.WriteObjectsSlice(s.helloInfo())
+
+			if authArgs != nil {
+				var dtid uint64
+				c, dtid, err = s.authenticate(c, info, authArgs[0], authArgs[1])
+				if err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+				logger = logger.WithField("dtid", dtid)
+			}
+
+			writer.setProto(proto)
+			info.hello(proto, name)
+			err = writer.writeMap(s.helloInfo(proto))
 		case "AUTH":
-			log.Debug().Msg("client AUTH command")
+			logger.Debug("client AUTH command")
 			if command.ArgCount() != 3 {
 				err = writer.WriteError(errInvalidArgCount.Error())
 				break
 			}
 
-			// first arg is the dtid
-			var dtid uint64 // declare here so we don't shadow err below
-			dtid, err = strconv.ParseUint(string(command.Get(1)), 10, 64)
+			var dtid uint64
+			c, dtid, err = s.authenticate(c, info, command.Get(1), command.Get(2))
 			if err != nil {
 				err = writer.WriteError(err.Error())
 				break
 			}
 
-			// second arg is the signature.
-			rawSig := command.Get(2)
+			logger = logger.WithField("dtid", dtid)
+			err = writer.WriteSimpleString("Authenticated")
+		case "SUBSCRIBE":
+			logger.Debug("client SUBSCRIBE command")
+			// SUBSCRIBE key [key ...]
+			if command.ArgCount() < 2 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+			if info.snapshot().Twin == 0 {
+				err = writer.WriteError(errNotAuthenticated.Error())
+				break
+			}
 
-			if err = c.Auth(dtid, rawSig); err != nil {
+			keys := make([]string, 0, command.ArgCount()-1)
+			for i := 1; i < command.ArgCount() && err == nil; i++ {
+				keys = append(keys, string(command.Get(i)))
+				_, _, err = parseKey(keys[len(keys)-1])
+			}
+			if err != nil {
 				err = writer.WriteError(err.Error())
 				break
 			}
 
-			// upgrade connection
-			c = newAuthenticatedConn(dtid, s)
-			err = writer.WriteSimpleString("Authenticated")
+			subs.stop()
+			for _, key := range keys {
+				subs.add(key)
+				if err = writer.writeAggregate('>', '*', []interface{}{"subscribe", key, subs.count()}); err != nil {
+					break
+				}
+			}
+			// confirm the subscriptions before messages are delivered
+			if err == nil {
+				err = writer.flush()
+			}
+			subs.start(reader.ctx, c)
+		case "UNSUBSCRIBE":
+			logger.Debug("client UNSUBSCRIBE command")
+			// UNSUBSCRIBE [key ...], all keys if none are given
+			keys := make([]string, 0, command.ArgCount()-1)
+			for i := 1; i < command.ArgCount(); i++ {
+				keys = append(keys, string(command.Get(i)))
+			}
 
-		case "LPUSH":
-			log.Debug().Msg("client LPUSH command")
+			subs.stop()
+			if len(keys) == 0 {
+				keys = append(keys, subs.keys...)
+			}
+			if len(keys) == 0 {
+				err = writer.writeAggregate('>', '*', []interface{}{"unsubscribe", nil, 0})
+			}
+			for _, key := range keys {
+				subs.remove(key)
+				if err = writer.writeAggregate('>', '*', []interface{}{"unsubscribe", key, subs.count()}); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = writer.flush()
+			}
+			subs.start(reader.ctx, c)
+		case "LPUSH", "RPUSH", "LPUSHID", "RPUSHID":
+			if debugEnabled(logger) {
+				logger.WithField("CMD", cmd).Debug("client push command")
+			}
 			if command.ArgCount() != 3 {
 				err = writer.WriteError(errInvalidArgCount.Error())
 				break
@@ -158,14 +449,59 @@ func (s *Server) handleCon(conn net.Conn) {
 				break
 			}
 
-			if err = c.LPush(dtid, subject, command.Get(2)); err != nil {
+			var id string
+			if strings.HasPrefix(cmd, "L") {
+				id, err = c.LPush(dtid, subject, command.Get(2))
+			} else {
+				id, err = c.RPush(dtid, subject, command.Get(2))
+			}
+			if err != nil {
 				err = writer.WriteError(err.Error())
 				break
 			}
 
+			// LPUSHID and RPUSHID reply with the ID of the message, so it can
+			// be traced, while LPUSH and RPUSH keep replying OK for existing clients.
+			if strings.HasSuffix(cmd, "ID") {
+				err = writer.WriteSimpleString(id)
+				break
+			}
 			err = writer.WriteSimpleString("OK")
-		case "LPOP":
-			log.Debug().Msg("client LPOP command")
+		case "LPOP", "RPOP":
+			if debugEnabled(logger) {
+				logger.WithField("CMD", cmd).Debug("client pop command")
+			}
+			if command.ArgCount() != 2 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			var dtid uint64
+			var subject string
+			dtid, subject, err = parseKey(string(command.Get(1)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			var msg Message
+			if cmd == "LPOP" {
+				msg, err = c.LPop(dtid, subject)
+			} else {
+				msg, err = c.RPop(dtid, subject)
+			}
+			if err != nil {
+				if errors.Is(err, errNoMessage) {
+					err = writer.writeNull()
+					break
+				}
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			err = writer.WriteObjectsSlice([]interface{}{createKey(msg.Sender, msg.Topic), msg.Payload})
+		case "LPOPMSG":
+			logger.Debug("client LPOPMSG command")
 			if command.ArgCount() != 2 {
 				err = writer.WriteError(errInvalidArgCount.Error())
 				break
@@ -180,19 +516,170 @@ func (s *Server) handleCon(conn net.Conn) {
 			}
 
 			var msg Message
-			msg, err = c.LPop(dtid, subject)
+			msg, err = c.LPopMsg(dtid, subject)
+			if err != nil {
+				if errors.Is(err, errNoMessage) {
+					err = writer.writeNull()
+					break
+				}
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			if writer.proto == resp3 {
+				err = writer.writeMap(messageMap(msg))
+				break
+			}
+			err = writer.WriteObjectsSlice([]interface{}{createKey(msg.Sender, msg.Topic), msg.Payload, msg.ID})
+		case "LEASE":
+			logger.Debug("client LEASE command")
+			// LEASE key timeout
+			if command.ArgCount() != 3 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			var dtid uint64
+			var subject string
+			dtid, subject, err = parseKey(string(command.Get(1)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			// the timeout is in seconds, as for CALL
+			var timeout float64
+			timeout, err = strconv.ParseFloat(string(command.Get(2)), 64)
+			if err != nil {
+				err = writer.WriteError(errInvalidTimeout.Error())
+				break
+			}
+			if timeout < 0 {
+				err = writer.WriteError(errNegativeArg.Error())
+				break
+			}
+
+			var msg Message
+			var lease string
+			msg, lease, err = c.Lease(dtid, subject, time.Duration(timeout*float64(time.Second)))
 			if err != nil {
 				if errors.Is(err, errNoMessage) {
-					err = writer.WriteBulksSlice(nil)
+					err = writer.writeNull()
 					break
 				}
 				err = writer.WriteError(err.Error())
 				break
 			}
 
+			if writer.proto == resp3 {
+				err = writer.writeMap(append(messageMap(msg), "lease", lease))
+				break
+			}
+			err = writer.writeAggregate('*', '*', []interface{}{createKey(msg.Sender, msg.Topic), msg.Payload, msg.ID, msg.Deliveries, lease})
+		case "ACK", "NACK":
+			if debugEnabled(logger) {
+				logger.WithField("CMD", cmd).Debug("client acknowledgement command")
+			}
+			// ACK lease [lease ...]
+			if command.ArgCount() < 2 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			ids := make([]string, 0, command.ArgCount()-1)
+			for i := 1; i < command.ArgCount(); i++ {
+				ids = append(ids, string(command.Get(i)))
+			}
+
+			var n uint64
+			if cmd == "ACK" {
+				n, err = c.Ack(ids)
+			} else {
+				n, err = c.Nack(ids)
+			}
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			err = writer.WriteInt(int64(n))
+		case "CALL":
+			logger.Debug("client CALL command")
+			// CALL key payload timeout
+			if command.ArgCount() != 4 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			var dtid uint64
+			var subject string
+			dtid, subject, err = parseKey(string(command.Get(1)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			// the timeout is in seconds, as for BLPOP
+			var timeout float64
+			timeout, err = strconv.ParseFloat(string(command.Get(3)), 64)
+			if err != nil {
+				err = writer.WriteError(errInvalidTimeout.Error())
+				break
+			}
+			if timeout < 0 {
+				err = writer.WriteError(errNegativeArg.Error())
+				break
+			}
+
+			// don't hold back the replies of pipelined commands while waiting
+			if err = writer.flush(); err != nil {
+				break
+			}
+			// a connection waiting for a reply is not idle
+			conn.SetReadDeadline(time.Time{})
+
+			var msg Message
+			msg, err = c.Call(reader.ctx, dtid, subject, command.Get(2), time.Duration(timeout*float64(time.Second)))
+			if err != nil {
+				if errors.Is(err, errNoMessage) {
+					err = writer.writeNull()
+					break
+				}
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			if writer.proto == resp3 {
+				err = writer.writeMap(messageMap(msg))
+				break
+			}
 			err = writer.WriteObjectsSlice([]interface{}{createKey(msg.Sender, msg.Topic), msg.Payload})
+		case "REPLY":
+			logger.Debug("client REPLY command")
+			// REPLY key request-id payload
+			if command.ArgCount() != 4 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			var dtid uint64
+			var subject string
+			dtid, subject, err = parseKey(string(command.Get(1)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			var id string
+			id, err = c.Reply(dtid, subject, string(command.Get(2)), command.Get(3))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			err = writer.WriteSimpleString(id)
 		case "LLEN":
-			log.Debug().Msg("client LLEN command")
+			logger.Debug("client LLEN command")
 			if command.ArgCount() != 2 {
 				err = writer.WriteError(errInvalidArgCount.Error())
 				break
@@ -214,8 +701,10 @@ func (s *Server) handleCon(conn net.Conn) {
 			}
 
 			err = writer.WriteInt(int64(count))
-		case "LRANGE":
-			log.Debug().Msg("client LRANGE command")
+		case "LRANGE", "LRANGEMSG":
+			if debugEnabled(logger) {
+				logger.WithField("CMD", cmd).Debug("client range command")
+			}
 			if command.ArgCount() != 4 {
 				err = writer.WriteError(errInvalidArgCount.Error())
 				break
@@ -249,50 +738,465 @@ func (s *Server) handleCon(conn net.Conn) {
 				break
 			}
 
-			output := make([]interface{}, len(messages))
+			// LRANGEMSG lists the messages with their ID, as LPOPMSG
+			if cmd == "LRANGEMSG" {
+				output := make([]interface{}, 0, len(messages))
+				for _, msg := range messages {
+					output = append(output, messageReply(writer.proto, msg))
+				}
+				err = writer.writeAggregate('*', '*', output)
+				break
+			}
+
+			output := make([]interface{}, 2*len(messages))
 			for i := range messages {
 				output[2*i] = createKey(messages[i].Sender, messages[i].Topic)
 				output[2*i+1] = messages[i].Payload
 			}
 			err = writer.WriteObjectsSlice(output)
+		case "LINDEX":
+			logger.Debug("client LINDEX command")
+			if command.ArgCount() != 3 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			var dtid uint64
+			var subject string
+			dtid, subject, err = parseKey(string(command.Get(1)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			var index int
+			index, err = strconv.Atoi(string(command.Get(2)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			var msg Message
+			msg, err = c.LIndex(dtid, subject, index)
+			if err != nil {
+				if errors.Is(err, errNoMessage) {
+					err = writer.writeNull()
+					break
+				}
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			err = writer.WriteObjectsSlice([]interface{}{createKey(msg.Sender, msg.Topic), msg.Payload})
+		case "LREM":
+			logger.Debug("client LREM command")
+			if command.ArgCount() != 4 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			var dtid uint64
+			var subject string
+			dtid, subject, err = parseKey(string(command.Get(1)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			var count int
+			count, err = strconv.Atoi(string(command.Get(2)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			var removed uint64
+			removed, err = c.LRem(dtid, subject, count, command.Get(3))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			err = writer.WriteInt(int64(removed))
+		case "LTRIM":
+			logger.Debug("client LTRIM command")
+			if command.ArgCount() != 4 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			var dtid uint64
+			var subject string
+			dtid, subject, err = parseKey(string(command.Get(1)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			var start, end int
+			start, err = strconv.Atoi(string(command.Get(2)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			end, err = strconv.Atoi(string(command.Get(3)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			if err = c.LTrim(dtid, subject, start, end); err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			err = writer.WriteSimpleString("OK")
+		case "LPOS":
+			logger.Debug("client LPOS command")
+			// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+			if command.ArgCount() < 3 || command.ArgCount()%2 != 1 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			var dtid uint64
+			var subject string
+			dtid, subject, err = parseKey(string(command.Get(1)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			rank, count, maxLen := 1, 1, 0
+			hasCount := false
+			for i := 3; i < command.ArgCount() && err == nil; i += 2 {
+				var val int
+				val, err = strconv.Atoi(string(command.Get(i + 1)))
+				if err != nil {
+					break
+				}
+				switch strings.ToUpper(string(command.Get(i))) {
+				case "RANK":
+					rank = val
+				case "COUNT":
+					count, hasCount = val, true
+				case "MAXLEN":
+					maxLen = val
+				default:
+					err = errSyntax
+				}
+				if count < 0 || maxLen < 0 {
+					err = errNegativeArg
+				}
+			}
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			var positions []int
+			positions, err = c.LPos(dtid, subject, command.Get(2), rank, count, maxLen)
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			if !hasCount {
+				if len(positions) == 0 {
+					err = writer.writeNullBulk()
+					break
+				}
+				err = writer.WriteInt(int64(positions[0]))
+				break
+			}
+
+			output := make([]interface{}, len(positions))
+			for i := range positions {
+				output[i] = positions[i]
+			}
+			err = writer.WriteObjectsSlice(output)
+		case "TRACE":
+			logger.Debug("client TRACE command")
+			if command.ArgCount() != 2 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			var events []TraceEvent
+			events, err = c.Trace(string(command.Get(1)))
+			if err != nil {
+				err = writer.WriteError(err.Error())
+				break
+			}
+
+			output := make([]string, len(events))
+			for i := range events {
+				output[i] = events[i].String()
+			}
+			err = writer.WriteBulkStrings(output)
+		case "DEADLETTER":
+			logger.Debug("client DEADLETTER command")
+			if command.ArgCount() < 2 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			sub := strings.ToUpper(string(command.Get(1)))
+			switch sub {
+			case "LEN", "POP":
+				// DEADLETTER LEN|POP key
+				if command.ArgCount() != 3 {
+					err = writer.WriteError(errInvalidArgCount.Error())
+					break
+				}
+
+				var dtid uint64
+				var subject string
+				dtid, subject, err = parseKey(string(command.Get(2)))
+				if err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				if sub == "LEN" {
+					var letters []DeadLetter
+					if letters, err = c.DeadLetters(dtid, subject); err != nil {
+						err = writer.WriteError(err.Error())
+						break
+					}
+					err = writer.WriteInt(int64(len(letters)))
+					break
+				}
+
+				var letter DeadLetter
+				letter, err = c.DeadLetterPop(dtid, subject)
+				if err != nil {
+					if errors.Is(err, errNoMessage) {
+						err = writer.writeNull()
+						break
+					}
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				err = writer.writeValue(deadLetterReply(writer.proto, letter))
+			case "RANGE":
+				// DEADLETTER RANGE key start stop
+				if command.ArgCount() != 5 {
+					err = writer.WriteError(errInvalidArgCount.Error())
+					break
+				}
+
+				var dtid uint64
+				var subject string
+				dtid, subject, err = parseKey(string(command.Get(2)))
+				if err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				var start, end int
+				start, err = strconv.Atoi(string(command.Get(3)))
+				if err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+				end, err = strconv.Atoi(string(command.Get(4)))
+				if err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				var letters []DeadLetter
+				if letters, err = c.DeadLetters(dtid, subject); err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				start, end = normalizeRange(start, end, len(letters))
+				output := make([]interface{}, 0, end-start)
+				for _, letter := range letters[start:end] {
+					output = append(output, deadLetterReply(writer.proto, letter))
+				}
+				err = writer.writeAggregate('*', '*', output)
+			case "BOUNCE":
+				// DEADLETTER BOUNCE ON|OFF
+				if command.ArgCount() != 3 {
+					err = writer.WriteError(errInvalidArgCount.Error())
+					break
+				}
+
+				arg := strings.ToUpper(string(command.Get(2)))
+				if arg != "ON" && arg != "OFF" {
+					err = writer.WriteError(errSyntax.Error())
+					break
+				}
+
+				if err = c.SetBounce(arg == "ON"); err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				err = writer.WriteSimpleString("OK")
+			default:
+				logger.WithField("SUBCMD", sub).Debug("client sent unknown DEADLETTER subcommand")
+				err = writer.WriteError(errInvalidCommand.Error())
+			}
+		case "ACL":
+			logger.Debug("client ACL command")
+			if command.ArgCount() < 2 {
+				err = writer.WriteError(errInvalidArgCount.Error())
+				break
+			}
+
+			sub := strings.ToUpper(string(command.Get(1)))
+			switch sub {
+			case "ALLOW", "DENY", "DEL":
+				if command.ArgCount() != 3 {
+					err = writer.WriteError(errInvalidArgCount.Error())
+					break
+				}
+
+				var dtid uint64
+				var subject string
+				dtid, subject, err = parseACLKey(string(command.Get(2)))
+				if err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				if sub == "DEL" {
+					var removed bool
+					removed, err = c.ACLDel(dtid, subject)
+					if err != nil {
+						err = writer.WriteError(err.Error())
+						break
+					}
+					if removed {
+						err = writer.WriteInt(1)
+					} else {
+						err = writer.WriteInt(0)
+					}
+					break
+				}
+
+				if err = c.ACLSet(dtid, subject, sub == "ALLOW"); err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				err = writer.WriteSimpleString("OK")
+			case "LIST":
+				if command.ArgCount() != 2 {
+					err = writer.WriteError(errInvalidArgCount.Error())
+					break
+				}
+
+				var rules []ACLRule
+				rules, err = c.ACLList()
+				if err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				output := make([]string, len(rules))
+				for i := range rules {
+					output[i] = rules[i].String()
+				}
+				err = writer.WriteBulkStrings(output)
+			case "RESET":
+				if command.ArgCount() != 2 {
+					err = writer.WriteError(errInvalidArgCount.Error())
+					break
+				}
+
+				if err = c.ACLReset(); err != nil {
+					err = writer.WriteError(err.Error())
+					break
+				}
+
+				err = writer.WriteSimpleString("OK")
+			default:
+				logger.WithField("SUBCMD", sub).Debug("client sent unknown ACL subcommand")
+				err = writer.WriteError(errInvalidCommand.Error())
+			}
 		default:
-			log.Debug().Str("CMD", cmd).Msg("client sent unknown command")
+			logger.WithField("CMD", cmd).Debug("client sent unknown command")
+			// don't let clients create arbitrary metric labels
+			cmd = "UNKNOWN"
 			err = writer.WriteError(errInvalidCommand.Error())
 		}
+		// replies of pipelined commands are written together, once all commands
+		// read from the connection are handled
+		if err == nil && (command.IsLast() || writer.buffered() >= flushThreshold) {
+			err = writer.flush()
+		}
+		s.metrics.command(cmd, writer.failed, time.Since(start))
 
 		if err != nil {
-			log.Error().Err(err).Msg("could not write to connection")
+			if isTimeout(err) {
+				atomic.AddUint64(&s.stats.writeTimeouts, 1)
+			}
+			logger.WithField("error", err).Error("could not write to connection")
 			return
 		}
 	}
 }
 
+// readDeadline of the next command of a connection. Unauthenticated
+// connections must authenticate before the auth deadline, authenticated
+// connections are closed if they are idle, unless they are subscribed.
+func (s *Server) readDeadline(authenticated bool, authDeadline time.Time, subscribed bool) time.Time {
+	if !authenticated {
+		return authDeadline
+	}
+	if s.limits.IdleTimeout > 0 && !subscribed {
+		return time.Now().Add(s.limits.IdleTimeout)
+	}
+	return time.Time{}
+}
+
 var (
 	errInvalidCommand      = errors.New("unknown command")
 	errInvalidArgCount     = errors.New("invalid amount of argument for command")
 	errAuthorizationFailed = errors.New("authorization failed")
 	errMalformedKey        = errors.New("malformed key")
+	errSyntax              = errors.New("syntax error")
+	errNegativeArg         = errors.New("argument can't be negative")
+	errInvalidTimeout      = errors.New("timeout is not a float or out of range")
+	errNoProto             = errors.New("NOPROTO unsupported protocol version")
 )
 
-const (
-	serverVersion = "0.1.0"
-	protoVersion  = 1
-)
+const serverVersion = "0.1.0"
 
-func (s *Server) helloInfo() []interface{} {
-	// old style hello, trimmed down
+// helloInfo describes the server in the reply to HELLO
+func (s *Server) helloInfo(proto int) []interface{} {
 	return []interface{}{
-		"server",
-		"tfagent",
-		"version",
-		serverVersion,
-		"proto",
-		protoVersion,
-		"id",
-		s.peerID(),
+		"server", "tfagent",
+		"version", serverVersion,
+		"proto", proto,
+		"id", s.peerID(),
 	}
 }
 
+// authenticate the connection as the twin, and return the authenticated
+// connection
+func (s *Server) authenticate(c connection, info *client, rawDtid []byte, rawSig []byte) (connection, uint64, error) {
+	dtid, err := strconv.ParseUint(string(rawDtid), 10, 64)
+	if err != nil {
+		return c, 0, err
+	}
+
+	if err = c.Auth(dtid, rawSig); err != nil {
+		s.metrics.authFailed()
+		return c, 0, err
+	}
+
+	info.authenticated(dtid)
+	return newAuthenticatedConn(dtid, s), dtid, nil
+}
+
 func (s *Server) peerID() string {
 	return s.node.PeerID()
 }
@@ -0,0 +1,667 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfagent/pkg/keys"
+)
+
+// testStore is a PeerStore with a generated key per digital twin, ed25519
+// unless replaced with setKey
+type testStore struct {
+	keys  map[uint64]*keys.Key
+	peers map[uint64]string
+	lock  sync.Mutex
+}
+
+func newTestStore(t testing.TB, dtids ...uint64) *testStore {
+	ts := &testStore{
+		keys:  make(map[uint64]*keys.Key),
+		peers: make(map[uint64]string),
+	}
+	for _, dtid := range dtids {
+		ts.setKey(t, dtid, keys.Ed25519)
+	}
+	return ts
+}
+
+// setKey generates a key of the given type for the twin
+func (ts *testStore) setKey(t testing.TB, dtid uint64, typ keys.Type) *keys.Key {
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.FromURI(typ, "0x"+hex.EncodeToString(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.keys[dtid] = key
+	return key
+}
+
+func (ts *testStore) PeerID(dtid uint64) (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	pid, ok := ts.peers[dtid]
+	if !ok {
+		return "", errors.New("unknown twin")
+	}
+	return pid, nil
+}
+
+func (ts *testStore) PublicKey(dtid uint64) (TwinKey, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	pk := TwinKey{}
+	key, ok := ts.keys[dtid]
+	if !ok {
+		return pk, errors.New("unknown twin")
+	}
+	pk.Type = key.Type()
+	copy(pk.Public[:], key.Public())
+	return pk, nil
+}
+
+func (ts *testStore) SetPeerID(dtid uint64, pid string) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.peers[dtid] = pid
+}
+
+// sig is the hex encoded AUTH signature of the twin
+func (ts *testStore) sig(dtid uint64) string {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	sig, err := ts.keys[dtid].Sign([]byte(keys.AuthChallenge))
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(sig)
+}
+
+// harness runs a broker, i.e. a Server backed by a BufferedNode on a
+// MemoryTransport
+type harness struct {
+	t      testing.TB
+	store  *testStore
+	node   *BufferedNode
+	server *Server
+	addr   string
+}
+
+// newHarness starts a single broker serving the given twins
+func newHarness(t testing.TB, dtids ...uint64) *harness {
+	return newBroker(t, NewMemoryNetwork(), newTestStore(t, dtids...), dtids...)
+}
+
+// newBroker starts a broker on the network, serving the given twins
+func newBroker(t testing.TB, network *MemoryNetwork, store *testStore, dtids ...uint64) *harness {
+	return newBrokerWith(t, network, store, nil, dtids...)
+}
+
+// newBrokerWith starts a broker like newBroker, calling setup on the server
+// before it is run
+func newBrokerWith(t testing.TB, network *MemoryNetwork, store *testStore, setup func(*Server) error, dtids ...uint64) *harness {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := NewBufferedNode(store, network.NewTransport())
+	if err = node.Start(ctx, priv); err != nil {
+		t.Fatal(err)
+	}
+	for _, dtid := range dtids {
+		store.SetPeerID(dtid, node.PeerID())
+	}
+
+	s, err := NewServer(ctx, 0, store, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if setup != nil {
+		if err = setup(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go s.Run()
+
+	return &harness{
+		t:      t,
+		store:  store,
+		node:   node,
+		server: s,
+		addr:   fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port),
+	}
+}
+
+// client connects to the server, authenticated as the given twin
+func (h *harness) client(dtid uint64) *redis.Client {
+	sig := h.store.sig(dtid)
+	client := redis.NewClient(&redis.Options{
+		Addr: h.addr,
+		OnConnect: func(ctx context.Context, cn *redis.Conn) error {
+			return cn.Process(ctx, redis.NewStatusCmd(ctx, "AUTH", dtid, sig))
+		},
+	})
+	h.t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// peerID of the broker
+func (h *harness) peerID() peer.ID {
+	id, err := peer.Decode(h.node.PeerID())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return id
+}
+
+// anonClient connects to the server without authenticating
+func (h *harness) anonClient() *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: h.addr})
+	h.t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// deliver messages to the mailbox of the node, as if they were received from
+// the network
+func (h *harness) deliver(msgs ...Message) {
+	h.node.recvQLock.Lock()
+	defer h.node.recvQLock.Unlock()
+
+	for _, msg := range msgs {
+		msg.TTL = time.Now().Add(defaultMsgTTL)
+		h.node.recvQ = append(h.node.recvQ, msg)
+	}
+	close(h.node.recvNotify)
+	h.node.recvNotify = make(chan struct{})
+}
+
+// eventually polls the condition until it is true, or fails the test after a
+// few seconds
+func (h *harness) eventually(cond func() bool, format string, args ...interface{}) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func msg(sender uint64, receiver uint64, topic string, payload string) Message {
+	return Message{Sender: sender, Receiver: receiver, Topic: topic, Payload: []byte(payload)}
+}
+
+func TestPing(t *testing.T) {
+	h := newHarness(t, 1)
+	ctx := context.Background()
+
+	for _, client := range []*redis.Client{h.anonClient(), h.client(1)} {
+		pong, err := client.Ping(ctx).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pong != "PONG" {
+			t.Errorf("expected PONG, got %s", pong)
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	h := newHarness(t, 1)
+	ctx := context.Background()
+	client := h.anonClient()
+
+	reply, err := client.Do(ctx, "HELLO").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		"server", "tfagent",
+		"version", serverVersion,
+		"proto", int64(resp2),
+		"id", h.node.PeerID(),
+	}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("expected %v, got %v", expected, reply)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	ctx := context.Background()
+
+	rawSig, err := h.store.keys[1].Sign([]byte(keys.AuthChallenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		args []interface{}
+		err  string
+	}{
+		{"hex signature", []interface{}{"AUTH", 1, h.store.sig(1)}, ""},
+		{"raw signature", []interface{}{"AUTH", 1, rawSig}, ""},
+		{"signature of other twin", []interface{}{"AUTH", 1, h.store.sig(2)}, errAuthorizationFailed.Error()},
+		{"unknown twin", []interface{}{"AUTH", 3, h.store.sig(1)}, "could not get public key: unknown twin"},
+		{"short signature", []interface{}{"AUTH", 1, "abcd"}, errInvalidSignatureLength.Error()},
+		{"invalid hex", []interface{}{"AUTH", 1, h.store.sig(1)[2:] + "zz"}, "encoding/hex: invalid byte: U+007A 'z'"},
+		{"invalid dtid", []interface{}{"AUTH", "twin", h.store.sig(1)}, `strconv.ParseUint: parsing "twin": invalid syntax`},
+		{"missing signature", []interface{}{"AUTH", 1}, errInvalidArgCount.Error()},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := h.anonClient()
+			// make sure all commands run on the same connection
+			conn := client.Conn(ctx)
+			defer conn.Close()
+
+			cmd := redis.NewStatusCmd(ctx, tc.args...)
+			conn.Process(ctx, cmd)
+			if tc.err != "" {
+				if cmd.Err() == nil || cmd.Err().Error() != tc.err {
+					t.Fatalf("expected error %q, got %v", tc.err, cmd.Err())
+				}
+				// connection is still unauthenticated
+				llen := redis.NewIntCmd(ctx, "LLEN", "0:")
+				conn.Process(ctx, llen)
+				if llen.Err() == nil || llen.Err().Error() != errNotAuthenticated.Error() {
+					t.Errorf("expected connection to be unauthenticated, got %v", llen.Err())
+				}
+				return
+			}
+
+			if cmd.Err() != nil {
+				t.Fatal(cmd.Err())
+			}
+			if cmd.Val() != "Authenticated" {
+				t.Errorf("unexpected AUTH reply %s", cmd.Val())
+			}
+
+			again := redis.NewStatusCmd(ctx, tc.args...)
+			conn.Process(ctx, again)
+			if again.Err() == nil || again.Err().Error() != errAlreadyAuthenticated.Error() {
+				t.Errorf("expected already authenticated error, got %v", again.Err())
+			}
+		})
+	}
+}
+
+func TestAuthSr25519(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	h.store.setKey(t, 1, keys.Sr25519)
+	ctx := context.Background()
+
+	// the signature of an ed25519 twin does not verify as sr25519
+	err := h.anonClient().Do(ctx, "AUTH", 1, h.store.sig(2)).Err()
+	if err == nil || err.Error() != errAuthorizationFailed.Error() {
+		t.Errorf("expected authorization failure, got %v", err)
+	}
+
+	if err := h.client(1).LLen(ctx, "2:").Err(); err != nil {
+		t.Errorf("expected sr25519 twin to authenticate, got %v", err)
+	}
+}
+
+func TestRequiresAuth(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.anonClient()
+	ctx := context.Background()
+
+	for _, args := range [][]interface{}{
+		{"LPUSH", "2:a", "x"},
+		{"RPUSH", "2:a", "x"},
+		{"LPUSHID", "2:a", "x"},
+		{"LPOP", "0:"},
+		{"RPOP", "0:"},
+		{"LLEN", "0:"},
+		{"LRANGE", "0:", 0, -1},
+		{"LRANGEMSG", "0:", 0, -1},
+		{"LINDEX", "0:", 0},
+		{"LREM", "0:", 0, "x"},
+		{"LTRIM", "0:", 0, -1},
+		{"LPOS", "0:", "x"},
+		{"LPOPMSG", "0:"},
+		{"CALL", "2:a", "x", 1},
+		{"REPLY", "2:a", "x", "y"},
+		{"TRACE", "x"},
+		{"SUBSCRIBE", "0:"},
+		{"ACL", "ALLOW", "2"},
+		{"ACL", "DENY", "2"},
+		{"ACL", "DEL", "2"},
+		{"ACL", "LIST"},
+		{"ACL", "RESET"},
+	} {
+		err := client.Do(ctx, args...).Err()
+		if err == nil || err.Error() != errNotAuthenticated.Error() {
+			t.Errorf("%v: expected not authenticated error, got %v", args, err)
+		}
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	h := newHarness(t, 1)
+	client := h.client(1)
+	ctx := context.Background()
+
+	cases := []struct {
+		args []interface{}
+		err  string
+	}{
+		{[]interface{}{"FLUSHALL"}, errInvalidCommand.Error()},
+		{[]interface{}{"HELLO", 4}, errNoProto.Error()},
+		{[]interface{}{"HELLO", 2, "SETNAME"}, errSyntax.Error()},
+		{[]interface{}{"HELLO", 2, "AUTH", 1}, errSyntax.Error()},
+		{[]interface{}{"SUBSCRIBE"}, errInvalidArgCount.Error()},
+		{[]interface{}{"SUBSCRIBE", "1"}, errMalformedKey.Error()},
+		{[]interface{}{"LPUSH", "1:a"}, errInvalidArgCount.Error()},
+		{[]interface{}{"LPUSH", "1", "x"}, errMalformedKey.Error()},
+		{[]interface{}{"LPUSH", "1:a:b", "x"}, errMalformedKey.Error()},
+		{[]interface{}{"LPUSH", "twin:a", "x"}, `could not parse dtid: strconv.ParseUint: parsing "twin": invalid syntax`},
+		{[]interface{}{"LPOP"}, errInvalidArgCount.Error()},
+		{[]interface{}{"LPOP", "a"}, errMalformedKey.Error()},
+		{[]interface{}{"LLEN", "0:", "x"}, errInvalidArgCount.Error()},
+		{[]interface{}{"LRANGE", "0:", 0}, errInvalidArgCount.Error()},
+		{[]interface{}{"LRANGE", "0:", "a", 1}, `strconv.Atoi: parsing "a": invalid syntax`},
+		{[]interface{}{"LRANGE", "0:", 0, "b"}, `strconv.Atoi: parsing "b": invalid syntax`},
+		{[]interface{}{"LINDEX", "0:", "a"}, `strconv.Atoi: parsing "a": invalid syntax`},
+		{[]interface{}{"LREM", "0:", "a", "x"}, `strconv.Atoi: parsing "a": invalid syntax`},
+		{[]interface{}{"LPOS", "0:", "x", "RANK"}, errInvalidArgCount.Error()},
+		{[]interface{}{"LPOS", "0:", "x", "FOO", 1}, errSyntax.Error()},
+		{[]interface{}{"LPOS", "0:", "x", "COUNT", -1}, errNegativeArg.Error()},
+		{[]interface{}{"ACL"}, errInvalidArgCount.Error()},
+		{[]interface{}{"ACL", "FOO"}, errInvalidCommand.Error()},
+		{[]interface{}{"ACL", "ALLOW"}, errInvalidArgCount.Error()},
+		{[]interface{}{"ACL", "ALLOW", "a:b"}, `could not parse dtid: strconv.ParseUint: parsing "a": invalid syntax`},
+		{[]interface{}{"ACL", "LIST", "x"}, errInvalidArgCount.Error()},
+	}
+
+	for _, tc := range cases {
+		err := client.Do(ctx, tc.args...).Err()
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.err, err)
+		}
+	}
+
+	// the connection is still usable after all the errors
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMalformedInput(t *testing.T) {
+	h := newHarness(t, 1)
+
+	for _, input := range []string{
+		"\n",
+		"*-1\r\nPING\r\n",
+		"*1\r\n$4\r\nPINGxx",
+		"*1\r\n:4\r\n",
+	} {
+		conn, err := net.Dial("tcp", h.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		conn.Write([]byte(input))
+		// read whatever the server replies until it closes the connection or
+		// the deadline expires
+		bufio.NewReader(conn).ReadString(0)
+		conn.Close()
+	}
+
+	// the server still accepts new connections
+	if err := h.client(1).Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushPop(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	ctx := context.Background()
+	c1, c2 := h.client(1), h.client(2)
+
+	if reply, err := c1.Do(ctx, "LPUSH", "2:greeting", "hello").Text(); err != nil || reply != "OK" {
+		t.Fatalf("expected OK reply, got %q %v", reply, err)
+	}
+	if reply, err := c1.Do(ctx, "RPUSH", "2:greeting", "world").Text(); err != nil || reply != "OK" {
+		t.Fatalf("expected OK reply, got %q %v", reply, err)
+	}
+
+	h.eventually(func() bool { return c2.LLen(ctx, "1:greeting").Val() == 2 }, "messages were not delivered")
+
+	// the sender has no messages
+	if n := c1.LLen(ctx, "0:").Val(); n != 0 {
+		t.Errorf("expected no messages for sender, got %d", n)
+	}
+
+	for _, expected := range []string{"hello", "world"} {
+		reply, err := c2.Do(ctx, "LPOP", "0:").Slice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(reply, []interface{}{"1:greeting", expected}) {
+			t.Errorf("unexpected LPOP reply %v", reply)
+		}
+	}
+
+	if err := c2.Do(ctx, "LPOP", "0:").Err(); err != redis.Nil {
+		t.Errorf("expected nil reply, got %v", err)
+	}
+}
+
+func TestPushUnknownTwin(t *testing.T) {
+	h := newHarness(t, 1)
+	ctx := context.Background()
+
+	err := h.client(1).Do(ctx, "LPUSH", "5:a", "x").Err()
+	if err == nil || err.Error() != "could not send message: could not load receiver peerID: unknown twin" {
+		t.Errorf("expected unknown twin error, got %v", err)
+	}
+}
+
+func TestPushUnreachablePeer(t *testing.T) {
+	h := newHarness(t, 1, 2)
+	ctx := context.Background()
+
+	// twin 2 lives on some other peer, which can't be reached
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.store.SetPeerID(2, other.Pretty())
+
+	if err = h.client(1).Do(ctx, "LPUSH", "2:a", "x").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.node.sendQLock.Lock()
+	defer h.node.sendQLock.Unlock()
+	if len(h.node.sendQ) != 1 {
+		t.Fatalf("expected message to be queued, got %d messages", len(h.node.sendQ))
+	}
+	if string(h.node.sendQ[0].Payload) != "x" {
+		t.Errorf("unexpected queued payload %s", h.node.sendQ[0].Payload)
+	}
+}
+
+func TestACL(t *testing.T) {
+	h := newHarness(t, 1, 2, 3)
+	ctx := context.Background()
+	c1, c2, c3 := h.client(1), h.client(2), h.client(3)
+
+	for _, args := range [][]interface{}{
+		{"ACL", "DENY", "2"},
+		{"ACL", "ALLOW", "2:urgent"},
+		{"ACL", "DENY", "0:spam"},
+	} {
+		if err := c1.Do(ctx, args...).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rules, err := c1.Do(ctx, "ACL", "LIST").StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rules, []string{"deny 2:", "allow 2:urgent", "deny 0:spam"}) {
+		t.Errorf("unexpected rules %v", rules)
+	}
+
+	// rules are per twin
+	if rules, _ = c2.Do(ctx, "ACL", "LIST").StringSlice(); len(rules) != 0 {
+		t.Errorf("expected no rules for twin 2, got %v", rules)
+	}
+
+	for _, push := range []struct {
+		client  *redis.Client
+		key     string
+		allowed bool
+	}{
+		{c2, "1:chat", false},
+		{c2, "1:urgent", true},
+		{c3, "1:spam", false},
+		{c3, "1:chat", true},
+	} {
+		// denied messages are rejected by the receiver
+		err = push.client.Do(ctx, "LPUSH", push.key, "hi").Err()
+		if push.allowed && err != nil {
+			t.Fatal(err)
+		}
+		if !push.allowed && (err == nil || !strings.Contains(err.Error(), "rejected by receiver")) {
+			t.Errorf("expected %s to be rejected, got %v", push.key, err)
+		}
+	}
+
+	h.eventually(func() bool { return c1.LLen(ctx, "0:").Val() == 2 }, "allowed messages were not delivered")
+
+	reply, err := c1.Do(ctx, "LRANGE", "0:", 0, -1).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, []interface{}{"2:urgent", "hi", "3:chat", "hi"}) {
+		t.Errorf("unexpected mailbox %v", reply)
+	}
+
+	if n := c1.Do(ctx, "ACL", "DEL", "2").Val(); n != int64(1) {
+		t.Errorf("expected rule to be deleted, got %v", n)
+	}
+	if n := c1.Do(ctx, "ACL", "DEL", "2").Val(); n != int64(0) {
+		t.Errorf("expected no rule to be deleted, got %v", n)
+	}
+
+	if err = c1.Do(ctx, "ACL", "RESET").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if rules, _ = c1.Do(ctx, "ACL", "LIST").StringSlice(); len(rules) != 0 {
+		t.Errorf("expected no rules after reset, got %v", rules)
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	const senders = 8
+	const perSender = 50
+
+	dtids := []uint64{1}
+	for i := uint64(2); i < senders+2; i++ {
+		dtids = append(dtids, i)
+	}
+	h := newHarness(t, dtids...)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for _, dtid := range dtids[1:] {
+		wg.Add(1)
+		go func(client *redis.Client, dtid uint64) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				if err := client.Do(ctx, "LPUSH", "1:load", fmt.Sprintf("%d-%d", dtid, i)).Err(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(h.client(dtid), dtid)
+	}
+
+	// pop concurrently from a few connections of the receiver
+	received := make(chan string, senders*perSender)
+	done := make(chan struct{})
+	var popWg sync.WaitGroup
+	receiver := h.client(1)
+	for i := 0; i < 4; i++ {
+		popWg.Add(1)
+		go func() {
+			defer popWg.Done()
+			for {
+				reply, err := receiver.Do(ctx, "LPOP", "0:load").Slice()
+				if err == redis.Nil {
+					select {
+					case <-done:
+						return
+					case <-time.After(time.Millisecond):
+						continue
+					}
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				received <- reply[1].(string)
+			}
+		}()
+	}
+
+	wg.Wait()
+	h.eventually(func() bool { return len(received) == senders*perSender }, "expected %d messages", senders*perSender)
+	close(done)
+	popWg.Wait()
+	close(received)
+
+	seen := make(map[string]bool)
+	for payload := range received {
+		if seen[payload] {
+			t.Errorf("message %s received twice", payload)
+		}
+		seen[payload] = true
+	}
+	if len(seen) != senders*perSender {
+		t.Errorf("expected %d unique messages, got %d", senders*perSender, len(seen))
+	}
+}
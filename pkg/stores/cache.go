@@ -0,0 +1,160 @@
+package stores
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/threefoldtech/tfagent/pkg"
+)
+
+// Cache wraps a pkg.PeerStore, caching successful lookups for a fixed time
+type Cache struct {
+	// accessed atomically, first in the struct for alignment
+	hits   uint64
+	misses uint64
+
+	store pkg.PeerStore
+	ttl   time.Duration
+
+	entries map[uint64]*cacheEntry
+	lock    sync.Mutex
+
+	log pkg.Log
+}
+
+type cacheEntry struct {
+	peerID           string
+	peerIDExpires    time.Time
+	publicKey        pkg.TwinKey
+	publicKeyExpires time.Time
+}
+
+// NewCache creates a new cache for the store, keeping entries for the given
+// time
+func NewCache(store pkg.PeerStore, ttl time.Duration) *Cache {
+	return &Cache{
+		store:   store,
+		ttl:     ttl,
+		entries: make(map[uint64]*cacheEntry),
+		log:     pkg.DefaultLogger(),
+	}
+}
+
+// SetLogger implements pkg.LogSetter
+func (c *Cache) SetLogger(log pkg.Log) {
+	c.log = log
+}
+
+// entry gets the entry of the twin, creating it if needed. The lock must be held.
+func (c *Cache) entry(dtid uint64) *cacheEntry {
+	e, ok := c.entries[dtid]
+	if !ok {
+		e = &cacheEntry{}
+		c.entries[dtid] = e
+	}
+	return e
+}
+
+// PeerID implements pkg.PeerStore
+func (c *Cache) PeerID(dtid uint64) (string, error) {
+	c.lock.Lock()
+	if e, ok := c.entries[dtid]; ok && time.Now().Before(e.peerIDExpires) {
+		c.lock.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return e.peerID, nil
+	}
+	c.lock.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	pid, err := c.store.PeerID(dtid)
+	if err != nil {
+		c.log.WithField("dtid", dtid).WithField("error", err).Debug("could not look up peer ID")
+		return "", err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e := c.entry(dtid)
+	e.peerID = pid
+	e.peerIDExpires = time.Now().Add(c.ttl)
+
+	return pid, nil
+}
+
+// PublicKey implements pkg.PeerStore
+func (c *Cache) PublicKey(dtid uint64) (pkg.TwinKey, error) {
+	c.lock.Lock()
+	if e, ok := c.entries[dtid]; ok && time.Now().Before(e.publicKeyExpires) {
+		c.lock.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return e.publicKey, nil
+	}
+	c.lock.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	pk, err := c.store.PublicKey(dtid)
+	if err != nil {
+		c.log.WithField("dtid", dtid).WithField("error", err).Debug("could not look up public key")
+		return pk, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e := c.entry(dtid)
+	e.publicKey = pk
+	e.publicKeyExpires = time.Now().Add(c.ttl)
+
+	return pk, nil
+}
+
+// SetPeerID implements pkg.PeerStore. The peer ID is set on the wrapped store,
+// and replaces the cached peer ID.
+func (c *Cache) SetPeerID(dtid uint64, pid string) {
+	c.store.SetPeerID(dtid, pid)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e := c.entry(dtid)
+	e.peerID = pid
+	e.peerIDExpires = time.Now().Add(c.ttl)
+}
+
+// Cached implements pkg.CachingStore. Expired entries are removed.
+func (c *Cache) Cached() []pkg.CachedTwin {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	out := make([]pkg.CachedTwin, 0, len(c.entries))
+	for dtid, e := range c.entries {
+		ct := pkg.CachedTwin{ID: dtid}
+		if now.Before(e.peerIDExpires) {
+			ct.PeerID = e.peerID
+			ct.PeerIDExpires = e.peerIDExpires
+		}
+		if now.Before(e.publicKeyExpires) {
+			ct.PublicKey = hex.EncodeToString(e.publicKey.Public[:])
+			ct.KeyType = string(e.publicKey.Type)
+			ct.PublicKeyExpires = e.publicKeyExpires
+		}
+		if ct.PeerIDExpires.IsZero() && ct.PublicKeyExpires.IsZero() {
+			delete(c.entries, dtid)
+			continue
+		}
+		out = append(out, ct)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+
+	return out
+}
+
+// CacheStats implements pkg.CachingStore
+func (c *Cache) CacheStats() (uint64, uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
@@ -0,0 +1,84 @@
+package stores
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfagent/pkg"
+	"github.com/threefoldtech/tfagent/pkg/keys"
+)
+
+// countingStore counts lookups, and fails for twins without a peer ID
+type countingStore struct {
+	peers   map[uint64]string
+	lookups int
+}
+
+func (cs *countingStore) PeerID(dtid uint64) (string, error) {
+	cs.lookups++
+	pid, ok := cs.peers[dtid]
+	if !ok {
+		return "", errors.New("unknown twin")
+	}
+	return pid, nil
+}
+
+func (cs *countingStore) PublicKey(dtid uint64) (pkg.TwinKey, error) {
+	cs.lookups++
+	return pkg.TwinKey{Type: keys.Sr25519, Public: [pkg.PublicKeySize]byte{1}}, nil
+}
+
+func (cs *countingStore) SetPeerID(dtid uint64, pid string) {
+	cs.peers[dtid] = pid
+}
+
+func TestCache(t *testing.T) {
+	store := &countingStore{peers: map[uint64]string{1: "a"}}
+	cache := NewCache(store, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if pid, err := cache.PeerID(1); err != nil || pid != "a" {
+			t.Fatalf("unexpected peer ID %q (%v)", pid, err)
+		}
+	}
+	if store.lookups != 1 {
+		t.Errorf("expected 1 lookup, got %d", store.lookups)
+	}
+
+	// failed lookups are not cached
+	cache.PeerID(2)
+	cache.PeerID(2)
+	if store.lookups != 3 {
+		t.Errorf("expected failed lookups to be retried, got %d lookups", store.lookups)
+	}
+	if hits, misses := cache.CacheStats(); hits != 2 || misses != 3 {
+		t.Errorf("expected 2 hits and 3 misses, got %d and %d", hits, misses)
+	}
+
+	cache.SetPeerID(1, "b")
+	if pid, _ := cache.PeerID(1); pid != "b" {
+		t.Errorf("expected SetPeerID to replace cached peer ID, got %q", pid)
+	}
+
+	cache.PublicKey(1)
+	cached := cache.Cached()
+	if len(cached) != 1 || cached[0].PeerID != "b" || cached[0].PublicKey[:2] != "01" || cached[0].KeyType != "sr25519" {
+		t.Errorf("unexpected cache contents %+v", cached)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	store := &countingStore{peers: map[uint64]string{1: "a"}}
+	cache := NewCache(store, time.Millisecond)
+
+	cache.PeerID(1)
+	time.Sleep(5 * time.Millisecond)
+	if len(cache.Cached()) != 0 {
+		t.Errorf("expected expired entries to be removed")
+	}
+	cache.PeerID(1)
+	if store.lookups != 2 {
+		t.Errorf("expected expired entry to be looked up again, got %d lookups", store.lookups)
+	}
+}
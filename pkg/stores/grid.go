@@ -0,0 +1,60 @@
+package stores
+
+import (
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfagent/pkg"
+)
+
+// twinGetter gets twin records, implemented by Client
+type twinGetter interface {
+	GetTwin(twinID uint64) (Twin, error)
+}
+
+// Grid is a pkg.PeerStore which looks up twins on the grid
+type Grid struct {
+	twins twinGetter
+}
+
+// NewGrid creates a new store looking up twins with the client
+func NewGrid(client *Client) *Grid {
+	return &Grid{twins: client}
+}
+
+// twin gets the record of the twin. Missing twins are decoded as an empty
+// record, so the ID of the record is checked.
+func (g *Grid) twin(dtid uint64) (Twin, error) {
+	twin, err := g.twins.GetTwin(dtid)
+	if err != nil {
+		return Twin{}, errors.Wrapf(err, "could not get twin %d", dtid)
+	}
+	if uint64(twin.TwinID) != dtid {
+		return Twin{}, errors.Errorf("twin %d not found", dtid)
+	}
+	return twin, nil
+}
+
+// PeerID implements pkg.PeerStore
+func (g *Grid) PeerID(dtid uint64) (string, error) {
+	twin, err := g.twin(dtid)
+	if err != nil {
+		return "", err
+	}
+	if len(twin.PeerID) == 0 {
+		return "", errors.Errorf("twin %d has no peer ID", dtid)
+	}
+	return byteSliceToString(twin.PeerID), nil
+}
+
+// PublicKey implements pkg.PeerStore
+func (g *Grid) PublicKey(dtid uint64) (pkg.TwinKey, error) {
+	twin, err := g.twin(dtid)
+	if err != nil {
+		return pkg.TwinKey{}, err
+	}
+	return twin.Key()
+}
+
+// SetPeerID implements pkg.PeerStore. Twin records are only updated by the
+// twins themselves, so this is a no-op. Wrap the store in a Cache to
+// override peer IDs.
+func (g *Grid) SetPeerID(dtid uint64, pid string) {}
@@ -6,6 +6,9 @@ import (
 	gsrpc "github.com/centrifuge/go-substrate-rpc-client/v2"
 	"github.com/centrifuge/go-substrate-rpc-client/v2/scale"
 	"github.com/centrifuge/go-substrate-rpc-client/v2/types"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/tfagent/pkg"
+	"github.com/threefoldtech/tfagent/pkg/keys"
 )
 
 // Client is a struct that holds the api client
@@ -14,12 +17,34 @@ type Client struct {
 }
 
 type Twin struct {
-	TwinID   types.U64
-	Pubkey   types.AccountID
+	TwinID types.U64
+	Pubkey types.AccountID
+	// KeyType of the public key, the variant of the substrate MultiSigner
+	KeyType  types.U8
 	PeerID   []types.U8
 	Entities []entityProof
 }
 
+// key types of twin records, in the order of the substrate MultiSigner
+const (
+	keyTypeEd25519 types.U8 = iota
+	keyTypeSr25519
+)
+
+// Key of the twin, with the type of the twin record
+func (t Twin) Key() (pkg.TwinKey, error) {
+	key := pkg.TwinKey{Public: t.Pubkey}
+	switch t.KeyType {
+	case keyTypeEd25519:
+		key.Type = keys.Ed25519
+	case keyTypeSr25519:
+		key.Type = keys.Sr25519
+	default:
+		return key, errors.Errorf("unsupported key type %d", t.KeyType)
+	}
+	return key, nil
+}
+
 type entityProof struct {
 	entityID  types.U64
 	signature []types.U8
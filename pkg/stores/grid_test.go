@@ -0,0 +1,62 @@
+package stores
+
+import (
+	"testing"
+
+	"github.com/centrifuge/go-substrate-rpc-client/v2/types"
+	"github.com/threefoldtech/tfagent/pkg"
+	"github.com/threefoldtech/tfagent/pkg/keys"
+)
+
+// twinMap serves twin records from memory, returning an empty record for
+// missing twins like the chain does
+type twinMap map[uint64]Twin
+
+func (tm twinMap) GetTwin(twinID uint64) (Twin, error) {
+	return tm[twinID], nil
+}
+
+func gridTwin(id uint64, keyType types.U8, peerID string) Twin {
+	twin := Twin{TwinID: types.U64(id), Pubkey: types.AccountID{byte(id)}, KeyType: keyType}
+	for _, b := range []byte(peerID) {
+		twin.PeerID = append(twin.PeerID, types.U8(b))
+	}
+	return twin
+}
+
+func TestGrid(t *testing.T) {
+	grid := &Grid{twins: twinMap{
+		1: gridTwin(1, keyTypeEd25519, "peer1"),
+		2: gridTwin(2, keyTypeSr25519, "peer2"),
+		3: gridTwin(3, 7, ""),
+	}}
+
+	for _, tc := range []struct {
+		dtid    uint64
+		peerID  string
+		keyType keys.Type
+	}{
+		{1, "peer1", keys.Ed25519},
+		{2, "peer2", keys.Sr25519},
+	} {
+		pid, err := grid.PeerID(tc.dtid)
+		if err != nil || pid != tc.peerID {
+			t.Errorf("twin %d: expected peer ID %s, got %s (%v)", tc.dtid, tc.peerID, pid, err)
+		}
+		key, err := grid.PublicKey(tc.dtid)
+		expected := pkg.TwinKey{Type: tc.keyType, Public: [pkg.PublicKeySize]byte{byte(tc.dtid)}}
+		if err != nil || key != expected {
+			t.Errorf("twin %d: expected key %+v, got %+v (%v)", tc.dtid, expected, key, err)
+		}
+	}
+
+	if _, err := grid.PeerID(3); err == nil {
+		t.Error("expected twin without peer ID to fail")
+	}
+	if _, err := grid.PublicKey(3); err == nil {
+		t.Error("expected unsupported key type to fail")
+	}
+	if _, err := grid.PublicKey(4); err == nil {
+		t.Error("expected missing twin to fail")
+	}
+}
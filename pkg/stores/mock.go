@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 
 	"github.com/threefoldtech/tfagent/pkg"
+	"github.com/threefoldtech/tfagent/pkg/keys"
 )
 
 // pubkey hex: 74856cfef93872537edaebd19504e6494beabc33f61abac91da7301f0f37f655
@@ -17,10 +18,10 @@ func (m MockStore) PeerID(dtid uint64) (string, error) {
 	return "", nil	
 }
 // PublicKey implements pkg.PeerStore
-func (m MockStore) PublicKey(dtid uint64) ([pkg.PublicKeySize]byte, error) {
-	key := [32]byte{}
+func (m MockStore) PublicKey(dtid uint64) (pkg.TwinKey, error) {
+	key := pkg.TwinKey{Type: keys.Ed25519}
 	sb, err := hex.DecodeString("74856cfef93872537edaebd19504e6494beabc33f61abac91da7301f0f37f655")
-	copy(key[:], sb)
+	copy(key.Public[:], sb)
 	return key, err 
 }
 // SetPeerID implements pkg.PeerStore
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+var errSubscribed = errors.New("only SUBSCRIBE, UNSUBSCRIBE and PING are allowed while subscribed, unless RESP3 is negotiated with HELLO 3")
+
+// subscribedCommands can be used in RESP2 while subscribed, as replies can't be
+// told apart from push messages
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE":   true,
+	"UNSUBSCRIBE": true,
+	"PING":        true,
+}
+
+// subscriptions of a connection. Messages matching one of the keys are popped
+// from the mailbox as they arrive, and delivered as push messages.
+type subscriptions struct {
+	out *replyConn
+	log Log
+
+	// keys subscribed to, in order of subscription
+	keys []string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSubscriptions(out *replyConn, log Log) *subscriptions {
+	return &subscriptions{out: out, log: log}
+}
+
+// count of subscribed keys
+func (subs *subscriptions) count() int {
+	return len(subs.keys)
+}
+
+// add a key, returns false if it was already subscribed to
+func (subs *subscriptions) add(key string) bool {
+	for _, k := range subs.keys {
+		if k == key {
+			return false
+		}
+	}
+	subs.keys = append(subs.keys, key)
+	return true
+}
+
+// remove a key, returns false if it was not subscribed to
+func (subs *subscriptions) remove(key string) bool {
+	for i, k := range subs.keys {
+		if k == key {
+			subs.keys = append(subs.keys[:i], subs.keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// start delivering messages for the subscribed keys. Delivery must be stopped
+// before the keys are changed.
+func (subs *subscriptions) start(ctx context.Context, c connection) {
+	if len(subs.keys) == 0 {
+		return
+	}
+
+	keys := make([]mailboxKey, 0, len(subs.keys))
+	for _, k := range subs.keys {
+		// keys are validated when they are subscribed to
+		dtid, subject, _ := parseKey(k)
+		keys = append(keys, mailboxKey{dtid: dtid, subject: subject})
+	}
+
+	ctx, subs.cancel = context.WithCancel(ctx)
+	subs.done = make(chan struct{})
+	go subs.deliver(ctx, c, keys, subs.done)
+}
+
+// stop delivering messages, waiting for a message being delivered
+func (subs *subscriptions) stop() {
+	if subs.cancel == nil {
+		return
+	}
+
+	subs.cancel()
+	<-subs.done
+	subs.cancel, subs.done = nil, nil
+}
+
+func (subs *subscriptions) deliver(ctx context.Context, c connection, keys []mailboxKey, done chan struct{}) {
+	defer close(done)
+
+	for {
+		msg, err := c.Next(ctx, keys)
+		if err != nil {
+			return
+		}
+
+		err = subs.out.push([]interface{}{"message", createKey(msg.Sender, msg.Topic), msg.Payload, msg.ID})
+		if err != nil {
+			// the message is lost, as it can't be put back in order
+			subs.log.WithField("id", msg.ID).WithField("error", err).Error("could not deliver message to subscriber")
+			subs.out.close()
+			return
+		}
+	}
+}
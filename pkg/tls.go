@@ -0,0 +1,305 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// selfSignedValidity is the validity of generated certificates
+const selfSignedValidity = 365 * 24 * time.Hour
+
+var errNoCertificate = errors.New("TLS requires a certificate and key file, or a self-signed certificate")
+
+// TLSConfig configures TLS on the RESP listener
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM encoded certificate chain and private
+	// key of the server
+	CertFile string
+	KeyFile  string
+	// SelfSigned generates a certificate if the certificate and key files
+	// don't exist. The certificate is written to the files if they are set, so
+	// clients can use it as CA, and kept in memory otherwise.
+	SelfSigned bool
+	// Hosts the self-signed certificate is valid for, names or IPs. Defaults
+	// to localhost and the hostname.
+	Hosts []string
+	// ClientCAFile is a PEM bundle of CAs. If set, clients must present a
+	// certificate signed by one of these CAs before they can send commands.
+	ClientCAFile string
+}
+
+// tlsCerts holds the certificates of a TLS listener. Files are checked for
+// changes on every handshake, so certificates can be replaced without a
+// restart.
+type tlsCerts struct {
+	cfg TLSConfig
+	log Log
+
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// modTimes of the files the certificates were loaded from
+	modTimes map[string]time.Time
+
+	lock sync.Mutex
+}
+
+// tlsCache shares the certificates of the listeners with the same TLS config,
+// so a self-signed certificate is generated once for all of them
+type tlsCache struct {
+	entries []*tlsCerts
+	lock    sync.Mutex
+}
+
+// certs for the config, loaded or generated on first use
+func (tc *tlsCache) certs(cfg TLSConfig, log Log) (*tlsCerts, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	for _, certs := range tc.entries {
+		if reflect.DeepEqual(certs.cfg, cfg) {
+			return certs, nil
+		}
+	}
+
+	certs, err := newTLSCerts(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	tc.entries = append(tc.entries, certs)
+
+	return certs, nil
+}
+
+func newTLSCerts(cfg TLSConfig, log Log) (*tlsCerts, error) {
+	c := &tlsCerts{cfg: cfg, log: log}
+
+	if cfg.SelfSigned && !fileExists(cfg.CertFile) && !fileExists(cfg.KeyFile) {
+		if err := c.generate(); err != nil {
+			return nil, err
+		}
+	} else if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errNoCertificate
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// config for the listener
+func (c *tlsCerts) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := c.current()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if clientCAs != nil {
+				cfg.ClientCAs = clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// current certificates, reloaded if the files changed. If reloading fails, the
+// previous certificates are kept.
+func (c *tlsCerts) current() (*tls.Certificate, *x509.CertPool) {
+	c.lock.Lock()
+	changed := c.changed()
+	c.lock.Unlock()
+
+	if changed {
+		if err := c.load(); err != nil {
+			c.log.WithField("error", err).Error("could not reload TLS certificates")
+		} else {
+			c.log.WithField("fingerprint", c.fingerprint()).Info("reloaded TLS certificates")
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.cert, c.clientCAs
+}
+
+// changed returns true if one of the files was modified since it was loaded
+func (c *tlsCerts) changed() bool {
+	for path, modTime := range c.modTimes {
+		info, err := os.Stat(path)
+		if err == nil && !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// load the certificates from the files. A generated certificate which is
+// only kept in memory is not reloaded.
+func (c *tlsCerts) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{c.cfg.CertFile, c.cfg.KeyFile, c.cfg.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return errors.Wrap(err, "could not read TLS file")
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	cert := c.cert
+	if c.cfg.CertFile != "" {
+		loaded, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+		if err != nil {
+			return errors.Wrap(err, "could not load TLS certificate")
+		}
+		cert = &loaded
+	}
+
+	var clientCAs *x509.CertPool
+	if c.cfg.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(c.cfg.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read client CA file")
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return errors.Errorf("no certificates found in client CA file %s", c.cfg.ClientCAFile)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cert = cert
+	c.clientCAs = clientCAs
+	c.modTimes = modTimes
+	return nil
+}
+
+// generate a self-signed certificate, and write it to the files if they are
+// set
+func (c *tlsCerts) generate() error {
+	hosts := c.cfg.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if hostname, err := os.Hostname(); err == nil {
+			hosts = append(hosts, hostname)
+		}
+	}
+
+	certPEM, keyPEM, err := selfSignedCert(hosts)
+	if err != nil {
+		return err
+	}
+
+	if c.cfg.CertFile == "" || c.cfg.KeyFile == "" {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return errors.Wrap(err, "could not load generated certificate")
+		}
+		c.cert = &cert
+		return nil
+	}
+
+	if err = ioutil.WriteFile(c.cfg.KeyFile, keyPEM, 0600); err != nil {
+		return errors.Wrap(err, "could not write TLS key")
+	}
+	if err = ioutil.WriteFile(c.cfg.CertFile, certPEM, 0644); err != nil {
+		return errors.Wrap(err, "could not write TLS certificate")
+	}
+	c.log.WithField("cert", c.cfg.CertFile).Info("generated self-signed TLS certificate")
+
+	return nil
+}
+
+// fingerprint is the hex encoded SHA-256 hash of the leaf certificate, so a
+// self-signed certificate can be verified out of band
+func (c *tlsCerts) fingerprint() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(c.cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// selfSignedCert generates a PEM encoded certificate and private key for the
+// hosts
+func selfSignedCert(hosts []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate TLS key")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate serial number")
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"tfagent"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		// the certificate is its own CA, so clients can trust it directly
+		IsCA: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create certificate")
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not encode TLS key")
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey})
+	return certPEM, keyPEM, nil
+}
+
+func fileExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,267 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// tlsHarness starts a broker serving TLS with the config
+func tlsHarness(t *testing.T, cfg TLSConfig, dtids ...uint64) *harness {
+	setup := func(s *Server) error { return s.EnableTLS(cfg) }
+	return newBrokerWith(t, NewMemoryNetwork(), newTestStore(t, dtids...), setup, dtids...)
+}
+
+// tlsClient connects to the harness over TLS, authenticated as the twin
+func (h *harness) tlsClient(dtid uint64, cfg *tls.Config) *redis.Client {
+	sig := h.store.sig(dtid)
+	client := redis.NewClient(&redis.Options{
+		Addr:       h.addr,
+		TLSConfig:  cfg,
+		MaxRetries: -1,
+		OnConnect: func(ctx context.Context, cn *redis.Conn) error {
+			return cn.Process(ctx, redis.NewStatusCmd(ctx, "AUTH", dtid, sig))
+		},
+	})
+	h.t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// certPool with the certificates of the PEM file
+func certPool(t *testing.T, path string) *x509.CertPool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		t.Fatal("no certificates in", path)
+	}
+	return pool
+}
+
+// testCA creates a CA for client certificates, and writes its certificate to
+// the directory
+func testCA(t *testing.T, dir string) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "ca.pem")
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, path
+}
+
+// clientCert signs a client certificate with the CA
+func clientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "twin"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestTLS(t *testing.T) {
+	dir := tempDir(t)
+	cfg := TLSConfig{
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		SelfSigned: true,
+	}
+	h := tlsHarness(t, cfg, 1)
+	ctx := context.Background()
+
+	info, err := os.Stat(cfg.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected generated key mode 0600, got %s", info.Mode())
+	}
+
+	c := h.tlsClient(1, &tls.Config{RootCAs: certPool(t, cfg.CertFile)})
+	if err := c.Do(ctx, "LPUSH", "1:chat", "hello").Err(); err != nil {
+		t.Fatal(err)
+	}
+	clients := h.server.Clients()
+	if len(clients) != 1 || !clients[0].TLS || clients[0].Twin != 1 {
+		t.Errorf("expected an authenticated TLS client, got %+v", clients)
+	}
+
+	// the certificate is verified
+	if err := h.tlsClient(1, &tls.Config{}).Ping(ctx).Err(); err == nil {
+		t.Error("expected untrusted certificate to be rejected")
+	}
+	// plain connections don't get a reply
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	if err := h.anonClient().Ping(ctx).Err(); err == nil {
+		t.Error("expected plain connection to fail")
+	}
+}
+
+func TestTLSInMemory(t *testing.T) {
+	h := tlsHarness(t, TLSConfig{SelfSigned: true, Hosts: []string{"127.0.0.1"}}, 1)
+
+	c := h.tlsClient(1, &tls.Config{InsecureSkipVerify: true})
+	if err := c.Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newTLSCerts(TLSConfig{}, &NOOPLogger{}); err != errNoCertificate {
+		t.Errorf("expected missing certificate error, got %v", err)
+	}
+}
+
+func TestTLSShared(t *testing.T) {
+	cfg := TLSConfig{SelfSigned: true, Hosts: []string{"127.0.0.1"}}
+	setup := func(s *Server) error {
+		if err := s.EnableTLS(cfg); err != nil {
+			return err
+		}
+		return s.Listen(ListenerConfig{Address: "127.0.0.1:0", TLS: &cfg})
+	}
+	h := newBrokerWith(t, NewMemoryNetwork(), newTestStore(t, 1), setup, 1)
+
+	// the self-signed certificate is generated once for all listeners
+	var certs [][]byte
+	for _, addr := range h.server.Addrs() {
+		conn, err := tls.Dial("tcp", addr.String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, conn.ConnectionState().PeerCertificates[0].Raw)
+		conn.Close()
+	}
+	if len(certs) != 2 || !bytes.Equal(certs[0], certs[1]) {
+		t.Error("expected listeners to serve the same certificate")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := tempDir(t)
+	ca, caKey, caFile := testCA(t, dir)
+	cfg := TLSConfig{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		SelfSigned:   true,
+		ClientCAFile: caFile,
+	}
+	h := tlsHarness(t, cfg, 1)
+	ctx := context.Background()
+	roots := certPool(t, cfg.CertFile)
+
+	if err := h.tlsClient(1, &tls.Config{RootCAs: roots}).Ping(ctx).Err(); err == nil {
+		t.Error("expected client without certificate to be rejected")
+	}
+
+	// a certificate of another CA is rejected too
+	other, otherKey, _ := testCA(t, tempDir(t))
+	bad := clientCert(t, other, otherKey)
+	if err := h.tlsClient(1, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{bad}}).Ping(ctx).Err(); err == nil {
+		t.Error("expected certificate of unknown CA to be rejected")
+	}
+
+	cert := clientCert(t, ca, caKey)
+	c := h.tlsClient(1, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	if err := c.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := tempDir(t)
+	cfg := TLSConfig{
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		SelfSigned: true,
+	}
+	h := tlsHarness(t, cfg, 1)
+	ctx := context.Background()
+
+	old := certPool(t, cfg.CertFile)
+	if err := h.tlsClient(1, &tls.Config{RootCAs: old}).Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, keyPEM, err := selfSignedCert([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(cfg.KeyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(cfg.CertFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time changes on coarse filesystems
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{cfg.CertFile, cfg.KeyFile} {
+		if err = os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := h.tlsClient(1, &tls.Config{RootCAs: certPool(t, cfg.CertFile)}).Ping(ctx).Err(); err != nil {
+		t.Fatalf("expected reloaded certificate to be served, got %v", err)
+	}
+	if err := h.tlsClient(1, &tls.Config{RootCAs: old}).Ping(ctx).Err(); err == nil {
+		t.Error("expected old certificate to be replaced")
+	}
+}
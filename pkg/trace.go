@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceLogSize is the amount of events kept in the trace log of a node
+const traceLogSize = 10000
+
+const tracerName = "github.com/threefoldtech/tfagent"
+
+// events in the lifecycle of a message at a broker
+const (
+	eventAccepted     = "accepted"
+	eventSent         = "sent"
+	eventQueued       = "queued"
+	eventFailed       = "send failed"
+	eventReceived     = "received"
+	eventDenied       = "denied"
+	eventEnqueued     = "enqueued"
+	eventPopped       = "popped"
+	eventLeased       = "leased"
+	eventAcked        = "acknowledged"
+	eventRedelivered  = "redelivered"
+	eventRemoved      = "removed"
+	eventExpired      = "expired"
+	eventDeadLettered = "dead lettered"
+)
+
+// propagator carries span contexts in the Trace field of messages
+var propagator = propagation.TraceContext{}
+
+// TraceEvent is an event in the lifecycle of a message at this broker
+type TraceEvent struct {
+	// ID of the message
+	ID string `json:"id"`
+	// Sender of the message
+	Sender uint64 `json:"sender"`
+	// Receiver of the message
+	Receiver uint64 `json:"receiver"`
+	// Time of the event
+	Time time.Time `json:"time"`
+	// Event which happened
+	Event string `json:"event"`
+	// Detail of the event, e.g. the error for a failed send
+	Detail string `json:"detail,omitempty"`
+}
+
+func (te TraceEvent) String() string {
+	s := fmt.Sprintf("%s %s", te.Time.UTC().Format(time.RFC3339Nano), te.Event)
+	if te.Detail != "" {
+		s += ": " + te.Detail
+	}
+	return s
+}
+
+// traceLog is a ring buffer of the most recent trace events
+type traceLog struct {
+	events []TraceEvent
+	next   int
+	full   bool
+	lock   sync.Mutex
+}
+
+func newTraceLog(size int) *traceLog {
+	return &traceLog{events: make([]TraceEvent, size)}
+}
+
+func (tl *traceLog) add(event TraceEvent) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+
+	tl.events[tl.next] = event
+	tl.next = (tl.next + 1) % len(tl.events)
+	if tl.next == 0 {
+		tl.full = true
+	}
+}
+
+// lookup the events of the message which are still in the log, oldest first
+func (tl *traceLog) lookup(id string) []TraceEvent {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+
+	start, n := 0, tl.next
+	if tl.full {
+		start, n = tl.next, len(tl.events)
+	}
+
+	out := []TraceEvent{}
+	for i := 0; i < n; i++ {
+		event := tl.events[(start+i)%len(tl.events)]
+		if event.ID == id {
+			out = append(out, event)
+		}
+	}
+
+	return out
+}
+
+// injectSpan stores the span context of the context in the message, so the
+// remote broker can continue the trace
+func injectSpan(ctx context.Context, msg *Message) {
+	carrier := traceCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		msg.Trace = carrier
+	}
+}
+
+// extractSpan returns a context with the span context stored in the message
+func extractSpan(msg Message) context.Context {
+	return propagator.Extract(context.Background(), traceCarrier(msg.Trace))
+}
+
+// traceCarrier is a propagation.TextMapCarrier on the Trace field of a message
+type traceCarrier map[string]string
+
+func (c traceCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c traceCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c traceCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// noopTracer is used if no tracer provider is configured
+var noopTracer = trace.NewNoopTracerProvider().Tracer(tracerName)
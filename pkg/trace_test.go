@@ -0,0 +1,176 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// events returns the event names of the trace reply, without the timestamps
+func events(t *testing.T, reply []string) []string {
+	out := make([]string, len(reply))
+	for i, line := range reply {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			t.Fatalf("malformed trace line %q", line)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+			t.Fatalf("malformed trace time %q: %v", line, err)
+		}
+		out[i] = parts[1]
+	}
+	return out
+}
+
+func TestTraceAcrossBrokers(t *testing.T) {
+	network := NewMemoryNetwork()
+	store := newTestStore(t, 1, 2, 3)
+	b1 := newBroker(t, network, store, 1)
+	b2 := newBroker(t, network, store, 2, 3)
+	ctx := context.Background()
+
+	c1, c2, c3 := b1.client(1), b2.client(2), b2.client(3)
+
+	id, err := c1.Do(ctx, "LPUSHID", "2:chat", "hello").Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("expected a message ID as LPUSH reply")
+	}
+
+	b2.eventually(func() bool { return c2.LLen(ctx, "0:").Val() == 1 }, "message was not delivered to twin 2")
+	if mailbox := b2.node.Mailbox(2); len(mailbox) != 1 || mailbox[0].ID != id {
+		t.Fatalf("expected message ID %s to be propagated, got %+v", id, mailbox)
+	}
+	if err := c2.Do(ctx, "LPOP", "0:").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := c1.Do(ctx, "TRACE", id).StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"accepted", "sent: " + b2.node.PeerID()}
+	if got := events(t, reply); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected sender trace %v, got %v", expected, got)
+	}
+
+	reply, err = c2.Do(ctx, "TRACE", id).StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"received", "enqueued", "popped"}
+	if got := events(t, reply); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected receiver trace %v, got %v", expected, got)
+	}
+
+	// twins which are not involved don't see the trace
+	reply, err = c3.Do(ctx, "TRACE", id).StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 0 {
+		t.Errorf("expected no trace for twin 3, got %v", reply)
+	}
+
+	var trace []TraceEvent
+	if code := b2.admin(store)(http.MethodGet, "/messages/"+id+"/trace", &trace); code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	if len(trace) != 3 || trace[0].Event != eventReceived || trace[0].Sender != 1 || trace[0].Receiver != 2 {
+		t.Errorf("unexpected admin trace %+v", trace)
+	}
+}
+
+func TestTraceDenied(t *testing.T) {
+	network := NewMemoryNetwork()
+	store := newTestStore(t, 1, 2)
+	b1 := newBroker(t, network, store, 1)
+	b2 := newBroker(t, network, store, 2)
+	ctx := context.Background()
+
+	c2 := b2.client(2)
+	if err := c2.Do(ctx, "ACL", "DENY", "1").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := b1.client(1)
+	if err := c1.Do(ctx, "LPUSHID", "2:chat", "hello").Err(); err == nil {
+		t.Fatal("expected message to be rejected")
+	}
+	letter, err := c1.Do(ctx, "DEADLETTER", "POP", "2:chat").StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := letter[2]
+
+	b2.eventually(func() bool { return len(b2.node.Trace(id)) == 2 }, "message was not traced at the receiver")
+	reply, err := c2.Do(ctx, "TRACE", id).StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"received", "denied: receiver ACL"}
+	if got := events(t, reply); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected trace %v, got %v", expected, got)
+	}
+}
+
+func TestTraceLog(t *testing.T) {
+	tl := newTraceLog(3)
+	if events := tl.lookup("a"); len(events) != 0 {
+		t.Errorf("expected no events, got %+v", events)
+	}
+
+	for i, id := range []string{"a", "b", "a", "a", "b"} {
+		tl.add(TraceEvent{ID: id, Detail: string(rune('0' + i))})
+	}
+
+	// the first two events are overwritten
+	var details []string
+	for _, event := range tl.lookup("a") {
+		details = append(details, event.Detail)
+	}
+	if !reflect.DeepEqual(details, []string{"2", "3"}) {
+		t.Errorf("expected the remaining events in order, got %v", details)
+	}
+	if events := tl.lookup("b"); len(events) != 1 || events[0].Detail != "4" {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestSpanPropagation(t *testing.T) {
+	node := NewBufferedNode(newTestStore(t), NewMemoryNetwork().NewTransport())
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	msg := msg(1, 2, "chat", "hello")
+
+	ctx, span := node.startSpan(trace.ContextWithRemoteSpanContext(context.Background(), parent), "test", msg, trace.SpanKindProducer)
+	injectSpan(ctx, &msg)
+	span.End()
+
+	if msg.Trace["traceparent"] == "" {
+		t.Fatalf("expected span context in message, got %v", msg.Trace)
+	}
+
+	remote := trace.SpanContextFromContext(extractSpan(msg))
+	if remote.TraceID() != parent.TraceID() || !remote.IsRemote() {
+		t.Errorf("expected trace %s to be propagated, got %s", parent.TraceID(), remote.TraceID())
+	}
+
+	// messages without span context don't get one
+	msg.Trace = nil
+	injectSpan(context.Background(), &msg)
+	if msg.Trace != nil {
+		t.Errorf("expected no span context, got %v", msg.Trace)
+	}
+}
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Transport exchanges messages with the transports of other peers
+type Transport interface {
+	// Start the transport, using the private key as identity
+	Start(ctx context.Context, privateKey crypto.PrivKey) error
+	// Send a message to a peer. The addresses of the peer are optional hints,
+	// used before looking up the peer. If the peer can't be reached before the
+	// timeout, the returned error wraps context.DeadlineExceeded.
+	Send(message Message, remote peer.AddrInfo, timeout time.Duration) error
+	// PeerID of the transport, only valid once the transport is started
+	PeerID() string
+	// Addrs the transport can currently be reached on, as multiaddrs without
+	// the peer ID
+	Addrs() []string
+	// Messages received from other peers
+	Messages() <-chan Message
+}
+
+// Receiver is an optional extension of a Transport, which hands the received
+// messages to a function instead of the Messages channel. If the function
+// returns an error, the message is rejected, and Send of the sending peer
+// returns a RejectedError.
+type Receiver interface {
+	// SetReceiver sets the function receiving the messages. It must be
+	// called before the transport is started.
+	SetReceiver(receive func(Message) error)
+}
+
+// RejectedError is returned by Send if the receiving peer rejected the message
+type RejectedError struct {
+	// Reason the message was rejected, as reported by the receiving peer
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "rejected by receiver: " + e.Reason
+}
+
+// PeerLister is an optional extension of a Transport, listing the peers it is
+// currently connected to
+type PeerLister interface {
+	// Peers the transport is connected to
+	Peers() []PeerInfo
+}
+
+// PeerInfo describes a connected peer
+type PeerInfo struct {
+	// ID of the peer
+	ID string `json:"id"`
+	// Addrs of the connections to the peer, as multiaddrs
+	Addrs []string `json:"addrs"`
+}
+
+// sendError annotates a failed send with the stage it failed in
+type sendError struct {
+	stage string
+	err   error
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.err
+}
@@ -1,7 +1,9 @@
 package pkg
 
 import (
+	"context"
 	"encoding/hex"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -50,8 +52,13 @@ func (conn *unauthenticatedConn) Auth(dtid uint64, rawSig []byte) error {
 }
 
 // LPush implements connection
-func (conn *unauthenticatedConn) LPush(_ uint64, _ string, _ []byte) error {
-	return errNotAuthenticated
+func (conn *unauthenticatedConn) LPush(_ uint64, _ string, _ []byte) (string, error) {
+	return "", errNotAuthenticated
+}
+
+// RPush implements connection
+func (conn *unauthenticatedConn) RPush(_ uint64, _ string, _ []byte) (string, error) {
+	return "", errNotAuthenticated
 }
 
 // LPop implements connection
@@ -59,12 +66,117 @@ func (conn *unauthenticatedConn) LPop(_ uint64, _ string) (Message, error) {
 	return Message{}, errNotAuthenticated
 }
 
+// RPop implements connection
+func (conn *unauthenticatedConn) RPop(_ uint64, _ string) (Message, error) {
+	return Message{}, errNotAuthenticated
+}
+
 // LLen implements connection
-func (conn *unauthenticatedConn) LLen(_ uint64, _ string) error {
-	return errNotAuthenticated
+func (conn *unauthenticatedConn) LLen(_ uint64, _ string) (uint64, error) {
+	return 0, errNotAuthenticated
 }
 
 // LRange implements connection
 func (conn *unauthenticatedConn) LRange(_ uint64, _ string, _ int, _ int) ([]Message, error) {
 	return nil, errNotAuthenticated
 }
+
+// LIndex implements connection
+func (conn *unauthenticatedConn) LIndex(_ uint64, _ string, _ int) (Message, error) {
+	return Message{}, errNotAuthenticated
+}
+
+// LRem implements connection
+func (conn *unauthenticatedConn) LRem(_ uint64, _ string, _ int, _ []byte) (uint64, error) {
+	return 0, errNotAuthenticated
+}
+
+// LTrim implements connection
+func (conn *unauthenticatedConn) LTrim(_ uint64, _ string, _ int, _ int) error {
+	return errNotAuthenticated
+}
+
+// LPos implements connection
+func (conn *unauthenticatedConn) LPos(_ uint64, _ string, _ []byte, _ int, _ int, _ int) ([]int, error) {
+	return nil, errNotAuthenticated
+}
+
+// LPopMsg implements connection
+func (conn *unauthenticatedConn) LPopMsg(_ uint64, _ string) (Message, error) {
+	return Message{}, errNotAuthenticated
+}
+
+// Lease implements connection
+func (conn *unauthenticatedConn) Lease(_ uint64, _ string, _ time.Duration) (Message, string, error) {
+	return Message{}, "", errNotAuthenticated
+}
+
+// Ack implements connection
+func (conn *unauthenticatedConn) Ack(_ []string) (uint64, error) {
+	return 0, errNotAuthenticated
+}
+
+// Nack implements connection
+func (conn *unauthenticatedConn) Nack(_ []string) (uint64, error) {
+	return 0, errNotAuthenticated
+}
+
+// Next implements connection
+func (conn *unauthenticatedConn) Next(_ context.Context, _ []mailboxKey) (Message, error) {
+	return Message{}, errNotAuthenticated
+}
+
+// Peek implements connection
+func (conn *unauthenticatedConn) Peek(_ context.Context, _ []mailboxKey) (Message, error) {
+	return Message{}, errNotAuthenticated
+}
+
+// Call implements connection
+func (conn *unauthenticatedConn) Call(_ context.Context, _ uint64, _ string, _ []byte, _ time.Duration) (Message, error) {
+	return Message{}, errNotAuthenticated
+}
+
+// Reply implements connection
+func (conn *unauthenticatedConn) Reply(_ uint64, _ string, _ string, _ []byte) (string, error) {
+	return "", errNotAuthenticated
+}
+
+// Trace implements connection
+func (conn *unauthenticatedConn) Trace(_ string) ([]TraceEvent, error) {
+	return nil, errNotAuthenticated
+}
+
+// DeadLetters implements connection
+func (conn *unauthenticatedConn) DeadLetters(_ uint64, _ string) ([]DeadLetter, error) {
+	return nil, errNotAuthenticated
+}
+
+// DeadLetterPop implements connection
+func (conn *unauthenticatedConn) DeadLetterPop(_ uint64, _ string) (DeadLetter, error) {
+	return DeadLetter{}, errNotAuthenticated
+}
+
+// SetBounce implements connection
+func (conn *unauthenticatedConn) SetBounce(_ bool) error {
+	return errNotAuthenticated
+}
+
+// ACLSet implements connection
+func (conn *unauthenticatedConn) ACLSet(_ uint64, _ string, _ bool) error {
+	return errNotAuthenticated
+}
+
+// ACLDel implements connection
+func (conn *unauthenticatedConn) ACLDel(_ uint64, _ string) (bool, error) {
+	return false, errNotAuthenticated
+}
+
+// ACLList implements connection
+func (conn *unauthenticatedConn) ACLList() ([]ACLRule, error) {
+	return nil, errNotAuthenticated
+}
+
+// ACLReset implements connection
+func (conn *unauthenticatedConn) ACLReset() error {
+	return errNotAuthenticated
+}
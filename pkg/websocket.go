@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// webSocketPrefix of the address of a listener accepting RESP over WebSocket
+const webSocketPrefix = "ws://"
+
+var errListenerClosed = errors.New("listener closed")
+
+// wsListener accepts WebSocket connections on a path of an http server. The
+// connections carry RESP in binary or text messages, and are accepted as
+// net.Conn, so they are handled like any other connection of the server.
+type wsListener struct {
+	ln    net.Listener
+	srv   *http.Server
+	conns chan net.Conn
+
+	serve sync.Once
+	// done is closed once the listener is closed or the http server failed,
+	// err is set before
+	done  chan struct{}
+	close sync.Once
+	err   error
+}
+
+// newWSListener upgrades requests on the path to WebSocket connections.
+// Browsers can only connect from the allowed origins, which default to the
+// origin of the server itself. Clients which don't send an Origin header are
+// not restricted.
+func newWSListener(ln net.Listener, path string, origins []string, log Log) *wsListener {
+	l := &wsListener{
+		ln:    ln,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: checkOrigin(origins)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if !upgrader.CheckOrigin(r) {
+			log.WithField("origin", r.Header.Get("Origin")).WithField("remote", r.RemoteAddr).Warn("rejected WebSocket connection from origin")
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader replied with the error
+			return
+		}
+
+		conn := &wsConn{Conn: ws, tls: r.TLS != nil}
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			conn.Close()
+		}
+	})
+	l.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return l
+}
+
+// checkOrigin allows requests without an Origin header, requests from the
+// origin of the server if no origins are given, and requests from one of the
+// origins otherwise. "*" allows all origins.
+func checkOrigin(origins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if len(origins) == 0 {
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		}
+		for _, allowed := range origins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Accept implements net.Listener. The http server is started on the first
+// call.
+func (l *wsListener) Accept() (net.Conn, error) {
+	l.serve.Do(func() {
+		go func() {
+			err := l.srv.Serve(l.ln)
+			if err != http.ErrServerClosed {
+				l.fail(errors.Wrap(err, "WebSocket server failed"))
+			}
+		}()
+	})
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// fail stops accepting connections with the error
+func (l *wsListener) fail(err error) {
+	l.close.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+// Close implements net.Listener. Accepted connections are not closed.
+func (l *wsListener) Close() error {
+	l.fail(errListenerClosed)
+	return l.srv.Close()
+}
+
+// Addr implements net.Listener
+func (l *wsListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// wsConn is a net.Conn reading from and writing to WebSocket messages. Every
+// write is sent as a single binary message.
+type wsConn struct {
+	*websocket.Conn
+	// r reads the current message
+	r io.Reader
+	// tls is set if the WebSocket connection is served over TLS
+	tls bool
+}
+
+// Read implements net.Conn. Messages are read as a stream, a client closing
+// the connection is reported as io.EOF.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write implements net.Conn
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SetDeadline implements net.Conn
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+const testOrigin = "https://dashboard.example"
+
+// wsHarness starts a broker with a WebSocket endpoint on /resp
+func wsHarness(t *testing.T, cfg ListenerConfig, dtids ...uint64) (*harness, string) {
+	cfg.Address = "ws://127.0.0.1:0/resp"
+	setup := func(s *Server) error {
+		return s.Listen(cfg)
+	}
+	h := newBrokerWith(t, NewMemoryNetwork(), newTestStore(t, dtids...), setup, dtids...)
+
+	return h, fmt.Sprintf("127.0.0.1:%d", h.server.Addrs()[1].(*net.TCPAddr).Port)
+}
+
+// dialWS opens a WebSocket connection from the origin
+func dialWS(t *testing.T, dialer *websocket.Dialer, url string, origin string) (net.Conn, error) {
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	ws, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%s: %d", err, resp.StatusCode)
+		}
+		return nil, err
+	}
+	conn := &wsConn{Conn: ws}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, nil
+}
+
+func TestWebSocket(t *testing.T) {
+	h, addr := wsHarness(t, ListenerConfig{AllowedOrigins: []string{testOrigin}}, 1, 2)
+	ctx := context.Background()
+	url := "ws://" + addr + "/resp"
+
+	// go-redis can use the WebSocket connection like any other
+	sig := h.store.sig(1)
+	client := redis.NewClient(&redis.Options{
+		Addr: addr,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialWS(t, websocket.DefaultDialer, url, testOrigin)
+		},
+		OnConnect: func(ctx context.Context, cn *redis.Conn) error {
+			return cn.Process(ctx, redis.NewStatusCmd(ctx, "AUTH", 1, sig))
+		},
+	})
+	defer client.Close()
+
+	if err := client.Do(ctx, "LPUSH", "2:chat", "hello").Err(); err != nil {
+		t.Fatal(err)
+	}
+	h.eventually(func() bool {
+		n, err := h.client(2).LLen(ctx, "1:chat").Result()
+		return err == nil && n == 1
+	}, "message sent over WebSocket was not delivered")
+
+	var found bool
+	for _, info := range h.server.Clients() {
+		if info.Listener == "ws://127.0.0.1:0/resp" {
+			found = info.Twin == 1 && !info.TLS
+		}
+	}
+	if !found {
+		t.Errorf("WebSocket client is not listed, got %+v", h.server.Clients())
+	}
+
+	// messages are pushed to subscribed clients
+	conn, err := dialWS(t, websocket.DefaultDialer, url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &respConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.do("HELLO", 3, "AUTH", 2, h.store.sig(2))
+	c.do("SUBSCRIBE", "1:news")
+	if err := client.Do(ctx, "LPUSH", "2:news", "hi").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if reply, ok := c.read().(push); !ok || !reflect.DeepEqual(reply[:3], push{"message", "1:news", "hi"}) {
+		t.Errorf("unexpected push message %v", reply)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	_, addr := wsHarness(t, ListenerConfig{AllowedOrigins: []string{testOrigin}}, 1)
+	url := "ws://" + addr + "/resp"
+
+	if _, err := dialWS(t, websocket.DefaultDialer, url, "https://evil.example"); err == nil {
+		t.Error("expected connection from other origin to be rejected")
+	}
+	if _, err := dialWS(t, websocket.DefaultDialer, "ws://"+addr+"/other", testOrigin); err == nil {
+		t.Error("expected connection to other path to be rejected")
+	}
+
+	// the default is the origin of the endpoint itself
+	_, addr = wsHarness(t, ListenerConfig{}, 1)
+	url = "ws://" + addr + "/resp"
+	if _, err := dialWS(t, websocket.DefaultDialer, url, testOrigin); err == nil {
+		t.Error("expected connection from other origin to be rejected")
+	}
+	if _, err := dialWS(t, websocket.DefaultDialer, url, "http://"+addr); err != nil {
+		t.Errorf("expected connection from same origin, got %v", err)
+	}
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	h, addr := wsHarness(t, ListenerConfig{TLS: &TLSConfig{SelfSigned: true, Hosts: []string{"127.0.0.1"}}}, 1)
+
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	if _, err := dialWS(t, dialer, "ws://"+addr+"/resp", ""); err == nil {
+		t.Error("expected plain connection to fail")
+	}
+	conn, err := dialWS(t, dialer, "wss://"+addr+"/resp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &respConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if reply := c.do("AUTH", 1, h.store.sig(1)); reply != "Authenticated" {
+		t.Fatalf("expected to authenticate, got %v", reply)
+	}
+
+	for _, info := range h.server.Clients() {
+		if info.Twin == 1 && !info.TLS {
+			t.Errorf("expected WebSocket client to use TLS, got %+v", info)
+		}
+	}
+}